@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"log"
+	"path/filepath"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/pgstore"
+	"github.com/jackc/pgx/v5"
+)
+
+// Returns the location of the blob with the given hash in the store.
+func (dc *DogboxController) getBlobPath(hash string) string {
+	return filepath.Join("blobs", hash)
+}
+
+// Returns the location of a post's contents in the store. Posts uploaded
+// before content-addressed storage existed are still kept under their public
+// filename.
+func (dc *DogboxController) objectPath(p *db.Post) string {
+	if p.BlobHash != nil {
+		return dc.getBlobPath(*p.BlobHash)
+	}
+	return dc.getImagePath(*p.Filename)
+}
+
+// Writes the contents of a blob that has just been acquired to the store,
+// unless another post already stored them. An object that has gone missing is
+// written again. Reports whether the object was written.
+func (dc *DogboxController) storeBlob(
+	ctx context.Context,
+	st store.Store,
+	blob *db.Blob,
+	r io.Reader,
+) (bool, error) {
+	blobPath := dc.getBlobPath(blob.Hash)
+
+	if blob.Refcount > 1 {
+		_, err := st.Size(ctx, blobPath)
+		if err == nil {
+			return false, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return false, err
+		}
+	}
+
+	dstWriter := store.NewWriter(ctx, st, blobPath)
+	defer dstWriter.Abort()
+
+	if _, err := store.ContextCopy(ctx, dstWriter, r); err != nil {
+		return false, err
+	}
+
+	// Wait for the object to be durable before the post can be committed.
+	if err := dstWriter.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Marks a post as removed, releases the storage it was charged to its owner,
+// and releases its blob, deleting the blob once no post refers to it anymore.
+// Returns pgx.ErrNoRows if the post has already been removed.
+func (dc *DogboxController) removePost(ctx context.Context, p *db.Post) error {
+	tx, err := dc.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	qtx := dc.db.WithTx(tx)
+
+	if _, err := qtx.RemovePost(ctx, p.ID); err != nil {
+		return err
+	}
+
+	if p.OwnerID != nil && p.Size != nil {
+		if err := qtx.ReleaseUsage(ctx, db.ReleaseUsageParams{
+			Size: *p.Size,
+			ID:   *p.OwnerID,
+		}); err != nil {
+			return err
+		}
+	}
+
+	// Links have no stored contents.
+	if p.Kind == db.PostKindLink {
+		return tx.Commit(ctx)
+	}
+
+	// Posts uploaded before blobs existed own their object outright.
+	if p.BlobHash == nil {
+		if err := tx.Commit(ctx); err != nil {
+			return err
+		}
+
+		imPath := dc.getImagePath(*p.Filename)
+		err := dc.store.Delete(ctx, imPath)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("delete: post %d: %v\n", p.ID, err)
+		}
+		return nil
+	}
+
+	blob, err := qtx.ReleaseBlob(ctx, *p.BlobHash)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	// The post is gone either way, so the blob is deleted even if the
+	// request that removed it goes away.
+	if blob.Refcount == 0 {
+		err := dc.deleteBlob(context.WithoutCancel(ctx), blob.Hash)
+		if err != nil {
+			log.Printf("delete: blob %s: %v\n", blob.Hash, err)
+		}
+	}
+
+	return nil
+}
+
+// Deletes a blob that no post refers to anymore, along with its object. The
+// blob's row stays locked until the object is gone, so an upload of the same
+// contents either acquires the blob first, in which case it is kept, or waits
+// and writes the object again. A blob whose deletion fails is left for the
+// next upload of the same contents, which rewrites its object.
+func (dc *DogboxController) deleteBlob(ctx context.Context, hash string) error {
+	tx, err := dc.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	qtx := dc.db.WithTx(tx)
+
+	blob, err := qtx.LockBlob(ctx, hash)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if blob.Refcount > 0 {
+		return nil
+	}
+
+	err = dc.store.Delete(pgstore.WithTx(ctx, tx), dc.getBlobPath(hash))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if err := qtx.DeleteBlob(ctx, hash); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// A maintenance command, run with `dogbox <name> [flags]` instead of
+// starting the server.
+type command func(ctx context.Context, dc *DogboxController, args []string) error
+
+var commands = map[string]command{
+	"repair":   runRepair,
+	"scrub":    runScrub,
+	"rekey":    runRekey,
+	"tier":     runTier,
+	"relayout": runRelayout,
+	"expire":   runExpire,
+}
+
+// Runs the named command until it finishes or the process is interrupted.
+func runCommand(dc *DogboxController, name string, args []string) error {
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("Unknown command: %s", name)
+	}
+
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		os.Interrupt,
+		syscall.SIGTERM,
+	)
+	defer stop()
+
+	return cmd(ctx, dc, args)
+}
@@ -4,6 +4,8 @@ import (
 	"crypto/sha256"
 	"fmt"
 	"log"
+	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -24,9 +26,56 @@ type Config struct {
 	DogboxDataDir string `mapstructure:"DOGBOX_DATA_DIR"`
 	DogboxAPIKey  string `mapstructure:"DOGBOX_API_KEY"`
 
+	// Key of the signatures on shared links. Derived from the API key when
+	// empty.
+	DogboxURLSigningKey   string        `mapstructure:"DOGBOX_URL_SIGNING_KEY"`
+	DogboxShareDefaultTTL time.Duration `mapstructure:"DOGBOX_SHARE_DEFAULT_TTL"`
+	DogboxShareMaxTTL     time.Duration `mapstructure:"DOGBOX_SHARE_MAX_TTL"`
+
+	DogboxExpiryInterval time.Duration `mapstructure:"DOGBOX_EXPIRY_INTERVAL"`
+
+	DogboxLinkBlocklist string `mapstructure:"DOGBOX_LINK_BLOCKLIST"`
+
+	DogboxDefaultQuotaBytes int64 `mapstructure:"DOGBOX_DEFAULT_QUOTA_BYTES"`
+	DogboxDefaultQuotaFiles int64 `mapstructure:"DOGBOX_DEFAULT_QUOTA_FILES"`
+
+	DogboxStorageConfig   string `mapstructure:"DOGBOX_STORAGE_CONFIG"`
+	DogboxDatabaseStorage bool   `mapstructure:"DOGBOX_DATABASE_STORAGE"`
+
+	DogboxShardLevels int `mapstructure:"DOGBOX_SHARD_LEVELS"`
+	DogboxShardWidth  int `mapstructure:"DOGBOX_SHARD_WIDTH"`
+
 	PageSize int `mapstructure:"PAGE_SIZE"`
 
+	DogboxScrubInterval   time.Duration `mapstructure:"DOGBOX_SCRUB_INTERVAL"`
+	DogboxScrubRate       int           `mapstructure:"DOGBOX_SCRUB_RATE"`
+	DogboxScrubQuarantine bool          `mapstructure:"DOGBOX_SCRUB_QUARANTINE"`
+	DogboxAlertWebhook    string        `mapstructure:"DOGBOX_ALERT_WEBHOOK"`
+
+	DogboxSFTPAddr       string `mapstructure:"DOGBOX_SFTP_ADDR"`
+	DogboxSFTPUser       string `mapstructure:"DOGBOX_SFTP_USER"`
+	DogboxSFTPKeyFile    string `mapstructure:"DOGBOX_SFTP_KEY_FILE"`
+	DogboxSFTPKnownHosts string `mapstructure:"DOGBOX_SFTP_KNOWN_HOSTS"`
+	DogboxSFTPRoot       string `mapstructure:"DOGBOX_SFTP_ROOT"`
+	DogboxSFTPPoolSize   int    `mapstructure:"DOGBOX_SFTP_POOL_SIZE"`
+
+	DogboxEncryptionKeys  string `mapstructure:"DOGBOX_ENCRYPTION_KEYS"`
+	DogboxEncryptionKeyID string `mapstructure:"DOGBOX_ENCRYPTION_KEY_ID"`
+	DogboxCompression     bool   `mapstructure:"DOGBOX_COMPRESSION"`
+
+	DogboxCacheDir        string `mapstructure:"DOGBOX_CACHE_DIR"`
+	DogboxCacheDiskSize   int64  `mapstructure:"DOGBOX_CACHE_DISK_SIZE"`
+	DogboxCacheMemorySize int64  `mapstructure:"DOGBOX_CACHE_MEMORY_SIZE"`
+
+	DogboxColdDataDir  string        `mapstructure:"DOGBOX_COLD_DATA_DIR"`
+	DogboxTierMaxAge   time.Duration `mapstructure:"DOGBOX_TIER_MAX_AGE"`
+	DogboxTierMaxIdle  time.Duration `mapstructure:"DOGBOX_TIER_MAX_IDLE"`
+	DogboxTierInterval time.Duration `mapstructure:"DOGBOX_TIER_INTERVAL"`
+
 	DecodedAPIKey []byte
+	SigningKey    []byte
+	// Lowercased domains from DOGBOX_LINK_BLOCKLIST.
+	LinkBlocklist []string
 }
 
 func (c *Config) GetDBUrl() string {
@@ -60,5 +109,25 @@ func LoadConfig(v *viper.Viper, path string) (config Config) {
 	key := sha256.Sum256([]byte(config.DogboxAPIKey))
 	config.DecodedAPIKey = key[:]
 
+	// Shared links stop working when the key they were signed with changes.
+	if config.DogboxURLSigningKey != "" {
+		config.SigningKey = []byte(config.DogboxURLSigningKey)
+	} else {
+		signingKey := sha256.Sum256(
+			[]byte("dogbox url signing\n" + config.DogboxAPIKey),
+		)
+		config.SigningKey = signingKey[:]
+	}
+
+	for _, domain := range strings.Split(config.DogboxLinkBlocklist, ",") {
+		domain = strings.TrimSuffix(strings.TrimSpace(domain), ".")
+		if domain != "" {
+			config.LinkBlocklist = append(
+				config.LinkBlocklist,
+				strings.ToLower(domain),
+			)
+		}
+	}
+
 	return
 }
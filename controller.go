@@ -8,17 +8,21 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
 	db "github.com/Fekinox/dogbox-main/db/sqlc"
 	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/pgstore"
 	"github.com/gin-gonic/gin"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/sqids/sqids-go"
 )
 
@@ -26,8 +30,10 @@ type DogboxController struct {
 	db     *db.Queries
 	cfg    Config
 	router *gin.Engine
-	conn   *pgx.Conn
-	sqids  *sqids.Sqids
+	// Shared by the request handlers and the background jobs, each of which
+	// borrows a connection for as long as it needs one.
+	pool  *pgxpool.Pool
+	sqids *sqids.Sqids
 
 	store store.Store
 
@@ -58,12 +64,17 @@ func CreateController(cfg Config) (*DogboxController, error) {
 		engine = gin.Default()
 	}
 
-	conn, err := pgx.Connect(context.Background(), cfg.GetDBUrl())
+	pool, err := pgxpool.New(context.Background(), cfg.GetDBUrl())
 	if err != nil {
 		return nil, err
 	}
+	// The pool connects lazily, so check the database up front.
+	if err := pool.Ping(context.Background()); err != nil {
+		pool.Close()
+		return nil, err
+	}
 
-	q := db.New(conn)
+	q := db.New(pool)
 
 	wd, err := os.Getwd()
 	if err != nil {
@@ -79,12 +90,16 @@ func CreateController(cfg Config) (*DogboxController, error) {
 		return nil, err
 	}
 
-	store := store.MakeLocalStore(cfg.DogboxDataDir)
+	store, err := buildStore(cfg, pool)
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
 
 	return &DogboxController{
 		db:     q,
 		cfg:    cfg,
-		conn:   conn,
+		pool:   pool,
 		router: engine,
 		pwd:    wd,
 		sqids:  s,
@@ -102,7 +117,8 @@ func (dc *DogboxController) MountHandlers() {
 
 	posts.GET(
 		"",
-		ApiKeyMiddleware(&dc.cfg),
+		ApiKeyMiddleware(&dc.cfg, dc.db.GetApiKeyByHash),
+		AdminMiddleware(),
 		RateLimiter(100, 25),
 		dc.GetAllFiles,
 	)
@@ -113,16 +129,110 @@ func (dc *DogboxController) MountHandlers() {
 	)
 	posts.POST(
 		"",
-		ApiKeyMiddleware(&dc.cfg),
+		ApiKeyMiddleware(&dc.cfg, dc.db.GetApiKeyByHash),
 		RateLimiter(20, 5),
 		dc.CreateFile,
 	)
 	posts.DELETE(
 		":name",
-		ApiKeyMiddleware(&dc.cfg),
+		ApiKeyMiddleware(&dc.cfg, dc.db.GetApiKeyByHash),
 		RateLimiter(20, 5),
 		dc.DeleteFile,
 	)
+	posts.POST(
+		":name/unlock",
+		RateLimiter(20, 5),
+		dc.UnlockPost,
+	)
+	posts.POST(
+		":name/share",
+		ApiKeyMiddleware(&dc.cfg, dc.db.GetApiKeyByHash),
+		RateLimiter(20, 5),
+		dc.SharePost,
+	)
+
+	me := api.Group("/me")
+	me.Use(ErrorHandler(&dc.cfg))
+	me.Use(ApiKeyMiddleware(&dc.cfg, dc.db.GetApiKeyByHash))
+
+	me.GET(
+		"usage",
+		RateLimiter(100, 25),
+		dc.GetUsage,
+	)
+
+	pastes := api.Group("/pastes")
+	pastes.Use(ErrorHandler(&dc.cfg))
+
+	pastes.POST(
+		"",
+		ApiKeyMiddleware(&dc.cfg, dc.db.GetApiKeyByHash),
+		RateLimiter(20, 5),
+		dc.CreatePaste,
+	)
+
+	links := api.Group("/links")
+	links.Use(ErrorHandler(&dc.cfg))
+
+	links.POST(
+		"",
+		ApiKeyMiddleware(&dc.cfg, dc.db.GetApiKeyByHash),
+		RateLimiter(20, 5),
+		dc.CreateLink,
+	)
+
+	pastePages := dc.router.Group("/p")
+	pastePages.Use(ErrorHandler(&dc.cfg))
+
+	pastePages.GET(
+		":name",
+		RateLimiter(100, 25),
+		dc.GetPaste,
+	)
+	pastePages.GET(
+		":name/raw",
+		RateLimiter(100, 25),
+		dc.GetPasteRaw,
+	)
+
+	viewer := dc.router.Group("/v")
+	viewer.Use(ErrorHandler(&dc.cfg))
+
+	viewer.GET(
+		":name",
+		RateLimiter(100, 25),
+		dc.ViewPost,
+	)
+
+	linkPages := dc.router.Group("/l")
+	linkPages.Use(ErrorHandler(&dc.cfg))
+
+	linkPages.GET(
+		":slug",
+		RateLimiter(100, 25),
+		dc.FollowLink,
+	)
+
+	admin := api.Group("/admin")
+	admin.Use(ErrorHandler(&dc.cfg))
+	admin.Use(ApiKeyMiddleware(&dc.cfg, dc.db.GetApiKeyByHash))
+	admin.Use(AdminMiddleware())
+
+	admin.GET(
+		"cache",
+		RateLimiter(20, 5),
+		dc.GetCacheStats,
+	)
+	admin.POST(
+		"keys",
+		RateLimiter(20, 5),
+		dc.CreateApiKey,
+	)
+	admin.PUT(
+		"keys/:id/quota",
+		RateLimiter(20, 5),
+		dc.SetApiKeyQuota,
+	)
 }
 
 func (dc *DogboxController) Start(addr string) error {
@@ -134,7 +244,8 @@ func (dc *DogboxController) Router() *gin.Engine {
 }
 
 func (dc *DogboxController) Close() error {
-	return dc.conn.Close(context.Background())
+	dc.pool.Close()
+	return nil
 }
 
 func (dc *DogboxController) GetFile(c *gin.Context) {
@@ -146,63 +257,196 @@ func (dc *DogboxController) GetFile(c *gin.Context) {
 		return
 	}
 
-	if p.Status != db.PostStatusOk {
+	// Links are followed at /l/:name instead.
+	if !postAvailable(p) || p.Kind == db.PostKindLink {
 		c.AbortWithError(http.StatusNotFound, NotFoundError(name))
 		return
 	}
 
 	if p.Filename == nil || p.Hash == nil {
 		c.AbortWithError(http.StatusInternalServerError, NotFoundError(name))
+		return
 	}
 
-	modTimeMd5 := md5.Sum([]byte(p.UpdatedAt.Time.String()))
-	modTimeString := fmt.Sprintf("%x", modTimeMd5)
+	// Don't serve data that is known to be damaged.
+	if dc.cfg.DogboxScrubQuarantine &&
+		p.IntegrityStatus == db.IntegrityStatusCorrupt {
+		c.AbortWithError(http.StatusServiceUnavailable, QuarantinedError)
+		return
+	}
 
-	c.Header("Cache-Control", "public, max-age=31536000")
-	c.Header("Etag", modTimeString)
+	cacheControl, ok := dc.checkVisibility(c, p)
+	if !ok {
+		return
+	}
 
-	if match := c.GetHeader("If-None-Match"); match != "" {
-		if strings.Contains(match, modTimeString) {
-			c.Status(http.StatusNotModified)
-			return
+	// Nothing about the contents, not even whether they changed, is sent
+	// before the post is unlocked. Browsers have to come back with the
+	// cookie every time.
+	if !dc.checkUnlocked(c, p) {
+		return
+	}
+	if p.PasswordHash != nil {
+		cacheControl = "private, no-cache"
+	}
+
+	// Every request for a post with a download limit is one download of the
+	// whole file, so nothing may be cached or revalidated, and ranges are
+	// ignored.
+	limited := p.MaxDownloads != nil
+	modTime := p.UpdatedAt.Time
+	if limited {
+		cacheControl = "no-store"
+		modTime = time.Time{}
+		c.Request.Header.Del("Range")
+	}
+
+	// Ciphertext is sent exactly as it was uploaded, and must not be
+	// interpreted by anyone on the way.
+	if p.Encrypted {
+		cacheControl += ", no-transform"
+		c.Header("Content-Type", "application/octet-stream")
+	}
+
+	c.Header("Cache-Control", cacheControl)
+	setUploadHeaders(c)
+
+	// Compressed objects are sent gzipped to clients that accept it, so
+	// responses differ by Accept-Encoding.
+	encoder, canEncode := store.As[store.EncodedRetriever](dc.store)
+	canEncode = canEncode && !p.Encrypted
+	if canEncode {
+		c.Header("Vary", "Accept-Encoding")
+	}
+
+	if !limited {
+		modTimeMd5 := md5.Sum([]byte(p.UpdatedAt.Time.String()))
+		modTimeString := fmt.Sprintf("%x", modTimeMd5)
+
+		// The tag is weak, since the gzipped and identity responses carry
+		// the same file in different bytes.
+		c.Header("Etag", fmt.Sprintf("W/\"%s\"", modTimeString))
+
+		if match := c.GetHeader("If-None-Match"); match != "" {
+			if strings.Contains(match, modTimeString) {
+				c.Status(http.StatusNotModified)
+				return
+			}
 		}
 	}
 
-	imPath := dc.getImagePath(*p.Filename)
+	imPath := dc.objectPath(p)
 
-	reader, err := dc.store.Retrieve(imPath)
+	reader, err := dc.store.Retrieve(c.Request.Context(), imPath)
 	if err != nil {
 		c.AbortWithError(http.StatusNotFound, NotFoundError(name))
 		return
 	}
+	defer reader.Close()
 
-	tmpFile, err := store.CreateTempFile(filepath.Join(
-		dc.cfg.DogboxDataDir,
-		"images",
-		"tmp",
-		*p.Filename,
-	))
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
+	// The download is only counted once the file can be served. The post is
+	// removed after its last download has been sent.
+	if limited {
+		last, ok := dc.claimDownload(c, p)
+		if !ok {
+			return
+		}
+		if last {
+			defer dc.burnPost(c.Request.Context(), p)
+		}
 	}
-	defer tmpFile.Cleanup()
 
-	_, err = io.Copy(tmpFile, reader)
-	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
-		return
+	// Reads keep a post in the hot tier. Failing to record one only makes
+	// the post a candidate for demotion sooner.
+	if _, ok := store.As[*store.TieredStore](dc.store); ok {
+		dc.db.TouchPost(c.Request.Context(), p.ID)
+	}
+
+	if canEncode {
+		if dc.serveEncoded(c, encoder, imPath, *p.Filename, p.UpdatedAt.Time) {
+			return
+		}
 	}
 
+	// Object readers are seekable, so range requests are served straight
+	// from the store. Copying to a temporary file first would also leave
+	// decrypted data on disk when the store is encrypted.
 	http.ServeContent(
 		c.Writer,
 		c.Request,
 		*p.Filename,
-		p.UpdatedAt.Time,
-		tmpFile,
+		modTime,
+		reader,
+	)
+}
+
+// Keeps uploaded files from running as part of the site. Uploads are served
+// from the same origin as everything else, so an HTML file could otherwise
+// read the pages its visitors have unlocked. The sandbox gives the response
+// an origin of its own and no scripts, and browsers may not guess a more
+// active type than the one it is sent as.
+func setUploadHeaders(c *gin.Context) {
+	c.Header("Content-Security-Policy", "sandbox")
+	c.Header("X-Content-Type-Options", "nosniff")
+}
+
+// Sends the stored bytes of a compressed object as they are, if the client
+// accepts their encoding and is not asking for a range of the file. Reports
+// whether a response was written.
+func (dc *DogboxController) serveEncoded(
+	c *gin.Context,
+	encoder store.EncodedRetriever,
+	imPath string,
+	filename string,
+	modTime time.Time,
+) bool {
+	if c.GetHeader("Range") != "" || c.GetHeader("Accept-Encoding") == "" {
+		return false
+	}
+
+	rc, size, encoding, err := encoder.RetrieveEncoded(
+		c.Request.Context(),
+		imPath,
 	)
+	if err != nil {
+		return false
+	}
+	defer rc.Close()
+
+	if !acceptsEncoding(c.GetHeader("Accept-Encoding"), encoding) {
+		return false
+	}
+
+	contentType := mime.TypeByExtension(filepath.Ext(filename))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+
+	c.DataFromReader(http.StatusOK, size, contentType, rc, map[string]string{
+		"Content-Encoding": encoding,
+		"Last-Modified":    modTime.UTC().Format(http.TimeFormat),
+	})
+
+	return true
 }
 
+// Reports whether an Accept-Encoding header allows the given encoding.
+func acceptsEncoding(header, encoding string) bool {
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(name), encoding) {
+			continue
+		}
+
+		q := strings.ReplaceAll(params, " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+
+	return false
+}
+
+// Lists every post, including their deletion keys and owners. Only the admin
+// key may list posts; issued keys are rejected before reaching this handler.
 func (dc *DogboxController) GetAllFiles(c *gin.Context) {
 	pageNum := 1
 
@@ -223,6 +467,7 @@ func (dc *DogboxController) GetAllFiles(c *gin.Context) {
 
 	if err != nil {
 		c.AbortWithError(http.StatusInternalServerError, err)
+		return
 	}
 
 	c.JSON(http.StatusOK, data)
@@ -235,9 +480,21 @@ func (dc *DogboxController) CreateFile(c *gin.Context) {
 		return
 	}
 
-	final, err := dc.uploadToStore(c.Request.Context(), data, dc.store)
+	opts, err := parsePostOptions(c)
 	if err != nil {
-		c.AbortWithError(http.StatusInternalServerError, err)
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	final, err := dc.uploadToStore(
+		c.Request.Context(),
+		data,
+		dc.store,
+		requestApiKey(c),
+		opts,
+	)
+	if err != nil {
+		c.AbortWithError(uploadErrorStatus(err), err)
 		return
 	}
 
@@ -246,9 +503,43 @@ func (dc *DogboxController) CreateFile(c *gin.Context) {
 	})
 }
 
+// Returns the status code of the response to an upload that failed with the
+// given error.
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, FileTooLargeError):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, QuotaExceededError):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func (dc *DogboxController) DeleteFile(c *gin.Context) {
 	name := c.Param("name")
 
+	p, err := dc.db.GetPostByFilename(c.Request.Context(), &name)
+	if err != nil || p.Status != db.PostStatusOk {
+		c.AbortWithError(http.StatusNotFound, NotFoundError(name))
+		return
+	}
+
+	// Issued keys can only delete their own posts.
+	if !ownsPost(requestApiKey(c), p) {
+		c.AbortWithError(http.StatusForbidden, NotOwnerError)
+		return
+	}
+
+	if err := dc.removePost(c.Request.Context(), p); err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			c.AbortWithError(http.StatusNotFound, NotFoundError(name))
+			return
+		}
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
 	c.JSON(http.StatusNoContent, gin.H{
 		"deleted": name,
 	})
@@ -258,9 +549,56 @@ func (dc *DogboxController) uploadToStore(
 	ctx context.Context,
 	data *multipart.FileHeader,
 	st store.Store,
+	owner *db.ApiKey,
+	opts postOptions,
 ) (*db.Post, error) {
-	dataFilename := filepath.Base(data.Filename)
-	tx, err := dc.conn.Begin(ctx)
+	srcFile, err := data.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer srcFile.Close()
+
+	return dc.createPost(
+		ctx,
+		srcFile,
+		filepath.Ext(filepath.Base(data.Filename)),
+		st,
+		owner,
+		opts,
+	)
+}
+
+// Stores the contents of a new post and records the post, charging it to its
+// owner. The post's public filename ends in ext.
+func (dc *DogboxController) createPost(
+	ctx context.Context,
+	srcFile io.ReadSeeker,
+	ext string,
+	st store.Store,
+	owner *db.ApiKey,
+	opts postOptions,
+) (*db.Post, error) {
+	// Uploads are stored under the hash of their contents, so the file is
+	// hashed before anything is written.
+	hasher := sha256.New()
+	size, err := store.ContextCopy(ctx, hasher, srcFile)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := srcFile.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	hashString := hex.EncodeToString(hasher.Sum(nil))
+
+	var ownerID *int64
+	if owner != nil {
+		if owner.QuotaBytes != nil && size > *owner.QuotaBytes {
+			return nil, FileTooLargeError
+		}
+		ownerID = &owner.ID
+	}
+
+	tx, err := dc.pool.Begin(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -284,43 +622,94 @@ func (dc *DogboxController) uploadToStore(
 		return nil, err
 	}
 
-	ext := filepath.Ext(dataFilename)
-	filename := ident + ext
+	// The name of an encrypted file is part of its encrypted metadata, if
+	// anywhere, and its contents must not be stored in any other form.
+	filename := ident
+	if opts.Encrypted {
+		ctx = store.WithNoTransform(ctx)
+	} else {
+		filename += ext
+	}
 
-	imPath := dc.getImagePath(filename)
+	// Charging the upload to its owner locks the owner's row until the
+	// transaction ends, so concurrent uploads cannot overrun the quota.
+	if ownerID != nil {
+		_, err := qtx.ReserveUsage(ctx, db.ReserveUsageParams{
+			Size: size,
+			ID:   *ownerID,
+		})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, QuotaExceededError
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 
-	srcFile, err := data.Open()
+	// Acquiring the blob locks its row until the transaction ends, so it
+	// cannot be deleted, or written by another upload, in the meantime.
+	blob, err := qtx.AcquireBlob(ctx, db.AcquireBlobParams{
+		Hash: hashString,
+		Size: size,
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer srcFile.Close()
-
-	dstWriter := store.NewWriter(st, imPath)
-	defer dstWriter.Close()
 
-	hasher := sha256.New()
-
-	w := io.MultiWriter(
-		dstWriter,
-		hasher,
-	)
-
-	if _, err := io.Copy(w, srcFile); err != nil {
+	// The transaction holds a connection of the pool that a postgres store
+	// shares, so the store has to write within it rather than wait for
+	// another connection.
+	written, err := dc.storeBlob(pgstore.WithTx(ctx, tx), st, blob, srcFile)
+	if err != nil {
 		return nil, err
 	}
 
-	hashString := hex.EncodeToString(hasher.Sum(nil))
+	// A post that shares an existing blob shares its object too, which may
+	// have been moved to the cold tier already.
+	tier := db.StorageTierHot
+	if !written {
+		tier, err = dc.blobTier(pgstore.WithTx(ctx, tx), st, blob.Hash)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// From here on an object written for this upload exists in the store, so
+	// it has to be removed again if the post does not make it into the
+	// database.
+	committed := false
+	defer func() {
+		if written && !committed {
+			st.Delete(context.WithoutCancel(ctx), dc.getBlobPath(blob.Hash))
+		}
+	}()
+
 	dKey, err := dc.genDeletionKey(i.ID)
 	if err != nil {
 		return nil, err
 	}
 
 	final, err := qtx.UpdatePost(ctx, db.UpdatePostParams{
-		Filename:    &filename,
-		DeletionKey: &dKey,
-		Hash:        &hashString,
-		Status:      db.NullPostStatus{PostStatus: db.PostStatusOk, Valid: true},
-		ID:          i.ID,
+		Filename:     &filename,
+		DeletionKey:  &dKey,
+		Hash:         &hashString,
+		BlobHash:     &blob.Hash,
+		OwnerID:      ownerID,
+		Size:         &size,
+		PasswordHash: opts.PasswordHash,
+		MaxDownloads: opts.MaxDownloads,
+		Encrypted:    &opts.Encrypted,
+		Envelope:     opts.Envelope,
+		Kind:         db.NullPostKind{PostKind: opts.Kind, Valid: true},
+		Language:     opts.Language,
+		ExpiresAt:    opts.ExpiresAt,
+		Tier:         db.NullStorageTier{StorageTier: tier, Valid: true},
+		Status:       db.NullPostStatus{PostStatus: db.PostStatusOk, Valid: true},
+		Visibility: db.NullPostVisibility{
+			PostVisibility: opts.Visibility,
+			Valid:          true,
+		},
+		ID: i.ID,
 	})
 	if err != nil {
 		return nil, err
@@ -329,6 +718,7 @@ func (dc *DogboxController) uploadToStore(
 	if err = tx.Commit(ctx); err != nil {
 		return nil, err
 	}
+	committed = true
 
 	return final, nil
 }
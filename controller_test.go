@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	"github.com/Fekinox/dogbox-main/internal/dbtest"
+	"github.com/gin-gonic/gin"
+	"github.com/sqids/sqids-go"
+)
+
+const TEST_API_KEY = "dogbox-test-key"
+
+// Returns a controller backed by a database of its own and a local store in
+// a temporary directory, with its handlers mounted. Skipped without a test
+// database.
+func newTestController(t *testing.T) *DogboxController {
+	t.Helper()
+
+	pool := dbtest.New(t)
+
+	key := sha256.Sum256([]byte(TEST_API_KEY))
+	cfg := Config{
+		Environment:           "test",
+		DogboxDataDir:         t.TempDir(),
+		DogboxAPIKey:          TEST_API_KEY,
+		DogboxShareDefaultTTL: time.Hour,
+		DogboxShareMaxTTL:     24 * time.Hour,
+		PageSize:              20,
+		DecodedAPIKey:         key[:],
+		SigningKey:            []byte("dogbox test signing key"),
+	}
+
+	s, err := sqids.New(sqids.Options{MinLength: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	st, err := buildStore(cfg, pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	dc := &DogboxController{
+		db:     db.New(pool),
+		cfg:    cfg,
+		pool:   pool,
+		router: gin.New(),
+		pwd:    t.TempDir(),
+		sqids:  s,
+
+		store: st,
+	}
+	dc.MountHandlers()
+
+	return dc
+}
+
+// Sends a request to the controller's router. Requests with a form body are
+// authenticated with the admin key.
+func serve(dc *DogboxController, method, target, form string) *httptest.ResponseRecorder {
+	var req *http.Request
+	if form != "" {
+		req = httptest.NewRequest(method, target, strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("Authorization", "Bearer "+TEST_API_KEY)
+	} else {
+		req = httptest.NewRequest(method, target, nil)
+	}
+
+	w := httptest.NewRecorder()
+	dc.router.ServeHTTP(w, req)
+	return w
+}
+
+// Uploads a file with the admin key, along with the given form fields.
+// Returns the response and the name of the new post, if it was created.
+func upload(
+	t *testing.T,
+	dc *DogboxController,
+	name string,
+	data []byte,
+	fields map[string]string,
+) (*httptest.ResponseRecorder, string) {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for k, v := range fields {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fw, err := mw.CreateFormFile("data", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/posts", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+TEST_API_KEY)
+
+	w := httptest.NewRecorder()
+	dc.router.ServeHTTP(w, req)
+	if w.Code != http.StatusCreated {
+		return w, ""
+	}
+
+	var res struct {
+		Message db.Post `json:"message"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return w, *res.Message.Filename
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip", true},
+		{"br;q=1.0, gzip;q=0.5", true},
+		{"gzip; q=0.001", true},
+		{"", false},
+		{"br, deflate", false},
+		{"x-gzip", false},
+		{"gzip;q=0", false},
+		{"gzip; q=0.000", false},
+		{"deflate, gzip;q=0, br", false},
+	}
+
+	for _, tt := range tests {
+		if got := acceptsEncoding(tt.header, "gzip"); got != tt.want {
+			t.Errorf("acceptsEncoding(%q) = %v, want %v", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestGetAllFilesListsEveryPost(t *testing.T) {
+	dc := newTestController(t)
+
+	var names []string
+	for _, visibility := range []string{"public", "unlisted", "private"} {
+		w, name := upload(t, dc, visibility+".txt", []byte(visibility), map[string]string{
+			"visibility": visibility,
+		})
+		if name == "" {
+			t.Fatalf("uploading: %d %s", w.Code, w.Body)
+		}
+		names = append(names, name)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/posts", nil)
+	req.Header.Set("Authorization", "Bearer "+TEST_API_KEY)
+	w := httptest.NewRecorder()
+	dc.router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("listing posts: %d %s", w.Code, w.Body)
+	}
+
+	var posts []db.Post
+	if err := json.Unmarshal(w.Body.Bytes(), &posts); err != nil {
+		t.Fatal(err)
+	}
+	listed := map[string]bool{}
+	for _, p := range posts {
+		listed[*p.Filename] = true
+	}
+	for _, name := range names {
+		if !listed[name] {
+			t.Errorf("%s is not listed", name)
+		}
+	}
+}
+
+func TestUploadsAreSandboxed(t *testing.T) {
+	dc := newTestController(t)
+	page := []byte("<script>fetch('/api/posts/secret.txt')</script>")
+
+	w, name := upload(t, dc, "page.html", page, nil)
+	if name == "" {
+		t.Fatalf("uploading: %d %s", w.Code, w.Body)
+	}
+
+	w = serve(dc, http.MethodGet, postURL(name), "")
+	if w.Code != http.StatusOK || w.Body.String() != string(page) {
+		t.Fatalf("downloading: %d %q", w.Code, w.Body)
+	}
+	if csp := w.Header().Get("Content-Security-Policy"); csp != "sandbox" {
+		t.Errorf("Content-Security-Policy = %q, want sandbox", csp)
+	}
+	if opts := w.Header().Get("X-Content-Type-Options"); opts != "nosniff" {
+		t.Errorf("X-Content-Type-Options = %q, want nosniff", opts)
+	}
+}
@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE IF EXISTS posts
+DROP COLUMN IF EXISTS integrity_status,
+DROP COLUMN IF EXISTS verified_at;
+
+DROP TYPE IF EXISTS integrity_status;
+
+COMMIT;
@@ -0,0 +1,9 @@
+BEGIN;
+
+CREATE TYPE integrity_status AS ENUM ('unverified', 'ok', 'corrupt', 'missing');
+
+ALTER TABLE IF EXISTS posts
+ADD COLUMN integrity_status integrity_status NOT NULL DEFAULT 'unverified',
+ADD COLUMN verified_at timestamptz;
+
+COMMIT;
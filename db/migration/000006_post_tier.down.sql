@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE IF EXISTS posts
+DROP COLUMN IF EXISTS tier,
+DROP COLUMN IF EXISTS accessed_at;
+
+DROP TYPE IF EXISTS storage_tier;
+
+COMMIT;
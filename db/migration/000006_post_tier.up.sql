@@ -0,0 +1,9 @@
+BEGIN;
+
+CREATE TYPE storage_tier AS ENUM ('hot', 'cold');
+
+ALTER TABLE IF EXISTS posts
+ADD COLUMN tier storage_tier NOT NULL DEFAULT 'hot',
+ADD COLUMN accessed_at timestamptz;
+
+COMMIT;
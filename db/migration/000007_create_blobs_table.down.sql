@@ -0,0 +1,11 @@
+BEGIN;
+
+DROP INDEX IF EXISTS idx_posts_blob;
+
+ALTER TABLE IF EXISTS posts
+DROP COLUMN IF EXISTS blob_hash,
+ADD CONSTRAINT hash_unique UNIQUE (hash);
+
+DROP TABLE IF EXISTS blobs;
+
+COMMIT;
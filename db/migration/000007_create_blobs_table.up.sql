@@ -0,0 +1,16 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS blobs (
+  hash text PRIMARY KEY,
+  size bigint NOT NULL,
+  refcount bigint NOT NULL DEFAULT 0 CONSTRAINT refcount_positive CHECK (refcount >= 0),
+  created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE IF EXISTS posts
+DROP CONSTRAINT IF EXISTS hash_unique,
+ADD COLUMN blob_hash text REFERENCES blobs (hash);
+
+CREATE INDEX idx_posts_blob ON posts (blob_hash);
+
+COMMIT;
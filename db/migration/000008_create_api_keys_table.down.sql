@@ -0,0 +1,11 @@
+BEGIN;
+
+DROP INDEX IF EXISTS idx_posts_owner;
+
+ALTER TABLE IF EXISTS posts
+DROP COLUMN IF EXISTS owner_id,
+DROP COLUMN IF EXISTS size;
+
+DROP TABLE IF EXISTS api_keys;
+
+COMMIT;
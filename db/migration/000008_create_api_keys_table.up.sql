@@ -0,0 +1,20 @@
+BEGIN;
+
+CREATE TABLE IF NOT EXISTS api_keys (
+  id bigserial PRIMARY KEY,
+  name text NOT NULL,
+  key_hash bytea NOT NULL CONSTRAINT key_hash_unique UNIQUE,
+  quota_bytes bigint,
+  quota_files bigint,
+  used_bytes bigint NOT NULL DEFAULT 0,
+  used_files bigint NOT NULL DEFAULT 0,
+  created_at timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+ALTER TABLE IF EXISTS posts
+ADD COLUMN owner_id bigint REFERENCES api_keys (id),
+ADD COLUMN size bigint;
+
+CREATE INDEX idx_posts_owner ON posts (owner_id);
+
+COMMIT;
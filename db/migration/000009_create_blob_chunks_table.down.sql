@@ -0,0 +1,9 @@
+BEGIN;
+
+DROP TABLE IF EXISTS blob_chunks;
+
+DROP TABLE IF EXISTS store_objects;
+
+DROP SEQUENCE IF EXISTS store_object_ids;
+
+COMMIT;
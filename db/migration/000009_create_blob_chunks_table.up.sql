@@ -0,0 +1,23 @@
+BEGIN;
+
+-- Objects of the "postgres" storage backend. Every version of an object gets
+-- a new object_id, so that a write can be published by pointing its path at
+-- the new chunks.
+CREATE SEQUENCE IF NOT EXISTS store_object_ids;
+
+CREATE TABLE IF NOT EXISTS store_objects (
+  path text PRIMARY KEY,
+  object_id bigint NOT NULL UNIQUE,
+  size bigint NOT NULL,
+  chunk_size integer NOT NULL CONSTRAINT chunk_size_positive CHECK (chunk_size > 0),
+  mod_time timestamptz NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS blob_chunks (
+  object_id bigint NOT NULL,
+  idx integer NOT NULL,
+  data bytea NOT NULL,
+  PRIMARY KEY (object_id, idx)
+);
+
+COMMIT;
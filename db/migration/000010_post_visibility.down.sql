@@ -0,0 +1,8 @@
+BEGIN;
+
+ALTER TABLE IF EXISTS posts
+DROP COLUMN IF EXISTS visibility;
+
+DROP TYPE IF EXISTS post_visibility;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+CREATE TYPE post_visibility AS ENUM ('public', 'unlisted', 'private');
+
+ALTER TABLE IF EXISTS posts
+ADD COLUMN visibility post_visibility NOT NULL DEFAULT 'public';
+
+COMMIT;
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE IF EXISTS posts
+DROP COLUMN IF EXISTS password_hash;
+
+COMMIT;
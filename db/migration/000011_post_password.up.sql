@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE IF EXISTS posts
+ADD COLUMN password_hash text;
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE IF EXISTS posts
+DROP COLUMN IF EXISTS max_downloads,
+DROP COLUMN IF EXISTS downloads;
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE IF EXISTS posts
+ADD COLUMN max_downloads integer CONSTRAINT max_downloads_positive CHECK (max_downloads > 0),
+ADD COLUMN downloads integer NOT NULL DEFAULT 0;
+
+COMMIT;
@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE IF EXISTS posts
+DROP COLUMN IF EXISTS encrypted,
+DROP COLUMN IF EXISTS envelope;
+
+COMMIT;
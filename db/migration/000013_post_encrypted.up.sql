@@ -0,0 +1,9 @@
+BEGIN;
+
+-- Posts encrypted by the client. The server only holds the ciphertext and the
+-- envelope the client needs to decrypt it, minus the key.
+ALTER TABLE IF EXISTS posts
+ADD COLUMN encrypted boolean NOT NULL DEFAULT false,
+ADD COLUMN envelope text;
+
+COMMIT;
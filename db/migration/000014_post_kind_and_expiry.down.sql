@@ -0,0 +1,12 @@
+BEGIN;
+
+DROP INDEX IF EXISTS idx_posts_expires_at;
+
+ALTER TABLE IF EXISTS posts
+DROP COLUMN IF EXISTS kind,
+DROP COLUMN IF EXISTS language,
+DROP COLUMN IF EXISTS expires_at;
+
+DROP TYPE IF EXISTS post_kind;
+
+COMMIT;
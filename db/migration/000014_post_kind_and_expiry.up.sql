@@ -0,0 +1,14 @@
+BEGIN;
+
+CREATE TYPE post_kind AS ENUM ('file', 'paste');
+
+ALTER TABLE IF EXISTS posts
+ADD COLUMN kind post_kind NOT NULL DEFAULT 'file',
+ADD COLUMN language text,
+ADD COLUMN expires_at timestamptz;
+
+CREATE INDEX idx_posts_expires_at ON posts (expires_at)
+WHERE
+  expires_at IS NOT NULL;
+
+COMMIT;
@@ -0,0 +1,34 @@
+BEGIN;
+
+DELETE FROM posts
+WHERE
+  kind = 'link';
+
+ALTER TABLE IF EXISTS posts
+DROP CONSTRAINT IF EXISTS has_data,
+ADD CONSTRAINT has_data CHECK (
+  status <> 'ok'
+  OR (
+    filename IS NOT NULL
+    AND hash IS NOT NULL
+  )
+);
+
+ALTER TABLE IF EXISTS posts
+DROP COLUMN IF EXISTS target_url,
+DROP COLUMN IF EXISTS hits;
+
+-- Enum values cannot be dropped, so the type is recreated without it.
+ALTER TYPE post_kind
+RENAME TO post_kind_old;
+
+CREATE TYPE post_kind AS ENUM ('file', 'paste');
+
+ALTER TABLE IF EXISTS posts
+ALTER COLUMN kind DROP DEFAULT,
+ALTER COLUMN kind TYPE post_kind USING kind::text::post_kind,
+ALTER COLUMN kind SET DEFAULT 'file';
+
+DROP TYPE post_kind_old;
+
+COMMIT;
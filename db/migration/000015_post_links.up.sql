@@ -0,0 +1,27 @@
+-- Adding an enum value cannot be part of a transaction block before Postgres
+-- 12, so it runs on its own.
+ALTER TYPE post_kind ADD VALUE IF NOT EXISTS 'link';
+
+BEGIN;
+
+ALTER TABLE IF EXISTS posts
+ADD COLUMN target_url text,
+ADD COLUMN hits bigint NOT NULL DEFAULT 0;
+
+-- Links have a target instead of contents. The kind is compared as text,
+-- since the new enum value cannot be used before it has been committed.
+ALTER TABLE IF EXISTS posts
+DROP CONSTRAINT IF EXISTS has_data,
+ADD CONSTRAINT has_data CHECK (
+  status <> 'ok'
+  OR (
+    kind::text = 'link'
+    AND target_url IS NOT NULL
+  )
+  OR (
+    filename IS NOT NULL
+    AND hash IS NOT NULL
+  )
+);
+
+COMMIT;
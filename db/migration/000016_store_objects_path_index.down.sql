@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP INDEX IF EXISTS idx_store_objects_path_segments;
+
+COMMIT;
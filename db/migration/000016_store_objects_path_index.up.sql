@@ -0,0 +1,9 @@
+BEGIN;
+
+-- Matches the ordering of ListStoreObjects, so that each page is read from
+-- the index instead of sorting every object.
+CREATE INDEX idx_store_objects_path_segments ON store_objects (
+  (string_to_array(path COLLATE "C", '/'))
+);
+
+COMMIT;
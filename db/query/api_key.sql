@@ -0,0 +1,62 @@
+-- name: CreateApiKey :one
+INSERT INTO
+  api_keys (name, key_hash, quota_bytes, quota_files)
+VALUES
+  (
+    sqlc.arg ('name'),
+    sqlc.arg ('key_hash'),
+    sqlc.narg ('quota_bytes'),
+    sqlc.narg ('quota_files')
+  ) RETURNING *;
+
+-- name: GetApiKeyByHash :one
+SELECT
+  *
+FROM
+  api_keys
+WHERE
+  key_hash = sqlc.arg ('key_hash')
+LIMIT
+  1;
+
+-- name: SetApiKeyQuota :one
+UPDATE api_keys
+SET
+  quota_bytes = sqlc.narg ('quota_bytes'),
+  quota_files = sqlc.narg ('quota_files')
+WHERE
+  id = sqlc.arg ('id') RETURNING *;
+
+-- name: ReserveUsage :one
+UPDATE api_keys
+SET
+  used_bytes = used_bytes + sqlc.arg ('size'),
+  used_files = used_files + 1
+WHERE
+  id = sqlc.arg ('id')
+  AND (
+    quota_bytes IS NULL
+    OR used_bytes + sqlc.arg ('size') <= quota_bytes
+  )
+  AND (
+    quota_files IS NULL
+    OR used_files + 1 <= quota_files
+  ) RETURNING *;
+
+-- name: ReleaseUsage :exec
+UPDATE api_keys
+SET
+  used_bytes = greatest(used_bytes - sqlc.arg ('size'), 0),
+  used_files = greatest(used_files - 1, 0)
+WHERE
+  id = sqlc.arg ('id');
+
+-- name: GetUnownedUsage :one
+SELECT
+  count(*) AS used_files,
+  coalesce(sum(size), 0)::bigint AS used_bytes
+FROM
+  posts
+WHERE
+  owner_id IS NULL
+  AND status = 'ok';
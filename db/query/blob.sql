@@ -0,0 +1,30 @@
+-- name: AcquireBlob :one
+INSERT INTO
+  blobs (hash, size, refcount)
+VALUES
+  (sqlc.arg ('hash'), sqlc.arg ('size'), 1)
+ON CONFLICT (hash) DO UPDATE
+SET
+  refcount = blobs.refcount + 1 RETURNING *;
+
+-- name: ReleaseBlob :one
+UPDATE blobs
+SET
+  refcount = refcount - 1
+WHERE
+  hash = sqlc.arg ('hash') RETURNING *;
+
+-- name: DeleteBlob :exec
+DELETE FROM blobs
+WHERE
+  hash = sqlc.arg ('hash')
+  AND refcount = 0;
+
+-- name: LockBlob :one
+SELECT
+  *
+FROM
+  blobs
+WHERE
+  hash = sqlc.arg ('hash')
+FOR UPDATE;
@@ -43,12 +43,144 @@ SET
   filename = coalesce(sqlc.narg ('filename'), filename),
   deletion_key = coalesce(sqlc.narg ('deletion_key'), deletion_key),
   hash = coalesce(sqlc.narg ('hash'), hash),
+  blob_hash = coalesce(sqlc.narg ('blob_hash'), blob_hash),
+  owner_id = coalesce(sqlc.narg ('owner_id'), owner_id),
+  size = coalesce(sqlc.narg ('size'), size),
+  visibility = coalesce(sqlc.narg ('visibility'), visibility),
+  password_hash = coalesce(sqlc.narg ('password_hash'), password_hash),
+  max_downloads = coalesce(sqlc.narg ('max_downloads'), max_downloads),
+  encrypted = coalesce(sqlc.narg ('encrypted'), encrypted),
+  envelope = coalesce(sqlc.narg ('envelope'), envelope),
+  kind = coalesce(sqlc.narg ('kind'), kind),
+  language = coalesce(sqlc.narg ('language'), language),
+  expires_at = coalesce(sqlc.narg ('expires_at'), expires_at),
+  target_url = coalesce(sqlc.narg ('target_url'), target_url),
+  tier = coalesce(sqlc.narg ('tier'), tier),
   status = coalesce(sqlc.narg ('status'), status),
   updated_at = now ()
 WHERE
   id = sqlc.arg ('id') RETURNING *;
 
+-- Counts a download of a post with a download limit. Returns no rows once the
+-- limit has been reached.
+-- name: ClaimDownload :one
+UPDATE posts
+SET
+  downloads = downloads + 1
+WHERE
+  id = sqlc.arg ('id')
+  AND status = 'ok'
+  AND downloads < max_downloads RETURNING *;
+
+-- name: RemovePost :one
+UPDATE posts
+SET
+  status = 'removed',
+  blob_hash = NULL,
+  updated_at = now ()
+WHERE
+  id = sqlc.arg ('id')
+  AND status = 'ok' RETURNING *;
+
 -- name: DeletePost :exec
 DELETE FROM posts
 WHERE
   id = sqlc.arg ('id');
+
+-- name: ListPostsAfter :many
+SELECT
+  *
+FROM
+  posts
+WHERE
+  id > sqlc.arg ('after_id')
+  AND status = 'ok'
+  AND kind <> 'link'
+ORDER BY
+  id
+LIMIT
+  sqlc.arg ('page_size');
+
+-- name: ListPostsToScrub :many
+SELECT
+  *
+FROM
+  posts
+WHERE
+  id > sqlc.arg ('after_id')
+  AND status = 'ok'
+  AND kind <> 'link'
+  AND (
+    verified_at IS NULL
+    OR verified_at < sqlc.arg ('verified_before')
+  )
+ORDER BY
+  id
+LIMIT
+  sqlc.arg ('page_size');
+
+-- name: ListExpiredPosts :many
+SELECT
+  *
+FROM
+  posts
+WHERE
+  id > sqlc.arg ('after_id')
+  AND status = 'ok'
+  AND expires_at <= now ()
+ORDER BY
+  id
+LIMIT
+  sqlc.arg ('page_size');
+
+-- name: SetPostIntegrity :exec
+UPDATE posts
+SET
+  integrity_status = sqlc.arg ('integrity_status'),
+  verified_at = now ()
+WHERE
+  id = sqlc.arg ('id');
+
+-- name: ListPostsToDemote :many
+SELECT
+  *
+FROM
+  posts
+WHERE
+  id > sqlc.arg ('after_id')
+  AND status = 'ok'
+  AND kind <> 'link'
+  AND tier = 'hot'
+  AND (
+    created_at < sqlc.narg ('created_before')
+    OR coalesce(accessed_at, created_at) < sqlc.narg ('accessed_before')
+  )
+ORDER BY
+  id
+LIMIT
+  sqlc.arg ('page_size');
+
+-- name: SetPostTier :exec
+UPDATE posts
+SET
+  tier = sqlc.arg ('tier')
+WHERE
+  id = sqlc.arg ('id');
+
+-- name: CountLinkHit :exec
+UPDATE posts
+SET
+  hits = hits + 1
+WHERE
+  id = sqlc.arg ('id');
+
+-- name: TouchPost :exec
+UPDATE posts
+SET
+  accessed_at = now ()
+WHERE
+  id = sqlc.arg ('id')
+  AND (
+    accessed_at IS NULL
+    OR accessed_at < now () - interval '1 hour'
+  );
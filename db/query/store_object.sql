@@ -0,0 +1,79 @@
+-- name: LockStorePath :exec
+SELECT
+  pg_advisory_xact_lock(hashtext(sqlc.arg ('path')::text));
+
+-- name: NextStoreObjectID :one
+SELECT
+  nextval('store_object_ids')::bigint;
+
+-- name: InsertBlobChunk :exec
+INSERT INTO
+  blob_chunks (object_id, idx, data)
+VALUES
+  (
+    sqlc.arg ('object_id'),
+    sqlc.arg ('idx'),
+    sqlc.arg ('data')
+  );
+
+-- name: GetBlobChunk :one
+SELECT
+  data
+FROM
+  blob_chunks
+WHERE
+  object_id = sqlc.arg ('object_id')
+  AND idx = sqlc.arg ('idx');
+
+-- name: DeleteBlobChunks :exec
+DELETE FROM blob_chunks
+WHERE
+  object_id = sqlc.arg ('object_id');
+
+-- name: GetStoreObject :one
+SELECT
+  *
+FROM
+  store_objects
+WHERE
+  path = sqlc.arg ('path');
+
+-- name: PutStoreObject :exec
+INSERT INTO
+  store_objects (path, object_id, size, chunk_size)
+VALUES
+  (
+    sqlc.arg ('path'),
+    sqlc.arg ('object_id'),
+    sqlc.arg ('size'),
+    sqlc.arg ('chunk_size')
+  )
+ON CONFLICT (path) DO UPDATE
+SET
+  object_id = EXCLUDED.object_id,
+  size = EXCLUDED.size,
+  chunk_size = EXCLUDED.chunk_size,
+  mod_time = CURRENT_TIMESTAMP;
+
+-- name: DeleteStoreObject :one
+DELETE FROM store_objects
+WHERE
+  path = sqlc.arg ('path') RETURNING *;
+
+-- Objects are listed in the order of store.ComparePaths: component by
+-- component, comparing bytes.
+-- name: ListStoreObjects :many
+SELECT
+  *
+FROM
+  store_objects
+WHERE
+  starts_with(path, sqlc.arg ('prefix')::text)
+  AND (
+    sqlc.arg ('cursor')::text = ''
+    OR string_to_array(path COLLATE "C", '/') > string_to_array(sqlc.arg ('cursor')::text COLLATE "C", '/')
+  )
+ORDER BY
+  string_to_array(path COLLATE "C", '/')
+LIMIT
+  sqlc.arg ('limit');
@@ -0,0 +1,188 @@
+// Code generated by sqlc. DO NOT EDIT.
+// versions:
+//   sqlc v1.27.0
+// source: api_key.sql
+
+package db
+
+import (
+	"context"
+)
+
+const createApiKey = `-- name: CreateApiKey :one
+INSERT INTO
+  api_keys (name, key_hash, quota_bytes, quota_files)
+VALUES
+  (
+    $1,
+    $2,
+    $3,
+    $4
+  ) RETURNING id, name, key_hash, quota_bytes, quota_files, used_bytes, used_files, created_at
+`
+
+type CreateApiKeyParams struct {
+	Name       string `json:"name"`
+	KeyHash    []byte `json:"key_hash"`
+	QuotaBytes *int64 `json:"quota_bytes"`
+	QuotaFiles *int64 `json:"quota_files"`
+}
+
+func (q *Queries) CreateApiKey(ctx context.Context, arg CreateApiKeyParams) (*ApiKey, error) {
+	row := q.db.QueryRow(ctx, createApiKey,
+		arg.Name,
+		arg.KeyHash,
+		arg.QuotaBytes,
+		arg.QuotaFiles,
+	)
+	var i ApiKey
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.KeyHash,
+		&i.QuotaBytes,
+		&i.QuotaFiles,
+		&i.UsedBytes,
+		&i.UsedFiles,
+		&i.CreatedAt,
+	)
+	return &i, err
+}
+
+const getApiKeyByHash = `-- name: GetApiKeyByHash :one
+SELECT
+  id, name, key_hash, quota_bytes, quota_files, used_bytes, used_files, created_at
+FROM
+  api_keys
+WHERE
+  key_hash = $1
+LIMIT
+  1
+`
+
+func (q *Queries) GetApiKeyByHash(ctx context.Context, keyHash []byte) (*ApiKey, error) {
+	row := q.db.QueryRow(ctx, getApiKeyByHash, keyHash)
+	var i ApiKey
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.KeyHash,
+		&i.QuotaBytes,
+		&i.QuotaFiles,
+		&i.UsedBytes,
+		&i.UsedFiles,
+		&i.CreatedAt,
+	)
+	return &i, err
+}
+
+const getUnownedUsage = `-- name: GetUnownedUsage :one
+SELECT
+  count(*) AS used_files,
+  coalesce(sum(size), 0)::bigint AS used_bytes
+FROM
+  posts
+WHERE
+  owner_id IS NULL
+  AND status = 'ok'
+`
+
+type GetUnownedUsageRow struct {
+	UsedFiles int64 `json:"used_files"`
+	UsedBytes int64 `json:"used_bytes"`
+}
+
+func (q *Queries) GetUnownedUsage(ctx context.Context) (*GetUnownedUsageRow, error) {
+	row := q.db.QueryRow(ctx, getUnownedUsage)
+	var i GetUnownedUsageRow
+	err := row.Scan(&i.UsedFiles, &i.UsedBytes)
+	return &i, err
+}
+
+const releaseUsage = `-- name: ReleaseUsage :exec
+UPDATE api_keys
+SET
+  used_bytes = greatest(used_bytes - $1, 0),
+  used_files = greatest(used_files - 1, 0)
+WHERE
+  id = $2
+`
+
+type ReleaseUsageParams struct {
+	Size int64 `json:"size"`
+	ID   int64 `json:"id"`
+}
+
+func (q *Queries) ReleaseUsage(ctx context.Context, arg ReleaseUsageParams) error {
+	_, err := q.db.Exec(ctx, releaseUsage, arg.Size, arg.ID)
+	return err
+}
+
+const reserveUsage = `-- name: ReserveUsage :one
+UPDATE api_keys
+SET
+  used_bytes = used_bytes + $1,
+  used_files = used_files + 1
+WHERE
+  id = $2
+  AND (
+    quota_bytes IS NULL
+    OR used_bytes + $1 <= quota_bytes
+  )
+  AND (
+    quota_files IS NULL
+    OR used_files + 1 <= quota_files
+  ) RETURNING id, name, key_hash, quota_bytes, quota_files, used_bytes, used_files, created_at
+`
+
+type ReserveUsageParams struct {
+	Size int64 `json:"size"`
+	ID   int64 `json:"id"`
+}
+
+func (q *Queries) ReserveUsage(ctx context.Context, arg ReserveUsageParams) (*ApiKey, error) {
+	row := q.db.QueryRow(ctx, reserveUsage, arg.Size, arg.ID)
+	var i ApiKey
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.KeyHash,
+		&i.QuotaBytes,
+		&i.QuotaFiles,
+		&i.UsedBytes,
+		&i.UsedFiles,
+		&i.CreatedAt,
+	)
+	return &i, err
+}
+
+const setApiKeyQuota = `-- name: SetApiKeyQuota :one
+UPDATE api_keys
+SET
+  quota_bytes = $1,
+  quota_files = $2
+WHERE
+  id = $3 RETURNING id, name, key_hash, quota_bytes, quota_files, used_bytes, used_files, created_at
+`
+
+type SetApiKeyQuotaParams struct {
+	QuotaBytes *int64 `json:"quota_bytes"`
+	QuotaFiles *int64 `json:"quota_files"`
+	ID         int64  `json:"id"`
+}
+
+func (q *Queries) SetApiKeyQuota(ctx context.Context, arg SetApiKeyQuotaParams) (*ApiKey, error) {
+	row := q.db.QueryRow(ctx, setApiKeyQuota, arg.QuotaBytes, arg.QuotaFiles, arg.ID)
+	var i ApiKey
+	err := row.Scan(
+		&i.ID,
+		&i.Name,
+		&i.KeyHash,
+		&i.QuotaBytes,
+		&i.QuotaFiles,
+		&i.UsedBytes,
+		&i.UsedFiles,
+		&i.CreatedAt,
+	)
+	return &i, err
+}
@@ -0,0 +1,91 @@
+// Code generated by sqlc. DO NOT EDIT.
+// versions:
+//   sqlc v1.27.0
+// source: blob.sql
+
+package db
+
+import (
+	"context"
+)
+
+const acquireBlob = `-- name: AcquireBlob :one
+INSERT INTO
+  blobs (hash, size, refcount)
+VALUES
+  ($1, $2, 1)
+ON CONFLICT (hash) DO UPDATE
+SET
+  refcount = blobs.refcount + 1 RETURNING hash, size, refcount, created_at
+`
+
+type AcquireBlobParams struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+func (q *Queries) AcquireBlob(ctx context.Context, arg AcquireBlobParams) (*Blob, error) {
+	row := q.db.QueryRow(ctx, acquireBlob, arg.Hash, arg.Size)
+	var i Blob
+	err := row.Scan(
+		&i.Hash,
+		&i.Size,
+		&i.Refcount,
+		&i.CreatedAt,
+	)
+	return &i, err
+}
+
+const deleteBlob = `-- name: DeleteBlob :exec
+DELETE FROM blobs
+WHERE
+  hash = $1
+  AND refcount = 0
+`
+
+func (q *Queries) DeleteBlob(ctx context.Context, hash string) error {
+	_, err := q.db.Exec(ctx, deleteBlob, hash)
+	return err
+}
+
+const lockBlob = `-- name: LockBlob :one
+SELECT
+  hash, size, refcount, created_at
+FROM
+  blobs
+WHERE
+  hash = $1
+FOR UPDATE
+`
+
+func (q *Queries) LockBlob(ctx context.Context, hash string) (*Blob, error) {
+	row := q.db.QueryRow(ctx, lockBlob, hash)
+	var i Blob
+	err := row.Scan(
+		&i.Hash,
+		&i.Size,
+		&i.Refcount,
+		&i.CreatedAt,
+	)
+	return &i, err
+}
+
+const releaseBlob = `-- name: ReleaseBlob :one
+UPDATE blobs
+SET
+  refcount = refcount - 1
+WHERE
+  hash = $1 RETURNING hash, size, refcount, created_at
+`
+
+func (q *Queries) ReleaseBlob(ctx context.Context, hash string) (*Blob, error) {
+	row := q.db.QueryRow(ctx, releaseBlob, hash)
+	var i Blob
+	err := row.Scan(
+		&i.Hash,
+		&i.Size,
+		&i.Refcount,
+		&i.CreatedAt,
+	)
+	return &i, err
+}
@@ -11,6 +11,93 @@ import (
 	"github.com/jackc/pgx/v5/pgtype"
 )
 
+type IntegrityStatus string
+
+const (
+	IntegrityStatusUnverified IntegrityStatus = "unverified"
+	IntegrityStatusOk         IntegrityStatus = "ok"
+	IntegrityStatusCorrupt    IntegrityStatus = "corrupt"
+	IntegrityStatusMissing    IntegrityStatus = "missing"
+)
+
+func (e *IntegrityStatus) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case []byte:
+		*e = IntegrityStatus(s)
+	case string:
+		*e = IntegrityStatus(s)
+	default:
+		return fmt.Errorf("unsupported scan type for IntegrityStatus: %T", src)
+	}
+	return nil
+}
+
+type NullIntegrityStatus struct {
+	IntegrityStatus IntegrityStatus `json:"integrity_status"`
+	Valid           bool            `json:"valid"` // Valid is true if IntegrityStatus is not NULL
+}
+
+// Scan implements the Scanner interface.
+func (ns *NullIntegrityStatus) Scan(value interface{}) error {
+	if value == nil {
+		ns.IntegrityStatus, ns.Valid = "", false
+		return nil
+	}
+	ns.Valid = true
+	return ns.IntegrityStatus.Scan(value)
+}
+
+// Value implements the driver Valuer interface.
+func (ns NullIntegrityStatus) Value() (driver.Value, error) {
+	if !ns.Valid {
+		return nil, nil
+	}
+	return string(ns.IntegrityStatus), nil
+}
+
+type PostKind string
+
+const (
+	PostKindFile  PostKind = "file"
+	PostKindPaste PostKind = "paste"
+	PostKindLink  PostKind = "link"
+)
+
+func (e *PostKind) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case []byte:
+		*e = PostKind(s)
+	case string:
+		*e = PostKind(s)
+	default:
+		return fmt.Errorf("unsupported scan type for PostKind: %T", src)
+	}
+	return nil
+}
+
+type NullPostKind struct {
+	PostKind PostKind `json:"post_kind"`
+	Valid    bool     `json:"valid"` // Valid is true if PostKind is not NULL
+}
+
+// Scan implements the Scanner interface.
+func (ns *NullPostKind) Scan(value interface{}) error {
+	if value == nil {
+		ns.PostKind, ns.Valid = "", false
+		return nil
+	}
+	ns.Valid = true
+	return ns.PostKind.Scan(value)
+}
+
+// Value implements the driver Valuer interface.
+func (ns NullPostKind) Value() (driver.Value, error) {
+	if !ns.Valid {
+		return nil, nil
+	}
+	return string(ns.PostKind), nil
+}
+
 type PostStatus string
 
 const (
@@ -54,12 +141,147 @@ func (ns NullPostStatus) Value() (driver.Value, error) {
 	return string(ns.PostStatus), nil
 }
 
+type PostVisibility string
+
+const (
+	PostVisibilityPublic   PostVisibility = "public"
+	PostVisibilityUnlisted PostVisibility = "unlisted"
+	PostVisibilityPrivate  PostVisibility = "private"
+)
+
+func (e *PostVisibility) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case []byte:
+		*e = PostVisibility(s)
+	case string:
+		*e = PostVisibility(s)
+	default:
+		return fmt.Errorf("unsupported scan type for PostVisibility: %T", src)
+	}
+	return nil
+}
+
+type NullPostVisibility struct {
+	PostVisibility PostVisibility `json:"post_visibility"`
+	Valid          bool           `json:"valid"` // Valid is true if PostVisibility is not NULL
+}
+
+// Scan implements the Scanner interface.
+func (ns *NullPostVisibility) Scan(value interface{}) error {
+	if value == nil {
+		ns.PostVisibility, ns.Valid = "", false
+		return nil
+	}
+	ns.Valid = true
+	return ns.PostVisibility.Scan(value)
+}
+
+// Value implements the driver Valuer interface.
+func (ns NullPostVisibility) Value() (driver.Value, error) {
+	if !ns.Valid {
+		return nil, nil
+	}
+	return string(ns.PostVisibility), nil
+}
+
+type StorageTier string
+
+const (
+	StorageTierHot  StorageTier = "hot"
+	StorageTierCold StorageTier = "cold"
+)
+
+func (e *StorageTier) Scan(src interface{}) error {
+	switch s := src.(type) {
+	case []byte:
+		*e = StorageTier(s)
+	case string:
+		*e = StorageTier(s)
+	default:
+		return fmt.Errorf("unsupported scan type for StorageTier: %T", src)
+	}
+	return nil
+}
+
+type NullStorageTier struct {
+	StorageTier StorageTier `json:"storage_tier"`
+	Valid       bool        `json:"valid"` // Valid is true if StorageTier is not NULL
+}
+
+// Scan implements the Scanner interface.
+func (ns *NullStorageTier) Scan(value interface{}) error {
+	if value == nil {
+		ns.StorageTier, ns.Valid = "", false
+		return nil
+	}
+	ns.Valid = true
+	return ns.StorageTier.Scan(value)
+}
+
+// Value implements the driver Valuer interface.
+func (ns NullStorageTier) Value() (driver.Value, error) {
+	if !ns.Valid {
+		return nil, nil
+	}
+	return string(ns.StorageTier), nil
+}
+
+type ApiKey struct {
+	ID         int64              `json:"id"`
+	Name       string             `json:"name"`
+	KeyHash    []byte             `json:"key_hash"`
+	QuotaBytes *int64             `json:"quota_bytes"`
+	QuotaFiles *int64             `json:"quota_files"`
+	UsedBytes  int64              `json:"used_bytes"`
+	UsedFiles  int64              `json:"used_files"`
+	CreatedAt  pgtype.Timestamptz `json:"created_at"`
+}
+
+type Blob struct {
+	Hash      string             `json:"hash"`
+	Size      int64              `json:"size"`
+	Refcount  int64              `json:"refcount"`
+	CreatedAt pgtype.Timestamptz `json:"created_at"`
+}
+
+type BlobChunk struct {
+	ObjectID int64  `json:"object_id"`
+	Idx      int32  `json:"idx"`
+	Data     []byte `json:"data"`
+}
+
 type Post struct {
-	ID          int64              `json:"id"`
-	Filename    *string            `json:"filename"`
-	DeletionKey *string            `json:"deletion_key"`
-	Hash        *string            `json:"hash"`
-	Status      PostStatus         `json:"status"`
-	CreatedAt   pgtype.Timestamptz `json:"created_at"`
-	UpdatedAt   pgtype.Timestamptz `json:"updated_at"`
+	ID              int64              `json:"id"`
+	Filename        *string            `json:"filename"`
+	DeletionKey     *string            `json:"deletion_key"`
+	Hash            *string            `json:"hash"`
+	Status          PostStatus         `json:"status"`
+	CreatedAt       pgtype.Timestamptz `json:"created_at"`
+	UpdatedAt       pgtype.Timestamptz `json:"updated_at"`
+	IntegrityStatus IntegrityStatus    `json:"integrity_status"`
+	VerifiedAt      pgtype.Timestamptz `json:"verified_at"`
+	Tier            StorageTier        `json:"tier"`
+	AccessedAt      pgtype.Timestamptz `json:"accessed_at"`
+	BlobHash        *string            `json:"blob_hash"`
+	OwnerID         *int64             `json:"owner_id"`
+	Size            *int64             `json:"size"`
+	Visibility      PostVisibility     `json:"visibility"`
+	PasswordHash    *string            `json:"-"`
+	MaxDownloads    *int32             `json:"max_downloads"`
+	Downloads       int32              `json:"downloads"`
+	Encrypted       bool               `json:"encrypted"`
+	Envelope        *string            `json:"envelope"`
+	Kind            PostKind           `json:"kind"`
+	Language        *string            `json:"language"`
+	ExpiresAt       pgtype.Timestamptz `json:"expires_at"`
+	TargetUrl       *string            `json:"target_url"`
+	Hits            int64              `json:"hits"`
+}
+
+type StoreObject struct {
+	Path      string             `json:"path"`
+	ObjectID  int64              `json:"object_id"`
+	Size      int64              `json:"size"`
+	ChunkSize int32              `json:"chunk_size"`
+	ModTime   pgtype.Timestamptz `json:"mod_time"`
 }
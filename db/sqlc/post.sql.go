@@ -7,8 +7,68 @@ package db
 
 import (
 	"context"
+
+	"github.com/jackc/pgx/v5/pgtype"
 )
 
+const claimDownload = `-- name: ClaimDownload :one
+UPDATE posts
+SET
+  downloads = downloads + 1
+WHERE
+  id = $1
+  AND status = 'ok'
+  AND downloads < max_downloads RETURNING id, filename, deletion_key, hash, status, created_at, updated_at, integrity_status, verified_at, tier, accessed_at, blob_hash, owner_id, size, visibility, password_hash, max_downloads, downloads, encrypted, envelope, kind, language, expires_at, target_url, hits
+`
+
+// Counts a download of a post with a download limit. Returns no rows once the
+// limit has been reached.
+func (q *Queries) ClaimDownload(ctx context.Context, id int64) (*Post, error) {
+	row := q.db.QueryRow(ctx, claimDownload, id)
+	var i Post
+	err := row.Scan(
+		&i.ID,
+		&i.Filename,
+		&i.DeletionKey,
+		&i.Hash,
+		&i.Status,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.IntegrityStatus,
+		&i.VerifiedAt,
+		&i.Tier,
+		&i.AccessedAt,
+		&i.BlobHash,
+		&i.OwnerID,
+		&i.Size,
+		&i.Visibility,
+		&i.PasswordHash,
+		&i.MaxDownloads,
+		&i.Downloads,
+		&i.Encrypted,
+		&i.Envelope,
+		&i.Kind,
+		&i.Language,
+		&i.ExpiresAt,
+		&i.TargetUrl,
+		&i.Hits,
+	)
+	return &i, err
+}
+
+const countLinkHit = `-- name: CountLinkHit :exec
+UPDATE posts
+SET
+  hits = hits + 1
+WHERE
+  id = $1
+`
+
+func (q *Queries) CountLinkHit(ctx context.Context, id int64) error {
+	_, err := q.db.Exec(ctx, countLinkHit, id)
+	return err
+}
+
 const createPost = `-- name: CreatePost :one
 INSERT INTO
   posts (filename, deletion_key, hash)
@@ -17,7 +77,7 @@ VALUES
     $1,
     $2,
     $3
-  ) RETURNING id, filename, deletion_key, hash, status, created_at, updated_at
+  ) RETURNING id, filename, deletion_key, hash, status, created_at, updated_at, integrity_status, verified_at, tier, accessed_at, blob_hash, owner_id, size, visibility, password_hash, max_downloads, downloads, encrypted, envelope, kind, language, expires_at, target_url, hits
 `
 
 type CreatePostParams struct {
@@ -37,6 +97,24 @@ func (q *Queries) CreatePost(ctx context.Context, arg CreatePostParams) (*Post,
 		&i.Status,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.IntegrityStatus,
+		&i.VerifiedAt,
+		&i.Tier,
+		&i.AccessedAt,
+		&i.BlobHash,
+		&i.OwnerID,
+		&i.Size,
+		&i.Visibility,
+		&i.PasswordHash,
+		&i.MaxDownloads,
+		&i.Downloads,
+		&i.Encrypted,
+		&i.Envelope,
+		&i.Kind,
+		&i.Language,
+		&i.ExpiresAt,
+		&i.TargetUrl,
+		&i.Hits,
 	)
 	return &i, err
 }
@@ -54,7 +132,7 @@ func (q *Queries) DeletePost(ctx context.Context, id int64) error {
 
 const getAllPosts = `-- name: GetAllPosts :many
 SELECT
-  id, filename, deletion_key, hash, status, created_at, updated_at
+  id, filename, deletion_key, hash, status, created_at, updated_at, integrity_status, verified_at, tier, accessed_at, blob_hash, owner_id, size, visibility, password_hash, max_downloads, downloads, encrypted, envelope, kind, language, expires_at, target_url, hits
 FROM
   posts
 WHERE
@@ -84,6 +162,24 @@ func (q *Queries) GetAllPosts(ctx context.Context, arg GetAllPostsParams) ([]*Po
 			&i.Status,
 			&i.CreatedAt,
 			&i.UpdatedAt,
+			&i.IntegrityStatus,
+			&i.VerifiedAt,
+			&i.Tier,
+			&i.AccessedAt,
+			&i.BlobHash,
+			&i.OwnerID,
+			&i.Size,
+			&i.Visibility,
+			&i.PasswordHash,
+			&i.MaxDownloads,
+			&i.Downloads,
+			&i.Encrypted,
+			&i.Envelope,
+			&i.Kind,
+			&i.Language,
+			&i.ExpiresAt,
+			&i.TargetUrl,
+			&i.Hits,
 		); err != nil {
 			return nil, err
 		}
@@ -97,7 +193,7 @@ func (q *Queries) GetAllPosts(ctx context.Context, arg GetAllPostsParams) ([]*Po
 
 const getPost = `-- name: GetPost :one
 SELECT
-  id, filename, deletion_key, hash, status, created_at, updated_at
+  id, filename, deletion_key, hash, status, created_at, updated_at, integrity_status, verified_at, tier, accessed_at, blob_hash, owner_id, size, visibility, password_hash, max_downloads, downloads, encrypted, envelope, kind, language, expires_at, target_url, hits
 FROM
   posts
 WHERE
@@ -117,13 +213,31 @@ func (q *Queries) GetPost(ctx context.Context, id int64) (*Post, error) {
 		&i.Status,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.IntegrityStatus,
+		&i.VerifiedAt,
+		&i.Tier,
+		&i.AccessedAt,
+		&i.BlobHash,
+		&i.OwnerID,
+		&i.Size,
+		&i.Visibility,
+		&i.PasswordHash,
+		&i.MaxDownloads,
+		&i.Downloads,
+		&i.Encrypted,
+		&i.Envelope,
+		&i.Kind,
+		&i.Language,
+		&i.ExpiresAt,
+		&i.TargetUrl,
+		&i.Hits,
 	)
 	return &i, err
 }
 
 const getPostByFilename = `-- name: GetPostByFilename :one
 SELECT
-  id, filename, deletion_key, hash, status, created_at, updated_at
+  id, filename, deletion_key, hash, status, created_at, updated_at, integrity_status, verified_at, tier, accessed_at, blob_hash, owner_id, size, visibility, password_hash, max_downloads, downloads, encrypted, envelope, kind, language, expires_at, target_url, hits
 FROM
   posts
 WHERE
@@ -143,28 +257,451 @@ func (q *Queries) GetPostByFilename(ctx context.Context, filename *string) (*Pos
 		&i.Status,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.IntegrityStatus,
+		&i.VerifiedAt,
+		&i.Tier,
+		&i.AccessedAt,
+		&i.BlobHash,
+		&i.OwnerID,
+		&i.Size,
+		&i.Visibility,
+		&i.PasswordHash,
+		&i.MaxDownloads,
+		&i.Downloads,
+		&i.Encrypted,
+		&i.Envelope,
+		&i.Kind,
+		&i.Language,
+		&i.ExpiresAt,
+		&i.TargetUrl,
+		&i.Hits,
 	)
 	return &i, err
 }
 
+const listExpiredPosts = `-- name: ListExpiredPosts :many
+SELECT
+  id, filename, deletion_key, hash, status, created_at, updated_at, integrity_status, verified_at, tier, accessed_at, blob_hash, owner_id, size, visibility, password_hash, max_downloads, downloads, encrypted, envelope, kind, language, expires_at, target_url, hits
+FROM
+  posts
+WHERE
+  id > $1
+  AND status = 'ok'
+  AND expires_at <= now ()
+ORDER BY
+  id
+LIMIT
+  $2
+`
+
+type ListExpiredPostsParams struct {
+	AfterID  int64 `json:"after_id"`
+	PageSize int32 `json:"page_size"`
+}
+
+func (q *Queries) ListExpiredPosts(ctx context.Context, arg ListExpiredPostsParams) ([]*Post, error) {
+	rows, err := q.db.Query(ctx, listExpiredPosts, arg.AfterID, arg.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*Post
+	for rows.Next() {
+		var i Post
+		if err := rows.Scan(
+			&i.ID,
+			&i.Filename,
+			&i.DeletionKey,
+			&i.Hash,
+			&i.Status,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.IntegrityStatus,
+			&i.VerifiedAt,
+			&i.Tier,
+			&i.AccessedAt,
+			&i.BlobHash,
+			&i.OwnerID,
+			&i.Size,
+			&i.Visibility,
+			&i.PasswordHash,
+			&i.MaxDownloads,
+			&i.Downloads,
+			&i.Encrypted,
+			&i.Envelope,
+			&i.Kind,
+			&i.Language,
+			&i.ExpiresAt,
+			&i.TargetUrl,
+			&i.Hits,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listPostsAfter = `-- name: ListPostsAfter :many
+SELECT
+  id, filename, deletion_key, hash, status, created_at, updated_at, integrity_status, verified_at, tier, accessed_at, blob_hash, owner_id, size, visibility, password_hash, max_downloads, downloads, encrypted, envelope, kind, language, expires_at, target_url, hits
+FROM
+  posts
+WHERE
+  id > $1
+  AND status = 'ok'
+  AND kind <> 'link'
+ORDER BY
+  id
+LIMIT
+  $2
+`
+
+type ListPostsAfterParams struct {
+	AfterID  int64 `json:"after_id"`
+	PageSize int32 `json:"page_size"`
+}
+
+func (q *Queries) ListPostsAfter(ctx context.Context, arg ListPostsAfterParams) ([]*Post, error) {
+	rows, err := q.db.Query(ctx, listPostsAfter, arg.AfterID, arg.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*Post
+	for rows.Next() {
+		var i Post
+		if err := rows.Scan(
+			&i.ID,
+			&i.Filename,
+			&i.DeletionKey,
+			&i.Hash,
+			&i.Status,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.IntegrityStatus,
+			&i.VerifiedAt,
+			&i.Tier,
+			&i.AccessedAt,
+			&i.BlobHash,
+			&i.OwnerID,
+			&i.Size,
+			&i.Visibility,
+			&i.PasswordHash,
+			&i.MaxDownloads,
+			&i.Downloads,
+			&i.Encrypted,
+			&i.Envelope,
+			&i.Kind,
+			&i.Language,
+			&i.ExpiresAt,
+			&i.TargetUrl,
+			&i.Hits,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listPostsToDemote = `-- name: ListPostsToDemote :many
+SELECT
+  id, filename, deletion_key, hash, status, created_at, updated_at, integrity_status, verified_at, tier, accessed_at, blob_hash, owner_id, size, visibility, password_hash, max_downloads, downloads, encrypted, envelope, kind, language, expires_at, target_url, hits
+FROM
+  posts
+WHERE
+  id > $1
+  AND status = 'ok'
+  AND kind <> 'link'
+  AND tier = 'hot'
+  AND (
+    created_at < $2
+    OR coalesce(accessed_at, created_at) < $3
+  )
+ORDER BY
+  id
+LIMIT
+  $4
+`
+
+type ListPostsToDemoteParams struct {
+	AfterID        int64              `json:"after_id"`
+	CreatedBefore  pgtype.Timestamptz `json:"created_before"`
+	AccessedBefore pgtype.Timestamptz `json:"accessed_before"`
+	PageSize       int32              `json:"page_size"`
+}
+
+func (q *Queries) ListPostsToDemote(ctx context.Context, arg ListPostsToDemoteParams) ([]*Post, error) {
+	rows, err := q.db.Query(ctx, listPostsToDemote,
+		arg.AfterID,
+		arg.CreatedBefore,
+		arg.AccessedBefore,
+		arg.PageSize,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*Post
+	for rows.Next() {
+		var i Post
+		if err := rows.Scan(
+			&i.ID,
+			&i.Filename,
+			&i.DeletionKey,
+			&i.Hash,
+			&i.Status,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.IntegrityStatus,
+			&i.VerifiedAt,
+			&i.Tier,
+			&i.AccessedAt,
+			&i.BlobHash,
+			&i.OwnerID,
+			&i.Size,
+			&i.Visibility,
+			&i.PasswordHash,
+			&i.MaxDownloads,
+			&i.Downloads,
+			&i.Encrypted,
+			&i.Envelope,
+			&i.Kind,
+			&i.Language,
+			&i.ExpiresAt,
+			&i.TargetUrl,
+			&i.Hits,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const listPostsToScrub = `-- name: ListPostsToScrub :many
+SELECT
+  id, filename, deletion_key, hash, status, created_at, updated_at, integrity_status, verified_at, tier, accessed_at, blob_hash, owner_id, size, visibility, password_hash, max_downloads, downloads, encrypted, envelope, kind, language, expires_at, target_url, hits
+FROM
+  posts
+WHERE
+  id > $1
+  AND status = 'ok'
+  AND kind <> 'link'
+  AND (
+    verified_at IS NULL
+    OR verified_at < $2
+  )
+ORDER BY
+  id
+LIMIT
+  $3
+`
+
+type ListPostsToScrubParams struct {
+	AfterID        int64              `json:"after_id"`
+	VerifiedBefore pgtype.Timestamptz `json:"verified_before"`
+	PageSize       int32              `json:"page_size"`
+}
+
+func (q *Queries) ListPostsToScrub(ctx context.Context, arg ListPostsToScrubParams) ([]*Post, error) {
+	rows, err := q.db.Query(ctx, listPostsToScrub, arg.AfterID, arg.VerifiedBefore, arg.PageSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*Post
+	for rows.Next() {
+		var i Post
+		if err := rows.Scan(
+			&i.ID,
+			&i.Filename,
+			&i.DeletionKey,
+			&i.Hash,
+			&i.Status,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+			&i.IntegrityStatus,
+			&i.VerifiedAt,
+			&i.Tier,
+			&i.AccessedAt,
+			&i.BlobHash,
+			&i.OwnerID,
+			&i.Size,
+			&i.Visibility,
+			&i.PasswordHash,
+			&i.MaxDownloads,
+			&i.Downloads,
+			&i.Encrypted,
+			&i.Envelope,
+			&i.Kind,
+			&i.Language,
+			&i.ExpiresAt,
+			&i.TargetUrl,
+			&i.Hits,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const removePost = `-- name: RemovePost :one
+UPDATE posts
+SET
+  status = 'removed',
+  blob_hash = NULL,
+  updated_at = now ()
+WHERE
+  id = $1
+  AND status = 'ok' RETURNING id, filename, deletion_key, hash, status, created_at, updated_at, integrity_status, verified_at, tier, accessed_at, blob_hash, owner_id, size, visibility, password_hash, max_downloads, downloads, encrypted, envelope, kind, language, expires_at, target_url, hits
+`
+
+func (q *Queries) RemovePost(ctx context.Context, id int64) (*Post, error) {
+	row := q.db.QueryRow(ctx, removePost, id)
+	var i Post
+	err := row.Scan(
+		&i.ID,
+		&i.Filename,
+		&i.DeletionKey,
+		&i.Hash,
+		&i.Status,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+		&i.IntegrityStatus,
+		&i.VerifiedAt,
+		&i.Tier,
+		&i.AccessedAt,
+		&i.BlobHash,
+		&i.OwnerID,
+		&i.Size,
+		&i.Visibility,
+		&i.PasswordHash,
+		&i.MaxDownloads,
+		&i.Downloads,
+		&i.Encrypted,
+		&i.Envelope,
+		&i.Kind,
+		&i.Language,
+		&i.ExpiresAt,
+		&i.TargetUrl,
+		&i.Hits,
+	)
+	return &i, err
+}
+
+const setPostIntegrity = `-- name: SetPostIntegrity :exec
+UPDATE posts
+SET
+  integrity_status = $1,
+  verified_at = now ()
+WHERE
+  id = $2
+`
+
+type SetPostIntegrityParams struct {
+	IntegrityStatus IntegrityStatus `json:"integrity_status"`
+	ID              int64           `json:"id"`
+}
+
+func (q *Queries) SetPostIntegrity(ctx context.Context, arg SetPostIntegrityParams) error {
+	_, err := q.db.Exec(ctx, setPostIntegrity, arg.IntegrityStatus, arg.ID)
+	return err
+}
+
+const setPostTier = `-- name: SetPostTier :exec
+UPDATE posts
+SET
+  tier = $1
+WHERE
+  id = $2
+`
+
+type SetPostTierParams struct {
+	Tier StorageTier `json:"tier"`
+	ID   int64       `json:"id"`
+}
+
+func (q *Queries) SetPostTier(ctx context.Context, arg SetPostTierParams) error {
+	_, err := q.db.Exec(ctx, setPostTier, arg.Tier, arg.ID)
+	return err
+}
+
+const touchPost = `-- name: TouchPost :exec
+UPDATE posts
+SET
+  accessed_at = now ()
+WHERE
+  id = $1
+  AND (
+    accessed_at IS NULL
+    OR accessed_at < now () - interval '1 hour'
+  )
+`
+
+func (q *Queries) TouchPost(ctx context.Context, id int64) error {
+	_, err := q.db.Exec(ctx, touchPost, id)
+	return err
+}
+
 const updatePost = `-- name: UpdatePost :one
 UPDATE posts
 SET
   filename = coalesce($1, filename),
   deletion_key = coalesce($2, deletion_key),
   hash = coalesce($3, hash),
-  status = coalesce($4, status),
+  blob_hash = coalesce($4, blob_hash),
+  owner_id = coalesce($5, owner_id),
+  size = coalesce($6, size),
+  visibility = coalesce($7, visibility),
+  password_hash = coalesce($8, password_hash),
+  max_downloads = coalesce($9, max_downloads),
+  encrypted = coalesce($10, encrypted),
+  envelope = coalesce($11, envelope),
+  kind = coalesce($12, kind),
+  language = coalesce($13, language),
+  expires_at = coalesce($14, expires_at),
+  target_url = coalesce($15, target_url),
+  tier = coalesce($16, tier),
+  status = coalesce($17, status),
   updated_at = now ()
 WHERE
-  id = $5 RETURNING id, filename, deletion_key, hash, status, created_at, updated_at
+  id = $18 RETURNING id, filename, deletion_key, hash, status, created_at, updated_at, integrity_status, verified_at, tier, accessed_at, blob_hash, owner_id, size, visibility, password_hash, max_downloads, downloads, encrypted, envelope, kind, language, expires_at, target_url, hits
 `
 
 type UpdatePostParams struct {
-	Filename    *string        `json:"filename"`
-	DeletionKey *string        `json:"deletion_key"`
-	Hash        *string        `json:"hash"`
-	Status      NullPostStatus `json:"status"`
-	ID          int64          `json:"id"`
+	Filename     *string            `json:"filename"`
+	DeletionKey  *string            `json:"deletion_key"`
+	Hash         *string            `json:"hash"`
+	BlobHash     *string            `json:"blob_hash"`
+	OwnerID      *int64             `json:"owner_id"`
+	Size         *int64             `json:"size"`
+	Visibility   NullPostVisibility `json:"visibility"`
+	PasswordHash *string            `json:"-"`
+	MaxDownloads *int32             `json:"max_downloads"`
+	Encrypted    *bool              `json:"encrypted"`
+	Envelope     *string            `json:"envelope"`
+	Kind         NullPostKind       `json:"kind"`
+	Language     *string            `json:"language"`
+	ExpiresAt    pgtype.Timestamptz `json:"expires_at"`
+	TargetUrl    *string            `json:"target_url"`
+	Tier         NullStorageTier    `json:"tier"`
+	Status       NullPostStatus     `json:"status"`
+	ID           int64              `json:"id"`
 }
 
 func (q *Queries) UpdatePost(ctx context.Context, arg UpdatePostParams) (*Post, error) {
@@ -172,6 +709,19 @@ func (q *Queries) UpdatePost(ctx context.Context, arg UpdatePostParams) (*Post,
 		arg.Filename,
 		arg.DeletionKey,
 		arg.Hash,
+		arg.BlobHash,
+		arg.OwnerID,
+		arg.Size,
+		arg.Visibility,
+		arg.PasswordHash,
+		arg.MaxDownloads,
+		arg.Encrypted,
+		arg.Envelope,
+		arg.Kind,
+		arg.Language,
+		arg.ExpiresAt,
+		arg.TargetUrl,
+		arg.Tier,
 		arg.Status,
 		arg.ID,
 	)
@@ -184,6 +734,24 @@ func (q *Queries) UpdatePost(ctx context.Context, arg UpdatePostParams) (*Post,
 		&i.Status,
 		&i.CreatedAt,
 		&i.UpdatedAt,
+		&i.IntegrityStatus,
+		&i.VerifiedAt,
+		&i.Tier,
+		&i.AccessedAt,
+		&i.BlobHash,
+		&i.OwnerID,
+		&i.Size,
+		&i.Visibility,
+		&i.PasswordHash,
+		&i.MaxDownloads,
+		&i.Downloads,
+		&i.Encrypted,
+		&i.Envelope,
+		&i.Kind,
+		&i.Language,
+		&i.ExpiresAt,
+		&i.TargetUrl,
+		&i.Hits,
 	)
 	return &i, err
 }
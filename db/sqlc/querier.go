@@ -9,11 +9,44 @@ import (
 )
 
 type Querier interface {
+	AcquireBlob(ctx context.Context, arg AcquireBlobParams) (*Blob, error)
+	// Counts a download of a post with a download limit. Returns no rows once the
+	// limit has been reached.
+	ClaimDownload(ctx context.Context, id int64) (*Post, error)
+	CountLinkHit(ctx context.Context, id int64) error
+	CreateApiKey(ctx context.Context, arg CreateApiKeyParams) (*ApiKey, error)
 	CreatePost(ctx context.Context, arg CreatePostParams) (*Post, error)
+	DeleteBlob(ctx context.Context, hash string) error
+	DeleteBlobChunks(ctx context.Context, objectID int64) error
 	DeletePost(ctx context.Context, id int64) error
+	DeleteStoreObject(ctx context.Context, path string) (*StoreObject, error)
 	GetAllPosts(ctx context.Context, arg GetAllPostsParams) ([]*Post, error)
+	GetApiKeyByHash(ctx context.Context, keyHash []byte) (*ApiKey, error)
+	GetBlobChunk(ctx context.Context, arg GetBlobChunkParams) ([]byte, error)
 	GetPost(ctx context.Context, id int64) (*Post, error)
 	GetPostByFilename(ctx context.Context, filename *string) (*Post, error)
+	GetStoreObject(ctx context.Context, path string) (*StoreObject, error)
+	GetUnownedUsage(ctx context.Context) (*GetUnownedUsageRow, error)
+	InsertBlobChunk(ctx context.Context, arg InsertBlobChunkParams) error
+	ListExpiredPosts(ctx context.Context, arg ListExpiredPostsParams) ([]*Post, error)
+	ListPostsAfter(ctx context.Context, arg ListPostsAfterParams) ([]*Post, error)
+	ListPostsToDemote(ctx context.Context, arg ListPostsToDemoteParams) ([]*Post, error)
+	ListPostsToScrub(ctx context.Context, arg ListPostsToScrubParams) ([]*Post, error)
+	// Objects are listed in the order of store.ComparePaths: component by
+	// component, comparing bytes.
+	ListStoreObjects(ctx context.Context, arg ListStoreObjectsParams) ([]*StoreObject, error)
+	LockBlob(ctx context.Context, hash string) (*Blob, error)
+	LockStorePath(ctx context.Context, path string) error
+	NextStoreObjectID(ctx context.Context) (int64, error)
+	PutStoreObject(ctx context.Context, arg PutStoreObjectParams) error
+	ReleaseBlob(ctx context.Context, hash string) (*Blob, error)
+	ReleaseUsage(ctx context.Context, arg ReleaseUsageParams) error
+	RemovePost(ctx context.Context, id int64) (*Post, error)
+	ReserveUsage(ctx context.Context, arg ReserveUsageParams) (*ApiKey, error)
+	SetApiKeyQuota(ctx context.Context, arg SetApiKeyQuotaParams) (*ApiKey, error)
+	SetPostIntegrity(ctx context.Context, arg SetPostIntegrityParams) error
+	SetPostTier(ctx context.Context, arg SetPostTierParams) error
+	TouchPost(ctx context.Context, id int64) error
 	UpdatePost(ctx context.Context, arg UpdatePostParams) (*Post, error)
 }
 
@@ -0,0 +1,214 @@
+// Code generated by sqlc. DO NOT EDIT.
+// versions:
+//   sqlc v1.27.0
+// source: store_object.sql
+
+package db
+
+import (
+	"context"
+)
+
+const deleteBlobChunks = `-- name: DeleteBlobChunks :exec
+DELETE FROM blob_chunks
+WHERE
+  object_id = $1
+`
+
+func (q *Queries) DeleteBlobChunks(ctx context.Context, objectID int64) error {
+	_, err := q.db.Exec(ctx, deleteBlobChunks, objectID)
+	return err
+}
+
+const deleteStoreObject = `-- name: DeleteStoreObject :one
+DELETE FROM store_objects
+WHERE
+  path = $1 RETURNING path, object_id, size, chunk_size, mod_time
+`
+
+func (q *Queries) DeleteStoreObject(ctx context.Context, path string) (*StoreObject, error) {
+	row := q.db.QueryRow(ctx, deleteStoreObject, path)
+	var i StoreObject
+	err := row.Scan(
+		&i.Path,
+		&i.ObjectID,
+		&i.Size,
+		&i.ChunkSize,
+		&i.ModTime,
+	)
+	return &i, err
+}
+
+const getBlobChunk = `-- name: GetBlobChunk :one
+SELECT
+  data
+FROM
+  blob_chunks
+WHERE
+  object_id = $1
+  AND idx = $2
+`
+
+type GetBlobChunkParams struct {
+	ObjectID int64 `json:"object_id"`
+	Idx      int32 `json:"idx"`
+}
+
+func (q *Queries) GetBlobChunk(ctx context.Context, arg GetBlobChunkParams) ([]byte, error) {
+	row := q.db.QueryRow(ctx, getBlobChunk, arg.ObjectID, arg.Idx)
+	var data []byte
+	err := row.Scan(&data)
+	return data, err
+}
+
+const getStoreObject = `-- name: GetStoreObject :one
+SELECT
+  path, object_id, size, chunk_size, mod_time
+FROM
+  store_objects
+WHERE
+  path = $1
+`
+
+func (q *Queries) GetStoreObject(ctx context.Context, path string) (*StoreObject, error) {
+	row := q.db.QueryRow(ctx, getStoreObject, path)
+	var i StoreObject
+	err := row.Scan(
+		&i.Path,
+		&i.ObjectID,
+		&i.Size,
+		&i.ChunkSize,
+		&i.ModTime,
+	)
+	return &i, err
+}
+
+const insertBlobChunk = `-- name: InsertBlobChunk :exec
+INSERT INTO
+  blob_chunks (object_id, idx, data)
+VALUES
+  (
+    $1,
+    $2,
+    $3
+  )
+`
+
+type InsertBlobChunkParams struct {
+	ObjectID int64  `json:"object_id"`
+	Idx      int32  `json:"idx"`
+	Data     []byte `json:"data"`
+}
+
+func (q *Queries) InsertBlobChunk(ctx context.Context, arg InsertBlobChunkParams) error {
+	_, err := q.db.Exec(ctx, insertBlobChunk, arg.ObjectID, arg.Idx, arg.Data)
+	return err
+}
+
+const listStoreObjects = `-- name: ListStoreObjects :many
+SELECT
+  path, object_id, size, chunk_size, mod_time
+FROM
+  store_objects
+WHERE
+  starts_with(path, $1::text)
+  AND (
+    $2::text = ''
+    OR string_to_array(path COLLATE "C", '/') > string_to_array($2::text COLLATE "C", '/')
+  )
+ORDER BY
+  string_to_array(path COLLATE "C", '/')
+LIMIT
+  $3
+`
+
+type ListStoreObjectsParams struct {
+	Prefix string `json:"prefix"`
+	Cursor string `json:"cursor"`
+	Limit  int32  `json:"limit"`
+}
+
+// Objects are listed in the order of store.ComparePaths: component by
+// component, comparing bytes.
+func (q *Queries) ListStoreObjects(ctx context.Context, arg ListStoreObjectsParams) ([]*StoreObject, error) {
+	rows, err := q.db.Query(ctx, listStoreObjects, arg.Prefix, arg.Cursor, arg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*StoreObject
+	for rows.Next() {
+		var i StoreObject
+		if err := rows.Scan(
+			&i.Path,
+			&i.ObjectID,
+			&i.Size,
+			&i.ChunkSize,
+			&i.ModTime,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const lockStorePath = `-- name: LockStorePath :exec
+SELECT
+  pg_advisory_xact_lock(hashtext($1::text))
+`
+
+func (q *Queries) LockStorePath(ctx context.Context, path string) error {
+	_, err := q.db.Exec(ctx, lockStorePath, path)
+	return err
+}
+
+const nextStoreObjectID = `-- name: NextStoreObjectID :one
+SELECT
+  nextval('store_object_ids')::bigint
+`
+
+func (q *Queries) NextStoreObjectID(ctx context.Context) (int64, error) {
+	row := q.db.QueryRow(ctx, nextStoreObjectID)
+	var column_1 int64
+	err := row.Scan(&column_1)
+	return column_1, err
+}
+
+const putStoreObject = `-- name: PutStoreObject :exec
+INSERT INTO
+  store_objects (path, object_id, size, chunk_size)
+VALUES
+  (
+    $1,
+    $2,
+    $3,
+    $4
+  )
+ON CONFLICT (path) DO UPDATE
+SET
+  object_id = EXCLUDED.object_id,
+  size = EXCLUDED.size,
+  chunk_size = EXCLUDED.chunk_size,
+  mod_time = CURRENT_TIMESTAMP
+`
+
+type PutStoreObjectParams struct {
+	Path      string `json:"path"`
+	ObjectID  int64  `json:"object_id"`
+	Size      int64  `json:"size"`
+	ChunkSize int32  `json:"chunk_size"`
+}
+
+func (q *Queries) PutStoreObject(ctx context.Context, arg PutStoreObjectParams) error {
+	_, err := q.db.Exec(ctx, putStoreObject,
+		arg.Path,
+		arg.ObjectID,
+		arg.Size,
+		arg.ChunkSize,
+	)
+	return err
+}
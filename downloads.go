@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+var InvalidMaxDownloadsError = errors.New(
+	"max_downloads must be a positive number",
+)
+
+// Converts the max_downloads field of an upload form, where an empty value
+// means no limit and 1 means the post is removed after its first download.
+func parseMaxDownloads(s string) (*int32, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	n, err := strconv.ParseInt(s, 10, 32)
+	if err != nil || n <= 0 {
+		return nil, InvalidMaxDownloadsError
+	}
+
+	max := int32(n)
+	return &max, nil
+}
+
+// Counts a download of a post with a download limit. The count is taken in a
+// single UPDATE, so concurrent requests cannot serve the post more often than
+// allowed. Aborts the request and reports false if the limit was already
+// reached; otherwise reports whether this was the last download.
+func (dc *DogboxController) claimDownload(
+	c *gin.Context,
+	p *db.Post,
+) (last bool, ok bool) {
+	claimed, err := dc.db.ClaimDownload(c.Request.Context(), p.ID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.AbortWithError(http.StatusNotFound, NotFoundError(*p.Filename))
+		return false, false
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return false, false
+	}
+
+	return claimed.Downloads >= *claimed.MaxDownloads, true
+}
+
+// Removes a post whose last download has been served. Runs after the
+// response, so it must not depend on the request still being alive.
+func (dc *DogboxController) burnPost(ctx context.Context, p *db.Post) {
+	err := dc.removePost(context.WithoutCancel(ctx), p)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Printf("burn: post %d: %v\n", p.ID, err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestParseMaxDownloads(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int32
+		err  error
+	}{
+		{"", 0, nil},
+		{"1", 1, nil},
+		{"100", 100, nil},
+		{"0", 0, InvalidMaxDownloadsError},
+		{"-1", 0, InvalidMaxDownloadsError},
+		{"1.5", 0, InvalidMaxDownloadsError},
+		{"many", 0, InvalidMaxDownloadsError},
+		{"4294967296", 0, InvalidMaxDownloadsError},
+	}
+
+	for _, tt := range tests {
+		got, err := parseMaxDownloads(tt.in)
+		if err != tt.err {
+			t.Errorf("parseMaxDownloads(%q): got error %v, want %v", tt.in, err, tt.err)
+			continue
+		}
+		if (got == nil) != (tt.want == 0) || (got != nil && *got != tt.want) {
+			t.Errorf("parseMaxDownloads(%q) = %v, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBurnAfterReading(t *testing.T) {
+	dc := newTestController(t)
+	data := []byte("read me once")
+
+	w, name := upload(t, dc, "secret.txt", data, map[string]string{
+		"max_downloads": "1",
+	})
+	if name == "" {
+		t.Fatalf("uploading: %d %s", w.Code, w.Body)
+	}
+
+	w = serve(dc, http.MethodGet, postURL(name), "")
+	if w.Code != http.StatusOK || w.Body.String() != string(data) {
+		t.Fatalf("first download: %d %q", w.Code, w.Body)
+	}
+	if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+		t.Fatalf("Cache-Control = %q, want no-store", cc)
+	}
+
+	w = serve(dc, http.MethodGet, postURL(name), "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("second download: %d %q, want %d", w.Code, w.Body, http.StatusNotFound)
+	}
+}
+
+func TestMaxDownloads(t *testing.T) {
+	dc := newTestController(t)
+
+	w, name := upload(t, dc, "a.txt", []byte("a"), map[string]string{
+		"max_downloads": "3",
+	})
+	if name == "" {
+		t.Fatalf("uploading: %d %s", w.Code, w.Body)
+	}
+
+	for i := range 3 {
+		w = serve(dc, http.MethodGet, postURL(name), "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("download %d: %d %q", i+1, w.Code, w.Body)
+		}
+	}
+
+	w = serve(dc, http.MethodGet, postURL(name), "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("download past the limit: %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var InvalidExpiryError = errors.New("expires_in must be a positive duration")
+
+// Converts the expires_in field of an upload form, such as "24h", to the
+// time the post expires. An empty value means the post never expires.
+func parseExpiry(s string) (pgtype.Timestamptz, error) {
+	if s == "" {
+		return pgtype.Timestamptz{}, nil
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return pgtype.Timestamptz{}, InvalidExpiryError
+	}
+
+	return pgtype.Timestamptz{Time: time.Now().Add(d), Valid: true}, nil
+}
+
+// Reports whether a post can be served: it has not been removed, and has not
+// expired. Expired posts stay in the database until the expirer removes them.
+func postAvailable(p *db.Post) bool {
+	if p.Status != db.PostStatusOk {
+		return false
+	}
+
+	return !p.ExpiresAt.Valid || time.Now().Before(p.ExpiresAt.Time)
+}
+
+// Removes every post that has expired, releasing its storage. Returns the
+// number of posts that were removed.
+func (dc *DogboxController) ExpirePosts(ctx context.Context) (int, error) {
+	params := db.ListExpiredPostsParams{PageSize: POST_BATCH_SIZE}
+
+	removed := 0
+	for {
+		posts, err := dc.db.ListExpiredPosts(ctx, params)
+		if err != nil {
+			return removed, err
+		}
+		if len(posts) == 0 {
+			return removed, nil
+		}
+
+		for _, p := range posts {
+			params.AfterID = p.ID
+
+			err := dc.removePost(ctx, p)
+			// The post was deleted in the meantime.
+			if errors.Is(err, pgx.ErrNoRows) {
+				continue
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return removed, ctx.Err()
+				}
+				log.Printf("expire: post %d: %v\n", p.ID, err)
+				continue
+			}
+			removed++
+		}
+	}
+}
+
+// Runs ExpirePosts in the background every DOGBOX_EXPIRY_INTERVAL until the
+// context is canceled.
+func (dc *DogboxController) StartExpirer(ctx context.Context) {
+	interval := dc.cfg.DogboxExpiryInterval
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			removed, err := dc.ExpirePosts(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("expire: %v\n", err)
+			}
+			if removed > 0 {
+				log.Printf("expire: removed %d posts\n", removed)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Command-line entry point for a single pass of the expirer.
+func runExpire(ctx context.Context, dc *DogboxController, args []string) error {
+	removed, err := dc.ExpirePosts(ctx)
+	log.Printf("expire: removed %d posts\n", removed)
+
+	return err
+}
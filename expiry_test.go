@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+func TestParseExpiry(t *testing.T) {
+	tests := []struct {
+		in   string
+		want time.Duration
+		err  error
+	}{
+		{"", 0, nil},
+		{"1h", time.Hour, nil},
+		{"90m", 90 * time.Minute, nil},
+		{"0s", 0, InvalidExpiryError},
+		{"-1h", 0, InvalidExpiryError},
+		{"1 day", 0, InvalidExpiryError},
+	}
+
+	for _, tt := range tests {
+		before := time.Now()
+		got, err := parseExpiry(tt.in)
+		if err != tt.err {
+			t.Errorf("parseExpiry(%q): got error %v, want %v", tt.in, err, tt.err)
+			continue
+		}
+		if got.Valid != (tt.want > 0) {
+			t.Errorf("parseExpiry(%q) is set: %v, want %v", tt.in, got.Valid, tt.want > 0)
+			continue
+		}
+		if got.Valid && (got.Time.Before(before.Add(tt.want)) ||
+			got.Time.After(time.Now().Add(tt.want))) {
+			t.Errorf("parseExpiry(%q) = %v, want %v from now", tt.in, got.Time, tt.want)
+		}
+	}
+}
+
+func TestPostAvailable(t *testing.T) {
+	past := pgtype.Timestamptz{Time: time.Now().Add(-time.Minute), Valid: true}
+	future := pgtype.Timestamptz{Time: time.Now().Add(time.Minute), Valid: true}
+
+	tests := []struct {
+		name string
+		post db.Post
+		want bool
+	}{
+		{"NoExpiry", db.Post{Status: db.PostStatusOk}, true},
+		{"NotExpired", db.Post{Status: db.PostStatusOk, ExpiresAt: future}, true},
+		{"Expired", db.Post{Status: db.PostStatusOk, ExpiresAt: past}, false},
+		{"Removed", db.Post{Status: db.PostStatusRemoved}, false},
+	}
+
+	for _, tt := range tests {
+		if got := postAvailable(&tt.post); got != tt.want {
+			t.Errorf("%s: postAvailable = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,548 @@
+package store
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// Hit and miss counters of a CachedStore, along with the current size of each
+// tier.
+type CacheStats struct {
+	MemoryHits      uint64 `json:"memory_hits"`
+	DiskHits        uint64 `json:"disk_hits"`
+	Misses          uint64 `json:"misses"`
+	Evictions       uint64 `json:"evictions"`
+	MemoryBytes     int64  `json:"memory_bytes"`
+	MemoryObjects   int    `json:"memory_objects"`
+	DiskBytes       int64  `json:"disk_bytes"`
+	DiskObjects     int    `json:"disk_objects"`
+	MemoryCapacity  int64  `json:"memory_capacity"`
+	DiskCapacity    int64  `json:"disk_capacity"`
+	CoalescedMisses uint64 `json:"coalesced_misses"`
+}
+
+// A CachedStore keeps recently read objects of a (presumably remote) backing
+// store in a bounded in-memory tier and a bounded local disk tier. Both
+// tiers evict the least recently used objects once they are over capacity.
+// Objects larger than a sixteenth of the memory tier are only cached on disk.
+//
+// Concurrent misses for the same path are coalesced into a single read from
+// the backing store. Writes and deletes go straight to the backing store and
+// invalidate the cached copy.
+//
+// The disk tier keeps each object in a file named after the hash of its
+// path, and outlives the process: a new cache takes over the files it finds
+// in its directory. Several processes, such as the server and maintenance
+// commands, may share the directory. Each keeps its own index of the files,
+// and writes and deletes in any of them remove the shared file.
+type CachedStore struct {
+	inner Store
+	dir   string
+
+	mu     sync.Mutex
+	memory *lruTier
+	disk   *lruTier
+	// Fills in progress, by path. Only paths that are being filled are
+	// tracked, so that the map does not grow with every path ever written.
+	pending map[string]*pendingFill
+
+	fills singleflight.Group
+
+	memoryHits atomic.Uint64
+	diskHits   atomic.Uint64
+	misses     atomic.Uint64
+	coalesced  atomic.Uint64
+	evictions  atomic.Uint64
+}
+
+var errTooLargeToCache = errors.New("Object is too large to cache")
+
+var _ Store = (*CachedStore)(nil)
+var _ Rewrapper = (*CachedStore)(nil)
+
+// Options of the "cached" store type.
+type cacheOptions struct {
+	Dir        string `mapstructure:"dir"`
+	DiskSize   int64  `mapstructure:"disk_size"`
+	MemorySize int64  `mapstructure:"memory_size"`
+}
+
+func init() {
+	Register("cached", func(spec *Spec) (Builder, error) {
+		if err := spec.ExpectStores(1, 1); err != nil {
+			return nil, err
+		}
+
+		var opts cacheOptions
+		if err := spec.Decode(&opts); err != nil {
+			return nil, err
+		}
+		if opts.Dir == "" {
+			return nil, fmt.Errorf("%w: dir is required", ErrInvalidSpec)
+		}
+		if opts.DiskSize < 0 || opts.MemorySize < 0 {
+			return nil, fmt.Errorf(
+				"%w: cache sizes must not be negative",
+				ErrInvalidSpec,
+			)
+		}
+
+		return func(stores []Store) (Store, error) {
+			return MakeCachedStore(
+				stores[0],
+				opts.Dir,
+				opts.DiskSize,
+				opts.MemorySize,
+			)
+		}, nil
+	})
+}
+
+// Returns a store that caches reads from the backing store in up to memSize
+// bytes of memory and diskSize bytes of files in dir. Files cached by earlier
+// processes are kept, from the least to the most recently written, until the
+// disk tier is full.
+func MakeCachedStore(
+	inner Store,
+	dir string,
+	diskSize, memSize int64,
+) (*CachedStore, error) {
+	if err := os.MkdirAll(dir, DIR_PERMISSIONS); err != nil {
+		return nil, err
+	}
+
+	c := &CachedStore{
+		inner:   inner,
+		dir:     dir,
+		pending: make(map[string]*pendingFill),
+	}
+	c.memory = newLRUTier(memSize, nil)
+	c.disk = newLRUTier(diskSize, func(e *cacheEntry) {
+		os.Remove(e.file)
+	})
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Adds the files in the cache directory to the disk tier.
+func (c *CachedStore) load() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+
+	type cached struct {
+		entry   *cacheEntry
+		modTime time.Time
+	}
+	var found []cached
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !isCacheFileName(e.Name()) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+
+		found = append(found, cached{
+			entry: &cacheEntry{
+				key:  e.Name(),
+				size: info.Size(),
+				file: filepath.Join(c.dir, e.Name()),
+			},
+			modTime: info.ModTime(),
+		})
+	}
+	slices.SortFunc(found, func(a, b cached) int {
+		return a.modTime.Compare(b.modTime)
+	})
+
+	for _, f := range found {
+		c.disk.add(f.entry)
+	}
+
+	return nil
+}
+
+// Returns the name of the disk tier's file for the given path.
+func cacheFileName(path string) string {
+	sum := sha256.Sum256([]byte(path))
+	return hex.EncodeToString(sum[:])
+}
+
+func isCacheFileName(name string) bool {
+	if len(name) != 2*sha256.Size {
+		return false
+	}
+	_, err := hex.DecodeString(name)
+	return err == nil
+}
+
+func (c *CachedStore) Unwrap() Store {
+	return c.inner
+}
+
+// Returns inner as is: the cache does not transform objects, and reads that
+// look past it are not meant to be cached.
+func (c *CachedStore) Rewrap(inner Store) Store {
+	return inner
+}
+
+func (c *CachedStore) BaseURL() string {
+	return c.inner.BaseURL()
+}
+
+func (c *CachedStore) Store(
+	ctx context.Context,
+	r io.Reader,
+	path string,
+) error {
+	c.invalidate(path)
+	err := c.inner.Store(ctx, r, path)
+	// Reads that raced with the write may have cached the old contents.
+	c.invalidate(path)
+
+	return err
+}
+
+func (c *CachedStore) Delete(ctx context.Context, path string) error {
+	err := c.inner.Delete(ctx, path)
+	c.invalidate(path)
+
+	return err
+}
+
+func (c *CachedStore) Retrieve(
+	ctx context.Context,
+	path string,
+) (ObjectReader, error) {
+	if NoCache(ctx) {
+		return c.inner.Retrieve(ctx, path)
+	}
+
+	if r, ok := c.lookup(path, true); ok {
+		return r, nil
+	}
+
+	c.misses.Add(1)
+	_, err, shared := c.fills.Do(path, func() (any, error) {
+		// Other readers may be waiting on this fill, so it should not be cut
+		// short if the reader that started it goes away.
+		return nil, c.fill(context.WithoutCancel(ctx), path)
+	})
+	if shared {
+		c.coalesced.Add(1)
+	}
+	if err != nil && !errors.Is(err, errTooLargeToCache) {
+		return nil, err
+	}
+
+	if r, ok := c.lookup(path, false); ok {
+		return r, nil
+	}
+
+	// The object was too large for either tier, or was invalidated right
+	// after it was cached.
+	return c.inner.Retrieve(ctx, path)
+}
+
+func (c *CachedStore) Size(ctx context.Context, path string) (int64, error) {
+	c.mu.Lock()
+	e, ok := c.memory.get(path)
+	if !ok {
+		e, ok = c.disk.get(cacheFileName(path))
+	}
+	c.mu.Unlock()
+
+	if ok {
+		return e.size, nil
+	}
+
+	return c.inner.Size(ctx, path)
+}
+
+func (c *CachedStore) ModTime(
+	ctx context.Context,
+	path string,
+) (time.Time, error) {
+	return c.inner.ModTime(ctx, path)
+}
+
+func (c *CachedStore) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		MemoryHits:      c.memoryHits.Load(),
+		DiskHits:        c.diskHits.Load(),
+		Misses:          c.misses.Load(),
+		CoalescedMisses: c.coalesced.Load(),
+		Evictions:       c.evictions.Load(),
+		MemoryBytes:     c.memory.used,
+		MemoryObjects:   c.memory.order.Len(),
+		MemoryCapacity:  c.memory.capacity,
+		DiskBytes:       c.disk.used,
+		DiskObjects:     c.disk.order.Len(),
+		DiskCapacity:    c.disk.capacity,
+	}
+}
+
+// Returns a reader over the cached copy of the object, if there is one. Hits
+// are only counted if countHit is set.
+func (c *CachedStore) lookup(path string, countHit bool) (ObjectReader, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.memory.get(path); ok {
+		if countHit {
+			c.memoryHits.Add(1)
+		}
+		return nopCloser{bytes.NewReader(e.data)}, true
+	}
+
+	if e, ok := c.disk.get(cacheFileName(path)); ok {
+		// The file can be evicted as soon as the lock is released, but an
+		// open file stays readable after it is removed.
+		f, err := os.Open(e.file)
+		if err == nil {
+			if countHit {
+				c.diskHits.Add(1)
+			}
+			return f, true
+		}
+		// Another process sharing the directory removed it.
+		c.disk.remove(e.key)
+	}
+
+	return nil, false
+}
+
+// Copies the object from the backing store into the disk tier, and into the
+// memory tier as well if it is small enough. Returns errTooLargeToCache,
+// without reading the object, if it fits in neither tier.
+func (c *CachedStore) fill(ctx context.Context, path string) error {
+	c.mu.Lock()
+	pending, ok := c.pending[path]
+	if !ok {
+		pending = &pendingFill{}
+		c.pending[path] = pending
+	}
+	pending.fills++
+	gen := pending.generation
+	c.mu.Unlock()
+
+	defer func() {
+		c.mu.Lock()
+		if pending.fills--; pending.fills == 0 {
+			delete(c.pending, path)
+		}
+		c.mu.Unlock()
+	}()
+
+	r, err := c.inner.Retrieve(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	maxMem := c.memory.capacity / 16
+	total, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if total > c.disk.capacity && total > maxMem {
+		return errTooLargeToCache
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	name := cacheFileName(path)
+	file := filepath.Join(c.dir, name)
+
+	tf, err := CreateTempFile(file)
+	if err != nil {
+		return err
+	}
+	defer tf.Cleanup()
+
+	var mem bytes.Buffer
+	w := io.Writer(tf)
+	if maxMem > 0 {
+		w = io.MultiWriter(tf, &limitedBuffer{buf: &mem, limit: maxMem})
+	}
+
+	size, err := ContextCopy(ctx, w, r)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pending.generation != gen {
+		return nil
+	}
+
+	if size <= c.disk.capacity {
+		// Replacing an entry does not remove its file, which the new copy
+		// takes the place of.
+		if err := tf.Save(file); err != nil {
+			return err
+		}
+		evicted := c.disk.add(&cacheEntry{key: name, size: size, file: file})
+		c.evictions.Add(uint64(evicted))
+	}
+	if size <= maxMem {
+		evicted := c.memory.add(&cacheEntry{
+			key:  path,
+			size: size,
+			data: mem.Bytes(),
+		})
+		c.evictions.Add(uint64(evicted))
+	}
+
+	return nil
+}
+
+func (c *CachedStore) invalidate(path string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if pending, ok := c.pending[path]; ok {
+		pending.generation++
+	}
+	c.memory.remove(path)
+	c.disk.remove(cacheFileName(path))
+	// The file may have been cached by another process.
+	os.Remove(filepath.Join(c.dir, cacheFileName(path)))
+}
+
+// Bumped whenever its path is invalidated, so that fills that started before
+// the invalidation do not put stale data back into the cache.
+type pendingFill struct {
+	generation uint64
+	fills      int
+}
+
+type cacheEntry struct {
+	// The object's path in the memory tier, and its file name in the disk
+	// tier.
+	key  string
+	size int64
+	// Contents of the object, for the memory tier.
+	data []byte
+	// Location of the cached copy, for the disk tier.
+	file string
+}
+
+// A size-bounded set of cache entries with least-recently-used eviction. Not
+// safe for concurrent use.
+type lruTier struct {
+	capacity int64
+	used     int64
+	order    *list.List
+	entries  map[string]*list.Element
+	onEvict  func(*cacheEntry)
+}
+
+func newLRUTier(capacity int64, onEvict func(*cacheEntry)) *lruTier {
+	return &lruTier{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+		onEvict:  onEvict,
+	}
+}
+
+func (t *lruTier) get(key string) (*cacheEntry, bool) {
+	el, ok := t.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	t.order.MoveToFront(el)
+	return el.Value.(*cacheEntry), true
+}
+
+// Adds the entry and evicts the least recently used entries until the tier
+// is within its capacity again. An entry with the same key is replaced
+// without being evicted. Returns the number of evicted entries.
+func (t *lruTier) add(e *cacheEntry) int {
+	if el, ok := t.entries[e.key]; ok {
+		t.unlink(el)
+	}
+
+	t.entries[e.key] = t.order.PushFront(e)
+	t.used += e.size
+
+	evicted := 0
+	for t.used > t.capacity && t.order.Len() > 0 {
+		t.remove(t.order.Back().Value.(*cacheEntry).key)
+		evicted++
+	}
+
+	return evicted
+}
+
+func (t *lruTier) remove(key string) {
+	el, ok := t.entries[key]
+	if !ok {
+		return
+	}
+
+	e := t.unlink(el)
+	if t.onEvict != nil {
+		t.onEvict(e)
+	}
+}
+
+func (t *lruTier) unlink(el *list.Element) *cacheEntry {
+	e := el.Value.(*cacheEntry)
+	t.order.Remove(el)
+	delete(t.entries, e.key)
+	t.used -= e.size
+
+	return e
+}
+
+// Buffers writes up to a limit and silently drops everything past it, so
+// that objects too large for the memory tier are not held in memory.
+type limitedBuffer struct {
+	buf   *bytes.Buffer
+	limit int64
+}
+
+func (l *limitedBuffer) Write(p []byte) (int, error) {
+	if room := l.limit - int64(l.buf.Len()); room > 0 {
+		l.buf.Write(p[:min(int64(len(p)), room)])
+	}
+	return len(p), nil
+}
+
+type nopCloser struct {
+	*bytes.Reader
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,163 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/memstore"
+	"github.com/Fekinox/dogbox-main/internal/store/storetest"
+)
+
+func makeCached(t *testing.T, inner store.Store, dir string, diskSize, memSize int64) *store.CachedStore {
+	t.Helper()
+
+	c, err := store.MakeCachedStore(inner, dir, diskSize, memSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestCachedStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return makeCached(t, memstore.MakeMemStore(), t.TempDir(), 64<<20, 16<<20)
+	})
+}
+
+// Objects too large for the tiers are read from the backing store.
+func TestTinyCachedStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return makeCached(t, memstore.MakeMemStore(), t.TempDir(), 1024, 1024)
+	})
+}
+
+// Counts the objects read from the backing store. Reads can be held up at
+// their first Read until release is closed.
+type countingStore struct {
+	*memstore.MemStore
+	retrieves atomic.Int64
+
+	// Receives a value when a held read has started, unless one is already
+	// waiting.
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *countingStore) Retrieve(ctx context.Context, path string) (store.ObjectReader, error) {
+	s.retrieves.Add(1)
+
+	r, err := s.MemStore.Retrieve(ctx, path)
+	if err != nil || s.release == nil {
+		return r, err
+	}
+	return &heldReader{ObjectReader: r, s: s}, nil
+}
+
+type heldReader struct {
+	store.ObjectReader
+	s    *countingStore
+	once sync.Once
+}
+
+func (h *heldReader) Read(p []byte) (int, error) {
+	h.once.Do(func() {
+		select {
+		case h.s.started <- struct{}{}:
+		default:
+		}
+		<-h.s.release
+	})
+	return h.ObjectReader.Read(p)
+}
+
+func TestCacheInvalidationDuringFill(t *testing.T) {
+	ctx := context.Background()
+	inner := &countingStore{
+		MemStore: memstore.MakeMemStore(),
+		started:  make(chan struct{}, 1),
+		release:  make(chan struct{}),
+	}
+	c := makeCached(t, inner, t.TempDir(), 1<<20, 1<<20)
+
+	put(t, c, "a", []byte("old"))
+
+	done := make(chan []byte)
+	go func() {
+		r, err := c.Retrieve(ctx, "a")
+		if err != nil {
+			done <- nil
+			return
+		}
+		defer r.Close()
+		data, _ := io.ReadAll(r)
+		done <- data
+	}()
+
+	// The fill has read the old contents' size and is about to copy them.
+	<-inner.started
+	put(t, c, "a", []byte("new"))
+	close(inner.release)
+
+	// Whichever contents the racing read returns, the cache must not keep
+	// the old ones.
+	if got := <-done; got == nil {
+		t.Fatal("racing read failed")
+	}
+	expectContents(t, c, "a", []byte("new"))
+}
+
+func TestCacheSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	inner := &countingStore{MemStore: memstore.MakeMemStore()}
+	data := bytes.Repeat([]byte("cached "), 1000)
+
+	first := makeCached(t, inner, dir, 1<<20, 0)
+	put(t, first, "a", data)
+	expectContents(t, first, "a", data)
+	if n := inner.retrieves.Load(); n != 1 {
+		t.Fatalf("backing store read %d times, want 1", n)
+	}
+
+	second := makeCached(t, inner, dir, 1<<20, 0)
+	if stats := second.Stats(); stats.DiskObjects != 1 || stats.DiskBytes != int64(len(data)) {
+		t.Fatalf("restarted cache holds %d objects of %d bytes, want 1 of %d",
+			stats.DiskObjects, stats.DiskBytes, len(data))
+	}
+	if size, err := second.Size(ctx, "a"); err != nil || size != int64(len(data)) {
+		t.Fatalf("Size = %d, %v; want %d", size, err, len(data))
+	}
+	expectContents(t, second, "a", data)
+	if n := inner.retrieves.Load(); n != 1 {
+		t.Fatalf("backing store read %d times after restart, want 1", n)
+	}
+	if hits := second.Stats().DiskHits; hits != 1 {
+		t.Fatalf("%d disk hits, want 1", hits)
+	}
+
+	// A write in one process removes the file the other one cached.
+	put(t, second, "a", []byte("changed"))
+	expectContents(t, first, "a", []byte("changed"))
+}
+
+func TestCacheRestartKeepsCapacity(t *testing.T) {
+	dir := t.TempDir()
+	inner := memstore.MakeMemStore()
+
+	first := makeCached(t, inner, dir, 1<<20, 0)
+	for _, p := range []string{"a", "b", "c"} {
+		put(t, first, p, bytes.Repeat([]byte(p), 1000))
+		get(t, first, p)
+	}
+
+	second := makeCached(t, inner, dir, 2500, 0)
+	if stats := second.Stats(); stats.DiskObjects != 2 || stats.DiskBytes != 2000 {
+		t.Fatalf("restarted cache holds %d objects of %d bytes, want 2 of 2000",
+			stats.DiskObjects, stats.DiskBytes)
+	}
+}
@@ -0,0 +1,537 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+const COMPRESSION_CHUNK_SIZE = 256 * 1024
+
+const (
+	cmpMagic      = "DBXZ"
+	cmpHeaderSize = len(cmpMagic) + 1
+	cmpFooterSize = 8 + 4 + 4 + len(cmpMagic)
+	cmpModeRaw    = 0
+	cmpModeGzip   = 1
+	sniffSize     = 512
+)
+
+var (
+	ErrNotCompressed = errors.New("Object is not compressed")
+	errCorruptIndex  = errors.New("Compressed object has a corrupt index")
+)
+
+// Content types that are worth compressing, besides text/*.
+var compressibleTypes = map[string]bool{
+	"application/json":       true,
+	"application/javascript": true,
+	"application/xml":        true,
+	"application/x-ndjson":   true,
+	"application/x-sh":       true,
+	"application/x-yaml":     true,
+	"application/yaml":       true,
+	"application/toml":       true,
+	"application/sql":        true,
+	"image/svg+xml":          true,
+	"image/bmp":              true,
+	"application/postscript": true,
+	"application/rtf":        true,
+}
+
+// An EncodedRetriever can hand out an object's stored bytes in a standard
+// HTTP content encoding, so that they can be sent to clients that accept the
+// encoding without being decoded first. It is looked up with As, so it has to
+// sit above any wrapper that transforms objects, as compression does above
+// encryption.
+type EncodedRetriever interface {
+	// Returns a reader over the encoded object, its encoded size and the
+	// name of the encoding. Returns ErrNotCompressed if the object is not
+	// stored in an encoded form.
+	RetrieveEncoded(
+		ctx context.Context,
+		path string,
+	) (io.ReadCloser, int64, string, error)
+}
+
+// A CompressedStore gzips compressible objects before handing them to the
+// backing store. Whether an object is compressible is decided from its path's
+// extension and the content type sniffed from its first bytes; formats that
+// are already compressed are stored as they are, and so are writes marked
+// with WithNoTransform.
+//
+// Compressed objects are made of independently gzipped chunks followed by an
+// index of the chunks and the uncompressed size, so that Size stays exact and
+// readers can seek by decompressing only the chunk they land in. The chunks
+// together form a valid multi-member gzip stream, which RetrieveEncoded
+// returns as-is.
+//
+// Objects stored before compression was enabled are read unchanged.
+type CompressedStore struct {
+	inner Store
+}
+
+var _ Store = (*CompressedStore)(nil)
+var _ Lister = (*CompressedStore)(nil)
+var _ Rewrapper = (*CompressedStore)(nil)
+var _ EncodedRetriever = (*CompressedStore)(nil)
+
+func init() {
+	Register("compressed", func(spec *Spec) (Builder, error) {
+		if err := spec.ExpectStores(1, 1); err != nil {
+			return nil, err
+		}
+		if err := spec.Decode(&struct{}{}); err != nil {
+			return nil, err
+		}
+
+		return func(stores []Store) (Store, error) {
+			return MakeCompressedStore(stores[0]), nil
+		}, nil
+	})
+}
+
+func MakeCompressedStore(inner Store) *CompressedStore {
+	return &CompressedStore{inner: inner}
+}
+
+func (c *CompressedStore) Unwrap() Store {
+	return c.inner
+}
+
+func (c *CompressedStore) Rewrap(inner Store) Store {
+	return MakeCompressedStore(inner)
+}
+
+func (c *CompressedStore) BaseURL() string {
+	return c.inner.BaseURL()
+}
+
+func (c *CompressedStore) Store(
+	ctx context.Context,
+	r io.Reader,
+	p string,
+) error {
+	br := bufio.NewReaderSize(r, COMPRESSION_CHUNK_SIZE)
+
+	// Opaque writes are not even sniffed.
+	compress := false
+	if !NoTransform(ctx) {
+		head, err := br.Peek(sniffSize)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		compress = isCompressible(p, head)
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if compress {
+			pw.CloseWithError(writeCompressed(pw, br))
+		} else {
+			pw.CloseWithError(writeRaw(pw, br))
+		}
+	}()
+
+	err := c.inner.Store(ctx, pr, p)
+	// Make sure the compression goroutine is no longer reading from r before
+	// returning.
+	pr.CloseWithError(ErrWriteAborted)
+	<-done
+
+	return err
+}
+
+func (c *CompressedStore) Delete(ctx context.Context, p string) error {
+	return c.inner.Delete(ctx, p)
+}
+
+func (c *CompressedStore) Retrieve(
+	ctx context.Context,
+	p string,
+) (ObjectReader, error) {
+	r, err := c.inner.Retrieve(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	cr, err := openCompressed(r)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return cr, nil
+}
+
+func (c *CompressedStore) RetrieveEncoded(
+	ctx context.Context,
+	p string,
+) (io.ReadCloser, int64, string, error) {
+	r, err := c.inner.Retrieve(ctx, p)
+	if err != nil {
+		return nil, 0, "", err
+	}
+
+	cr, err := openCompressed(r)
+	if err != nil {
+		r.Close()
+		return nil, 0, "", err
+	}
+
+	gz, ok := cr.(*gzipReader)
+	if !ok {
+		cr.Close()
+		return nil, 0, "", ErrNotCompressed
+	}
+
+	if _, err := r.Seek(int64(cmpHeaderSize), io.SeekStart); err != nil {
+		r.Close()
+		return nil, 0, "", err
+	}
+
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.LimitReader(r, gz.encodedSize), r}, gz.encodedSize, "gzip", nil
+}
+
+// Returns the uncompressed size of the object, read from its index.
+func (c *CompressedStore) Size(ctx context.Context, p string) (int64, error) {
+	r, err := c.Retrieve(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	return r.Seek(0, io.SeekEnd)
+}
+
+func (c *CompressedStore) ModTime(
+	ctx context.Context,
+	p string,
+) (time.Time, error) {
+	return c.inner.ModTime(ctx, p)
+}
+
+// Lists the objects of the backing store. Since the uncompressed size of an
+// object is only known from its index, every listed object is opened to
+// report its size.
+func (c *CompressedStore) List(
+	ctx context.Context,
+	prefix, cursor string,
+	limit int,
+) ([]ObjectInfo, string, error) {
+	l, ok := c.inner.(Lister)
+	if !ok {
+		return nil, "", ErrListingUnsupported
+	}
+
+	objs, next, err := l.List(ctx, prefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	for i := range objs {
+		size, err := c.Size(ctx, objs[i].Path)
+		if err != nil {
+			return nil, "", err
+		}
+		objs[i].Size = size
+		// The stored bytes no longer match any hash the backend knows.
+		objs[i].Hash = ""
+	}
+
+	return objs, next, nil
+}
+
+// Decides whether an object is worth compressing from its extension and the
+// content type sniffed from its first bytes.
+func isCompressible(p string, head []byte) bool {
+	types := []string{http.DetectContentType(head)}
+	if byExt := mime.TypeByExtension(path.Ext(p)); byExt != "" {
+		types = append(types, byExt)
+	}
+
+	for _, t := range types {
+		t, _, _ = strings.Cut(t, ";")
+		t = strings.TrimSpace(strings.ToLower(t))
+		if strings.HasPrefix(t, "text/") || compressibleTypes[t] ||
+			strings.HasSuffix(t, "+json") || strings.HasSuffix(t, "+xml") {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeRaw(w io.Writer, r io.Reader) error {
+	if _, err := w.Write([]byte{'D', 'B', 'X', 'Z', cmpModeRaw}); err != nil {
+		return err
+	}
+
+	_, err := io.Copy(w, r)
+	return err
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Writes the header, the gzipped chunks of r, the chunk index and the footer.
+func writeCompressed(w io.Writer, r io.Reader) error {
+	if _, err := w.Write([]byte{'D', 'B', 'X', 'Z', cmpModeGzip}); err != nil {
+		return err
+	}
+
+	cw := &countingWriter{w: w}
+	gz := gzip.NewWriter(cw)
+	var index []uint32
+	var total int64
+
+	for {
+		start := cw.n
+		gz.Reset(cw)
+		n, err := io.Copy(gz, io.LimitReader(r, COMPRESSION_CHUNK_SIZE))
+		if err != nil {
+			return err
+		}
+		// An empty object still gets one (empty) member, so that the encoded
+		// form is a valid gzip stream.
+		if n == 0 && len(index) > 0 {
+			break
+		}
+		if err := gz.Close(); err != nil {
+			return err
+		}
+
+		index = append(index, uint32(cw.n-start))
+		total += n
+		if n < COMPRESSION_CHUNK_SIZE {
+			break
+		}
+	}
+
+	trailer := make([]byte, 4*len(index)+cmpFooterSize)
+	for i, length := range index {
+		binary.BigEndian.PutUint32(trailer[4*i:], length)
+	}
+	footer := trailer[4*len(index):]
+	binary.BigEndian.PutUint64(footer, uint64(total))
+	binary.BigEndian.PutUint32(footer[8:], COMPRESSION_CHUNK_SIZE)
+	binary.BigEndian.PutUint32(footer[12:], uint32(len(index)))
+	copy(footer[16:], cmpMagic)
+
+	_, err := w.Write(trailer)
+	return err
+}
+
+// Opens a stored object, returning a reader over its uncompressed contents.
+func openCompressed(r ObjectReader) (ObjectReader, error) {
+	header := make([]byte, cmpHeaderSize)
+	_, err := io.ReadFull(r, header)
+	if err != nil && !errors.Is(err, io.EOF) &&
+		!errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil, err
+	}
+
+	switch {
+	case err != nil || !bytes.HasPrefix(header, []byte(cmpMagic)):
+		// Stored before compression was enabled.
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return r, nil
+	case header[len(cmpMagic)] == cmpModeRaw:
+		return newOffsetReader(r, int64(cmpHeaderSize))
+	case header[len(cmpMagic)] == cmpModeGzip:
+		return newGzipReader(r)
+	default:
+		return nil, errCorruptIndex
+	}
+}
+
+// Reads an object stored after a fixed-size header.
+type offsetReader struct {
+	ObjectReader
+	offset int64
+}
+
+func newOffsetReader(r ObjectReader, offset int64) (*offsetReader, error) {
+	if _, err := r.Seek(offset, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &offsetReader{ObjectReader: r, offset: offset}, nil
+}
+
+func (o *offsetReader) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += o.offset
+	}
+
+	pos, err := o.ObjectReader.Seek(offset, whence)
+	if err != nil {
+		return 0, err
+	}
+	if pos < o.offset {
+		o.ObjectReader.Seek(o.offset, io.SeekStart)
+		return 0, errors.New("Seek: negative position")
+	}
+
+	return pos - o.offset, nil
+}
+
+// A seekable reader over a chunked gzip object that decompresses one chunk at
+// a time.
+type gzipReader struct {
+	r           ObjectReader
+	offsets     []int64
+	chunkSize   int64
+	size        int64
+	encodedSize int64
+	pos         int64
+
+	chunk int64
+	buf   []byte
+}
+
+func newGzipReader(r ObjectReader) (*gzipReader, error) {
+	end, err := r.Seek(-int64(cmpFooterSize), io.SeekEnd)
+	if err != nil {
+		return nil, errCorruptIndex
+	}
+
+	footer := make([]byte, cmpFooterSize)
+	if _, err := io.ReadFull(r, footer); err != nil {
+		return nil, err
+	}
+	if string(footer[16:]) != cmpMagic {
+		return nil, errCorruptIndex
+	}
+
+	size := int64(binary.BigEndian.Uint64(footer))
+	chunkSize := int64(binary.BigEndian.Uint32(footer[8:]))
+	count := int64(binary.BigEndian.Uint32(footer[12:]))
+
+	indexStart := end - 4*count
+	if chunkSize == 0 || count == 0 || indexStart < int64(cmpHeaderSize) {
+		return nil, errCorruptIndex
+	}
+	if _, err := r.Seek(indexStart, io.SeekStart); err != nil {
+		return nil, err
+	}
+	index := make([]byte, 4*count)
+	if _, err := io.ReadFull(r, index); err != nil {
+		return nil, err
+	}
+
+	offsets := make([]int64, count+1)
+	offsets[0] = int64(cmpHeaderSize)
+	for i := int64(0); i < count; i++ {
+		offsets[i+1] = offsets[i] + int64(binary.BigEndian.Uint32(index[4*i:]))
+	}
+	if offsets[count] != indexStart {
+		return nil, errCorruptIndex
+	}
+
+	return &gzipReader{
+		r:           r,
+		offsets:     offsets,
+		chunkSize:   chunkSize,
+		size:        size,
+		encodedSize: indexStart - int64(cmpHeaderSize),
+		chunk:       -1,
+	}, nil
+}
+
+func (g *gzipReader) load(index int64) error {
+	if g.chunk == index {
+		return nil
+	}
+	if index+1 >= int64(len(g.offsets)) {
+		return errCorruptIndex
+	}
+
+	start, end := g.offsets[index], g.offsets[index+1]
+	if _, err := g.r.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	zr, err := gzip.NewReader(io.LimitReader(g.r, end-start))
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	buf := bytes.NewBuffer(g.buf[:0])
+	if _, err := io.Copy(buf, zr); err != nil {
+		return err
+	}
+
+	g.buf = buf.Bytes()
+	g.chunk = index
+	return nil
+}
+
+func (g *gzipReader) Read(p []byte) (int, error) {
+	if g.pos >= g.size {
+		return 0, io.EOF
+	}
+
+	index := g.pos / g.chunkSize
+	if err := g.load(index); err != nil {
+		return 0, err
+	}
+
+	offset := g.pos - index*g.chunkSize
+	if offset >= int64(len(g.buf)) {
+		return 0, errCorruptIndex
+	}
+
+	n := copy(p, g.buf[offset:])
+	g.pos += int64(n)
+	return n, nil
+}
+
+func (g *gzipReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = g.pos + offset
+	case io.SeekEnd:
+		pos = g.size + offset
+	default:
+		return 0, errors.New("Seek: invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("Seek: negative position")
+	}
+
+	g.pos = pos
+	return pos, nil
+}
+
+func (g *gzipReader) Close() error {
+	return g.r.Close()
+}
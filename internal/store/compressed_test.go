@@ -0,0 +1,150 @@
+package store_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/memstore"
+	"github.com/Fekinox/dogbox-main/internal/store/storetest"
+)
+
+func TestCompressedStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return store.MakeCompressedStore(memstore.MakeMemStore())
+	})
+}
+
+// Text spanning several compression chunks.
+var compressibleText = []byte(strings.Repeat(
+	"the quick brown fox jumps over the lazy dog\n",
+	3*store.COMPRESSION_CHUNK_SIZE/44,
+))
+
+func TestCompressedFormats(t *testing.T) {
+	ctx := context.Background()
+	inner := memstore.MakeMemStore()
+	c := store.MakeCompressedStore(inner)
+
+	binary := make([]byte, 1000)
+	for i := range binary {
+		binary[i] = byte(i * 7919)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		data []byte
+		// Whether the object is written straight to the backing store, as
+		// it was before compression was enabled.
+		legacy bool
+		// Prefix of the stored object.
+		header string
+	}{
+		{"Compressed", "a.txt", compressibleText, false, "DBXZ\x01"},
+		{"Raw", "a.bin", binary, false, "DBXZ\x00"},
+		{"RawWithMagic", "b.bin", []byte("DBXZ\x01 looks compressed"), false, "DBXZ\x00"},
+		{"EmptyText", "empty.txt", []byte{}, false, "DBXZ\x01"},
+		{"Legacy", "legacy.txt", compressibleText, true, "the quick"},
+		{"LegacyShort", "short", []byte("DBX"), true, "DBX"},
+		{"LegacyEmpty", "none", []byte{}, true, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.legacy {
+				put(t, inner, tt.path, tt.data)
+			} else {
+				put(t, c, tt.path, tt.data)
+			}
+
+			stored := get(t, inner, tt.path)
+			if !bytes.HasPrefix(stored, []byte(tt.header)) {
+				t.Fatalf("stored object starts with %q, want %q", stored[:min(5, len(stored))], tt.header)
+			}
+			if tt.header == "DBXZ\x01" && len(tt.data) > 0 && len(stored) >= len(tt.data) {
+				t.Fatalf("compressed %d bytes to %d", len(tt.data), len(stored))
+			}
+
+			expectContents(t, c, tt.path, tt.data)
+
+			size, err := c.Size(ctx, tt.path)
+			if err != nil || size != int64(len(tt.data)) {
+				t.Fatalf("Size = %d, %v; want %d", size, err, len(tt.data))
+			}
+
+			r, n, encoding, err := c.RetrieveEncoded(ctx, tt.path)
+			if tt.header != "DBXZ\x01" {
+				if !errors.Is(err, store.ErrNotCompressed) {
+					t.Fatalf("RetrieveEncoded: got %v, want %v", err, store.ErrNotCompressed)
+				}
+				return
+			}
+			if err != nil || encoding != "gzip" {
+				t.Fatalf("RetrieveEncoded = %q, %v", encoding, err)
+			}
+			defer r.Close()
+
+			encoded, err := io.ReadAll(r)
+			if err != nil || int64(len(encoded)) != n {
+				t.Fatalf("read %d encoded bytes, %v; want %d", len(encoded), err, n)
+			}
+			gz, err := gzip.NewReader(bytes.NewReader(encoded))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := io.ReadAll(gz)
+			if err != nil || !bytes.Equal(decoded, tt.data) {
+				t.Fatalf("decoded %d bytes, %v; want %d", len(decoded), err, len(tt.data))
+			}
+		})
+	}
+}
+
+func TestCompressedSeek(t *testing.T) {
+	c := store.MakeCompressedStore(memstore.MakeMemStore())
+	put(t, c, "a.txt", compressibleText)
+
+	r, err := c.Retrieve(context.Background(), "a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	for _, off := range []int64{
+		int64(len(compressibleText)) - 1,
+		store.COMPRESSION_CHUNK_SIZE + 3,
+		0,
+		2*store.COMPRESSION_CHUNK_SIZE - 1,
+	} {
+		if _, err := r.Seek(off, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 1)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			t.Fatalf("reading at %d: %v", off, err)
+		}
+		if buf[0] != compressibleText[off] {
+			t.Fatalf("byte at %d = %q, want %q", off, buf[0], compressibleText[off])
+		}
+	}
+}
+
+func TestCompressedCorruption(t *testing.T) {
+	inner := memstore.MakeMemStore()
+	c := store.MakeCompressedStore(inner)
+	put(t, c, "a.txt", compressibleText)
+
+	stored := get(t, inner, "a.txt")
+	stored[len("DBXZ\x01")+100] ^= 0xff
+	put(t, inner, "a.txt", stored)
+
+	if _, err := read(c, "a.txt"); err == nil {
+		t.Fatal("reading a corrupted object succeeded")
+	}
+}
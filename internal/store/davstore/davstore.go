@@ -0,0 +1,653 @@
+// Package davstore implements a store.Store on top of a WebDAV server.
+package davstore
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUnexpectedStatus = errors.New("Unexpected WebDAV response")
+	ErrObjectChanged    = errors.New("Object changed while it was being read")
+)
+
+// The properties requested by every PROPFIND.
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<D:propfind xmlns:D="DAV:"><D:prop>
+<D:resourcetype/><D:getcontentlength/><D:getlastmodified/><D:getetag/>
+</D:prop></D:propfind>`
+
+// A DavStore keeps objects as files in a collection on a WebDAV server.
+//
+// Writes are uploaded to a temporary name next to their destination and then
+// moved into place, so that readers never see a partially written object.
+// Reads fetch the object in ranges, starting a new ranged GET whenever the
+// reader seeks, and refuse to continue if the object is replaced in the
+// meantime.
+type DavStore struct {
+	client   *http.Client
+	base     *url.URL
+	url      string
+	username string
+	password string
+
+	// Collections that are known to exist, so that writes do not have to
+	// create them again.
+	collections sync.Map
+}
+
+var _ store.Store = (*DavStore)(nil)
+var _ store.Lister = (*DavStore)(nil)
+
+type DavOption func(*DavStore)
+
+func WithBasicAuth(username, password string) DavOption {
+	return func(d *DavStore) {
+		d.username = username
+		d.password = password
+	}
+}
+
+func WithHTTPClient(client *http.Client) DavOption {
+	return func(d *DavStore) {
+		d.client = client
+	}
+}
+
+// Options of the "webdav" store type.
+type davOptions struct {
+	URL      string        `mapstructure:"url"`
+	Username string        `mapstructure:"username"`
+	Password string        `mapstructure:"password"`
+	Timeout  time.Duration `mapstructure:"timeout"`
+}
+
+func init() {
+	store.Register("webdav", func(spec *store.Spec) (store.Builder, error) {
+		if err := spec.ExpectStores(0, 0); err != nil {
+			return nil, err
+		}
+
+		var opts davOptions
+		if err := spec.Decode(&opts); err != nil {
+			return nil, err
+		}
+		if _, err := parseEndpoint(opts.URL); err != nil {
+			return nil, fmt.Errorf("%w: %v", store.ErrInvalidSpec, err)
+		}
+
+		davOpts := []DavOption{
+			WithHTTPClient(&http.Client{Timeout: opts.Timeout}),
+		}
+		if opts.Username != "" {
+			davOpts = append(davOpts, WithBasicAuth(opts.Username, opts.Password))
+		}
+
+		return func([]store.Store) (store.Store, error) {
+			return MakeDavStore(opts.URL, davOpts...)
+		}, nil
+	})
+}
+
+// Returns a store that keeps objects in the collection at the given URL.
+func MakeDavStore(endpoint string, opts ...DavOption) (*DavStore, error) {
+	base, err := parseEndpoint(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &DavStore{
+		client: http.DefaultClient,
+		base:   base,
+	}
+	for _, opt := range opts {
+		opt(d)
+	}
+
+	return d, nil
+}
+
+func parseEndpoint(endpoint string) (*url.URL, error) {
+	base, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	if base.Scheme != "http" && base.Scheme != "https" {
+		return nil, fmt.Errorf("WebDAV url must be http or https: %q", endpoint)
+	}
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+
+	return base, nil
+}
+
+func (d *DavStore) BaseURL() string {
+	return d.url
+}
+
+func (d *DavStore) Store(ctx context.Context, r io.Reader, p string) error {
+	if err := d.makeCollections(ctx, path.Dir(p)); err != nil {
+		return err
+	}
+
+	tmp := tempPath(p)
+	res, err := d.do(ctx, http.MethodPut, tmp, contextReader{ctx, r}, nil)
+	if err != nil {
+		d.cleanup(ctx, tmp)
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated &&
+		res.StatusCode != http.StatusNoContent &&
+		res.StatusCode != http.StatusOK {
+		d.cleanup(ctx, tmp)
+		return statusError("store", p, res)
+	}
+
+	res, err = d.do(ctx, "MOVE", tmp, nil, map[string]string{
+		"Destination": d.objectURL(p).String(),
+		"Overwrite":   "T",
+	})
+	if err != nil {
+		d.cleanup(ctx, tmp)
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated &&
+		res.StatusCode != http.StatusNoContent {
+		d.cleanup(ctx, tmp)
+		return statusError("store", p, res)
+	}
+
+	return nil
+}
+
+// Removes an abandoned upload. This has to happen even if the context that
+// abandoned it is already canceled.
+func (d *DavStore) cleanup(ctx context.Context, tmp string) {
+	res, err := d.do(
+		context.WithoutCancel(ctx),
+		http.MethodDelete,
+		tmp,
+		nil,
+		nil,
+	)
+	if err == nil {
+		res.Body.Close()
+	}
+}
+
+// Creates the collection for the given directory and all of its parents, up
+// to and including the store's own collection.
+func (d *DavStore) makeCollections(ctx context.Context, dir string) error {
+	if dir == "." || dir == "/" {
+		dir = ""
+	}
+	if _, ok := d.collections.Load(dir); ok {
+		return nil
+	}
+
+	if dir != "" {
+		if err := d.makeCollections(ctx, path.Dir(dir)); err != nil {
+			return err
+		}
+	}
+
+	res, err := d.do(ctx, "MKCOL", dir+"/", nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	// 405 Method Not Allowed means that the collection already exists.
+	if res.StatusCode != http.StatusCreated &&
+		res.StatusCode != http.StatusMethodNotAllowed {
+		return statusError("mkcol", dir, res)
+	}
+	d.collections.Store(dir, struct{}{})
+
+	return nil
+}
+
+func (d *DavStore) Delete(ctx context.Context, p string) error {
+	res, err := d.do(ctx, http.MethodDelete, p, nil, nil)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return notExist("remove", p)
+	default:
+		return statusError("remove", p, res)
+	}
+}
+
+func (d *DavStore) Retrieve(
+	ctx context.Context,
+	p string,
+) (store.ObjectReader, error) {
+	info, err := d.stat(ctx, p)
+	if err != nil {
+		return nil, err
+	}
+
+	return &davReader{
+		ctx:  ctx,
+		d:    d,
+		path: p,
+		size: info.size,
+		etag: info.etag,
+	}, nil
+}
+
+func (d *DavStore) Size(ctx context.Context, p string) (int64, error) {
+	info, err := d.stat(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.size, nil
+}
+
+func (d *DavStore) ModTime(ctx context.Context, p string) (time.Time, error) {
+	info, err := d.stat(ctx, p)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.modTime, nil
+}
+
+// Lists the objects in the store's collection, one collection at a time.
+// Collections that sort entirely before the cursor or cannot contain the
+// prefix are not requested.
+func (d *DavStore) List(
+	ctx context.Context,
+	prefix, cursor string,
+	limit int,
+) ([]store.ObjectInfo, string, error) {
+	if limit <= 0 {
+		limit = store.DEFAULT_LIST_PAGE_SIZE
+	}
+
+	var objs []store.ObjectInfo
+	var walk func(dir string) error
+	walk = func(dir string) error {
+		entries, err := d.propfind(ctx, dir, "1")
+		if errors.Is(err, fs.ErrNotExist) && dir == "" {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		slices.SortFunc(entries, func(a, b davEntry) int {
+			return store.ComparePaths(a.path, b.path)
+		})
+
+		for _, e := range entries {
+			// The collection itself is part of the response.
+			if e.path == strings.TrimSuffix(dir, "/") {
+				continue
+			}
+
+			if e.collection {
+				if !strings.HasPrefix(e.path+"/", prefix) &&
+					!strings.HasPrefix(prefix, e.path+"/") {
+					continue
+				}
+				if cursor != "" && store.ComparePaths(e.path, cursor) < 0 &&
+					!strings.HasPrefix(cursor, e.path+"/") {
+					continue
+				}
+				if err := walk(e.path + "/"); err != nil {
+					return err
+				}
+			} else {
+				if !strings.HasPrefix(e.path, prefix) || isTempPath(e.path) {
+					continue
+				}
+				if cursor != "" && store.ComparePaths(e.path, cursor) <= 0 {
+					continue
+				}
+				objs = append(objs, store.ObjectInfo{
+					Path:    e.path,
+					Size:    e.size,
+					ModTime: e.modTime,
+				})
+			}
+
+			if len(objs) == limit {
+				return errLimitReached
+			}
+		}
+
+		return nil
+	}
+
+	err := walk("")
+	if err != nil && !errors.Is(err, errLimitReached) {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(objs) == limit {
+		next = objs[len(objs)-1].Path
+	}
+
+	return objs, next, nil
+}
+
+var errLimitReached = errors.New("limit reached")
+
+// A file or collection as reported by PROPFIND.
+type davEntry struct {
+	path       string
+	collection bool
+	size       int64
+	modTime    time.Time
+	etag       string
+}
+
+func (d *DavStore) stat(ctx context.Context, p string) (davEntry, error) {
+	entries, err := d.propfind(ctx, p, "0")
+	if err != nil {
+		return davEntry{}, err
+	}
+	if len(entries) != 1 || entries[0].collection {
+		return davEntry{}, notExist("stat", p)
+	}
+
+	return entries[0], nil
+}
+
+type multistatus struct {
+	Responses []struct {
+		Href      string `xml:"DAV: href"`
+		Propstats []struct {
+			Prop struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"DAV: collection"`
+				} `xml:"DAV: resourcetype"`
+				ContentLength string `xml:"DAV: getcontentlength"`
+				LastModified  string `xml:"DAV: getlastmodified"`
+				ETag          string `xml:"DAV: getetag"`
+			} `xml:"DAV: prop"`
+			Status string `xml:"DAV: status"`
+		} `xml:"DAV: propstat"`
+	} `xml:"DAV: response"`
+}
+
+// Requests the properties of the resource at p and, with depth "1", of its
+// members.
+func (d *DavStore) propfind(
+	ctx context.Context,
+	p string,
+	depth string,
+) ([]davEntry, error) {
+	res, err := d.do(
+		ctx,
+		"PROPFIND",
+		p,
+		strings.NewReader(propfindBody),
+		map[string]string{
+			"Depth":        depth,
+			"Content-Type": "application/xml; charset=utf-8",
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusMultiStatus:
+	case http.StatusNotFound:
+		return nil, notExist("stat", p)
+	default:
+		return nil, statusError("stat", p, res)
+	}
+
+	var ms multistatus
+	if err := xml.NewDecoder(res.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+
+	entries := make([]davEntry, 0, len(ms.Responses))
+	for _, r := range ms.Responses {
+		href, err := url.Parse(r.Href)
+		if err != nil {
+			return nil, err
+		}
+		rel, ok := strings.CutPrefix(href.Path, d.base.Path)
+		if !ok && href.Path+"/" != d.base.Path {
+			return nil, fmt.Errorf(
+				"%w: %s is outside of %s",
+				ErrUnexpectedStatus,
+				href.Path,
+				d.base.Path,
+			)
+		}
+
+		e := davEntry{path: strings.TrimSuffix(rel, "/")}
+		for _, ps := range r.Propstats {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+
+			prop := ps.Prop
+			if prop.ResourceType.Collection != nil {
+				e.collection = true
+			}
+			if prop.ContentLength != "" {
+				e.size, err = strconv.ParseInt(prop.ContentLength, 10, 64)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if prop.LastModified != "" {
+				e.modTime, err = http.ParseTime(prop.LastModified)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if prop.ETag != "" {
+				e.etag = prop.ETag
+			}
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries, nil
+}
+
+func (d *DavStore) objectURL(p string) *url.URL {
+	return d.base.JoinPath(p)
+}
+
+func (d *DavStore) do(
+	ctx context.Context,
+	method, p string,
+	body io.Reader,
+	headers map[string]string,
+) (*http.Response, error) {
+	u := d.objectURL(p)
+	// JoinPath drops the trailing slash that marks a collection.
+	if strings.HasSuffix(p, "/") && !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	if d.username != "" {
+		req.SetBasicAuth(d.username, d.password)
+	}
+
+	return d.client.Do(req)
+}
+
+// Reads an object with ranged GET requests. A request is only made when data
+// is read, and is reused for as long as the reader does not seek.
+type davReader struct {
+	ctx    context.Context
+	d      *DavStore
+	path   string
+	size   int64
+	etag   string
+	offset int64
+	body   io.ReadCloser
+}
+
+func (r *davReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+
+	if r.body == nil {
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if errors.Is(err, io.EOF) && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return n, err
+}
+
+func (r *davReader) open() error {
+	headers := map[string]string{
+		"Range": fmt.Sprintf("bytes=%d-", r.offset),
+	}
+	if r.etag != "" {
+		headers["If-Match"] = r.etag
+	}
+
+	res, err := r.d.do(r.ctx, http.MethodGet, r.path, nil, headers)
+	if err != nil {
+		return err
+	}
+
+	switch res.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		// The server ignored the range.
+		if _, err := io.CopyN(io.Discard, res.Body, r.offset); err != nil {
+			res.Body.Close()
+			return err
+		}
+	case http.StatusPreconditionFailed:
+		res.Body.Close()
+		return &fs.PathError{Op: "read", Path: r.path, Err: ErrObjectChanged}
+	case http.StatusNotFound:
+		res.Body.Close()
+		return notExist("read", r.path)
+	default:
+		res.Body.Close()
+		return statusError("read", r.path, res)
+	}
+
+	r.body = res.Body
+	return nil
+}
+
+func (r *davReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.offset + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("davstore: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("davstore: negative position")
+	}
+
+	if abs != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = abs
+
+	return abs, nil
+}
+
+func (r *davReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// Stops an upload once its context is canceled, so that the request fails
+// instead of completing with the data read so far.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// Returns the name an object is uploaded to before being moved into place.
+func tempPath(p string) string {
+	return p + "-" + uuid.NewString() + ".tmp"
+}
+
+func isTempPath(p string) bool {
+	base, ok := strings.CutSuffix(path.Base(p), ".tmp")
+	if !ok || len(base) < 37 || base[len(base)-37] != '-' {
+		return false
+	}
+
+	_, err := uuid.Parse(base[len(base)-36:])
+	return err == nil
+}
+
+func notExist(op, p string) error {
+	return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+}
+
+func statusError(op, p string, res *http.Response) error {
+	return fmt.Errorf("%w: %s %s: %s", ErrUnexpectedStatus, op, p, res.Status)
+}
@@ -0,0 +1,27 @@
+package davstore_test
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/davstore"
+	"github.com/Fekinox/dogbox-main/internal/store/storetest"
+	"golang.org/x/net/webdav"
+)
+
+func TestDavStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		srv := httptest.NewServer(&webdav.Handler{
+			FileSystem: webdav.NewMemFS(),
+			LockSystem: webdav.NewMemLS(),
+		})
+		t.Cleanup(srv.Close)
+
+		d, err := davstore.MakeDavStore(srv.URL + "/dogbox")
+		if err != nil {
+			t.Fatalf("MakeDavStore: %v", err)
+		}
+		return d
+	})
+}
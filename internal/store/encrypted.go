@@ -0,0 +1,583 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const ENCRYPTION_CHUNK_SIZE = 64 * 1024
+const ENCRYPTION_KEY_SIZE = 32
+const MAX_KEY_ID_LENGTH = 32
+
+const (
+	encMagic       = "DBXE"
+	encVersion     = 1
+	encSaltSize    = 32
+	encTagSize     = 16
+	encHeaderSize  = len(encMagic) + 1 + 1 + MAX_KEY_ID_LENGTH + 4 + encSaltSize
+	encKeyIDOffset = len(encMagic) + 2
+)
+
+var (
+	ErrUnknownKey      = errors.New("Object is encrypted with an unknown key")
+	ErrCorruptObject   = errors.New("Encrypted object is corrupt")
+	ErrInvalidKeyring  = errors.New("Invalid encryption keyring")
+	errNotEncryptedObj = errors.New("Object is not encrypted")
+)
+
+// An EncryptedStore encrypts objects with AES-256-GCM before handing them to
+// the backing store, so that the stored bytes are unreadable without the
+// server's keys.
+//
+// Objects are split into chunks that are sealed independently, which lets
+// readers seek to any offset and only decrypt the chunks they touch. Each
+// object has its own random salt from which a per-object key is derived, and
+// the header names the key it was written with, so that keys can be rotated:
+// new objects always use the current key, while objects written under older
+// keys stay readable until they are rewritten with Rekey.
+//
+// Objects that were stored before encryption was enabled are passed through
+// unchanged when read, and are encrypted by Rekey.
+type EncryptedStore struct {
+	inner   Store
+	keys    map[string][]byte
+	current string
+}
+
+var _ Store = (*EncryptedStore)(nil)
+var _ Lister = (*EncryptedStore)(nil)
+var _ Rewrapper = (*EncryptedStore)(nil)
+
+// Options of the "encrypted" store type.
+type encryptionOptions struct {
+	// A keyring in the format read by ParseKeyring.
+	Keys  string `mapstructure:"keys"`
+	KeyID string `mapstructure:"key_id"`
+}
+
+func init() {
+	Register("encrypted", func(spec *Spec) (Builder, error) {
+		if err := spec.ExpectStores(1, 1); err != nil {
+			return nil, err
+		}
+
+		var opts encryptionOptions
+		if err := spec.Decode(&opts); err != nil {
+			return nil, err
+		}
+		keys, err := ParseKeyring(opts.Keys)
+		if err != nil {
+			return nil, err
+		}
+		if err := validateKeyring(keys, opts.KeyID); err != nil {
+			return nil, err
+		}
+
+		return func(stores []Store) (Store, error) {
+			return MakeEncryptedStore(stores[0], keys, opts.KeyID)
+		}, nil
+	})
+}
+
+// Parses a comma-separated list of id:key pairs, where each key is encoded
+// in standard base64.
+func ParseKeyring(s string) (map[string][]byte, error) {
+	keys := make(map[string][]byte)
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf(
+				"%w: keys must be id:base64-key pairs",
+				ErrInvalidKeyring,
+			)
+		}
+
+		// The decoding error is left out, since it can contain parts of
+		// the key.
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf(
+				"%w: key %q is not valid base64",
+				ErrInvalidKeyring,
+				id,
+			)
+		}
+		keys[id] = key
+	}
+
+	return keys, nil
+}
+
+func validateKeyring(keys map[string][]byte, current string) error {
+	for id, key := range keys {
+		if len(id) == 0 || len(id) > MAX_KEY_ID_LENGTH {
+			return fmt.Errorf("%w: key id %q", ErrInvalidKeyring, id)
+		}
+		if len(key) != ENCRYPTION_KEY_SIZE {
+			return fmt.Errorf(
+				"%w: key %q must be %d bytes",
+				ErrInvalidKeyring,
+				id,
+				ENCRYPTION_KEY_SIZE,
+			)
+		}
+	}
+	if _, ok := keys[current]; !ok {
+		return fmt.Errorf(
+			"%w: current key %q not found",
+			ErrInvalidKeyring,
+			current,
+		)
+	}
+
+	return nil
+}
+
+// Returns a store that encrypts objects in the backing store. keys maps key
+// IDs to 32-byte keys, and current names the key used for new writes.
+func MakeEncryptedStore(
+	inner Store,
+	keys map[string][]byte,
+	current string,
+) (*EncryptedStore, error) {
+	if err := validateKeyring(keys, current); err != nil {
+		return nil, err
+	}
+
+	return &EncryptedStore{
+		inner:   inner,
+		keys:    keys,
+		current: current,
+	}, nil
+}
+
+func (e *EncryptedStore) Unwrap() Store {
+	return e.inner
+}
+
+func (e *EncryptedStore) Rewrap(inner Store) Store {
+	return &EncryptedStore{
+		inner:   inner,
+		keys:    e.keys,
+		current: e.current,
+	}
+}
+
+func (e *EncryptedStore) BaseURL() string {
+	return e.inner.BaseURL()
+}
+
+func (e *EncryptedStore) Store(
+	ctx context.Context,
+	r io.Reader,
+	path string,
+) error {
+	header := make([]byte, encHeaderSize)
+	copy(header, encMagic)
+	header[len(encMagic)] = encVersion
+	header[len(encMagic)+1] = byte(len(e.current))
+	copy(header[encKeyIDOffset:], e.current)
+	binary.BigEndian.PutUint32(
+		header[encKeyIDOffset+MAX_KEY_ID_LENGTH:],
+		ENCRYPTION_CHUNK_SIZE,
+	)
+	if _, err := rand.Read(header[encHeaderSize-encSaltSize:]); err != nil {
+		return err
+	}
+
+	aead, err := e.objectCipher(header)
+	if err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pw.CloseWithError(sealChunks(pw, r, aead, header))
+	}()
+
+	err = e.inner.Store(ctx, pr, path)
+	// Make sure the encryption goroutine is no longer reading from r before
+	// returning.
+	pr.CloseWithError(ErrWriteAborted)
+	<-done
+
+	return err
+}
+
+func (e *EncryptedStore) Delete(ctx context.Context, path string) error {
+	return e.inner.Delete(ctx, path)
+}
+
+func (e *EncryptedStore) Retrieve(
+	ctx context.Context,
+	path string,
+) (ObjectReader, error) {
+	r, err := e.inner.Retrieve(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+
+	er, err := e.openReader(r)
+	if errors.Is(err, errNotEncryptedObj) {
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			r.Close()
+			return nil, err
+		}
+		return r, nil
+	}
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	return er, nil
+}
+
+func (e *EncryptedStore) Size(ctx context.Context, path string) (int64, error) {
+	r, err := e.Retrieve(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	return r.Seek(0, io.SeekEnd)
+}
+
+func (e *EncryptedStore) ModTime(
+	ctx context.Context,
+	path string,
+) (time.Time, error) {
+	return e.inner.ModTime(ctx, path)
+}
+
+// Lists the objects of the backing store. Sizes are converted to plaintext
+// sizes without reading the objects, so they are only exact for objects that
+// are encrypted.
+func (e *EncryptedStore) List(
+	ctx context.Context,
+	prefix, cursor string,
+	limit int,
+) ([]ObjectInfo, string, error) {
+	l, ok := e.inner.(Lister)
+	if !ok {
+		return nil, "", ErrListingUnsupported
+	}
+
+	objs, next, err := l.List(ctx, prefix, cursor, limit)
+	for i := range objs {
+		if size, ok := plaintextSize(objs[i].Size, ENCRYPTION_CHUNK_SIZE); ok {
+			objs[i].Size = size
+		}
+	}
+
+	return objs, next, err
+}
+
+// Rewrites the object at path under the current key. Objects that are
+// already encrypted with the current key are left alone. Reports whether the
+// object was rewritten.
+func (e *EncryptedStore) Rekey(ctx context.Context, path string) (bool, error) {
+	r, err := e.inner.Retrieve(ctx, path)
+	if err != nil {
+		return false, err
+	}
+
+	header := make([]byte, encHeaderSize)
+	_, err = io.ReadFull(r, header)
+	r.Close()
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) &&
+		!errors.Is(err, io.EOF) {
+		return false, err
+	}
+	if err == nil && isEncryptedHeader(header) &&
+		headerKeyID(header) == e.current {
+		return false, nil
+	}
+
+	pr, err := e.Retrieve(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	defer pr.Close()
+
+	if err := e.Store(ctx, pr, path); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Derives the cipher for a single object from the key named in its header
+// and the header's salt.
+func (e *EncryptedStore) objectCipher(header []byte) (cipher.AEAD, error) {
+	key, ok := e.keys[headerKeyID(header)]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownKey, headerKeyID(header))
+	}
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(header[encHeaderSize-encSaltSize:])
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+func (e *EncryptedStore) openReader(r ObjectReader) (*encryptedReader, error) {
+	header := make([]byte, encHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errNotEncryptedObj
+		}
+		return nil, err
+	}
+	if !isEncryptedHeader(header) {
+		return nil, errNotEncryptedObj
+	}
+	if header[len(encMagic)] != encVersion {
+		return nil, ErrCorruptObject
+	}
+
+	aead, err := e.objectCipher(header)
+	if err != nil {
+		return nil, err
+	}
+
+	total, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		return nil, err
+	}
+
+	chunkSize := int64(binary.BigEndian.Uint32(
+		header[encKeyIDOffset+MAX_KEY_ID_LENGTH:],
+	))
+	size, ok := plaintextSize(total, chunkSize)
+	if chunkSize == 0 || !ok {
+		return nil, ErrCorruptObject
+	}
+
+	er := &encryptedReader{
+		r:         r,
+		aead:      aead,
+		header:    header,
+		chunkSize: chunkSize,
+		size:      size,
+		chunk:     -1,
+	}
+
+	// Authenticating the last chunk up front catches truncated objects and
+	// wrong keys before anything is returned to the caller.
+	if err := er.load(er.chunks() - 1); err != nil {
+		return nil, err
+	}
+
+	return er, nil
+}
+
+func isEncryptedHeader(header []byte) bool {
+	return bytes.HasPrefix(header, []byte(encMagic))
+}
+
+func headerKeyID(header []byte) string {
+	n := int(header[len(encMagic)+1])
+	if n > MAX_KEY_ID_LENGTH {
+		n = MAX_KEY_ID_LENGTH
+	}
+	return string(header[encKeyIDOffset : encKeyIDOffset+n])
+}
+
+// Converts the size of a stored object to the size of its plaintext. Every
+// object has at least one chunk, and every chunk carries an
+// authentication tag.
+func plaintextSize(stored, chunkSize int64) (int64, bool) {
+	body := stored - int64(encHeaderSize)
+	if body < encTagSize {
+		return 0, false
+	}
+
+	chunks := (body + chunkSize + encTagSize - 1) / (chunkSize + encTagSize)
+	size := body - chunks*encTagSize
+	if size < 0 {
+		return 0, false
+	}
+
+	return size, true
+}
+
+func chunkNonce(aead cipher.AEAD, index int64) []byte {
+	nonce := make([]byte, aead.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], uint64(index))
+	return nonce
+}
+
+// The additional data of each chunk binds it to the object's header and
+// marks whether it is the final chunk, so that chunks can be neither moved
+// between objects nor dropped from the end.
+func chunkAAD(header []byte, last bool) []byte {
+	aad := make([]byte, len(header)+1)
+	copy(aad, header)
+	if last {
+		aad[len(header)] = 1
+	}
+	return aad
+}
+
+// Writes the header followed by the sealed chunks of r to w.
+func sealChunks(
+	w io.Writer,
+	r io.Reader,
+	aead cipher.AEAD,
+	header []byte,
+) error {
+	if _, err := w.Write(header); err != nil {
+		return err
+	}
+
+	br := bufio.NewReaderSize(r, ENCRYPTION_CHUNK_SIZE)
+	buf := make([]byte, ENCRYPTION_CHUNK_SIZE)
+	sealed := make([]byte, 0, ENCRYPTION_CHUNK_SIZE+encTagSize)
+
+	for index := int64(0); ; index++ {
+		n, err := io.ReadFull(br, buf)
+		last := false
+		switch {
+		case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+			last = true
+		case err != nil:
+			return err
+		default:
+			if _, err := br.Peek(1); errors.Is(err, io.EOF) {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		sealed = aead.Seal(
+			sealed[:0],
+			chunkNonce(aead, index),
+			buf[:n],
+			chunkAAD(header, last),
+		)
+		if _, err := w.Write(sealed); err != nil {
+			return err
+		}
+
+		if last {
+			return nil
+		}
+	}
+}
+
+// A seekable reader over an encrypted object that decrypts one chunk at a
+// time.
+type encryptedReader struct {
+	r         ObjectReader
+	aead      cipher.AEAD
+	header    []byte
+	chunkSize int64
+	size      int64
+	pos       int64
+
+	chunk int64
+	buf   []byte
+}
+
+func (er *encryptedReader) chunks() int64 {
+	return max(1, (er.size+er.chunkSize-1)/er.chunkSize)
+}
+
+// Reads and decrypts the chunk with the given index into the buffer.
+func (er *encryptedReader) load(index int64) error {
+	if er.chunk == index {
+		return nil
+	}
+
+	offset := int64(encHeaderSize) + index*(er.chunkSize+encTagSize)
+	if _, err := er.r.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	length := min(er.chunkSize, er.size-index*er.chunkSize)
+	sealed := make([]byte, length+encTagSize)
+	if _, err := io.ReadFull(er.r, sealed); err != nil {
+		return err
+	}
+
+	buf, err := er.aead.Open(
+		er.buf[:0],
+		chunkNonce(er.aead, index),
+		sealed,
+		chunkAAD(er.header, index == er.chunks()-1),
+	)
+	if err != nil {
+		er.chunk = -1
+		return ErrCorruptObject
+	}
+
+	er.buf = buf
+	er.chunk = index
+	return nil
+}
+
+func (er *encryptedReader) Read(p []byte) (int, error) {
+	if er.pos >= er.size {
+		return 0, io.EOF
+	}
+
+	index := er.pos / er.chunkSize
+	if err := er.load(index); err != nil {
+		return 0, err
+	}
+
+	n := copy(p, er.buf[er.pos-index*er.chunkSize:])
+	er.pos += int64(n)
+	return n, nil
+}
+
+func (er *encryptedReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = er.pos + offset
+	case io.SeekEnd:
+		pos = er.size + offset
+	default:
+		return 0, errors.New("Seek: invalid whence")
+	}
+	if pos < 0 {
+		return 0, errors.New("Seek: negative position")
+	}
+
+	er.pos = pos
+	return pos, nil
+}
+
+func (er *encryptedReader) Close() error {
+	return er.r.Close()
+}
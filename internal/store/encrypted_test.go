@@ -0,0 +1,155 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/memstore"
+	"github.com/Fekinox/dogbox-main/internal/store/storetest"
+)
+
+// Size of the encrypted header, from the start of the stored object to the
+// first sealed chunk.
+const encryptedHeaderSize = 4 + 1 + 1 + store.MAX_KEY_ID_LENGTH + 4 + 32
+
+// Size of a sealed chunk: the plaintext and its GCM tag.
+const sealedChunkSize = store.ENCRYPTION_CHUNK_SIZE + 16
+
+var testKeys = map[string][]byte{
+	"old": bytes.Repeat([]byte{1}, store.ENCRYPTION_KEY_SIZE),
+	"new": bytes.Repeat([]byte{2}, store.ENCRYPTION_KEY_SIZE),
+}
+
+func makeEncrypted(t *testing.T, inner store.Store, current string) *store.EncryptedStore {
+	t.Helper()
+
+	e, err := store.MakeEncryptedStore(inner, testKeys, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestEncryptedStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return makeEncrypted(t, memstore.MakeMemStore(), "new")
+	})
+}
+
+func TestEncryptedObjectsAreUnreadable(t *testing.T) {
+	inner := memstore.MakeMemStore()
+	e := makeEncrypted(t, inner, "new")
+
+	data := bytes.Repeat([]byte("secret "), 1000)
+	put(t, e, "a", data)
+
+	if bytes.Contains(get(t, inner, "a"), []byte("secret")) {
+		t.Fatal("stored object contains the plaintext")
+	}
+	expectContents(t, e, "a", data)
+}
+
+// Stores three chunks of data through an encrypted store, lets tamper change
+// the stored bytes, and returns the error reading the object fails with.
+func readTampered(t *testing.T, tamper func([]byte) []byte) error {
+	inner := memstore.MakeMemStore()
+	e := makeEncrypted(t, inner, "new")
+
+	data := bytes.Repeat([]byte("x"), 2*store.ENCRYPTION_CHUNK_SIZE+100)
+	put(t, e, "a", data)
+	put(t, inner, "a", tamper(get(t, inner, "a")))
+
+	_, err := read(e, "a")
+	return err
+}
+
+func TestEncryptedTampering(t *testing.T) {
+	tests := []struct {
+		name   string
+		tamper func([]byte) []byte
+	}{
+		{"MiddleChunk", func(b []byte) []byte {
+			b[encryptedHeaderSize+sealedChunkSize+10] ^= 1
+			return b
+		}},
+		{"Salt", func(b []byte) []byte {
+			b[encryptedHeaderSize-1] ^= 1
+			return b
+		}},
+		{"TruncatedFinalChunk", func(b []byte) []byte {
+			return b[:len(b)-10]
+		}},
+		{"DroppedFinalChunk", func(b []byte) []byte {
+			return b[:encryptedHeaderSize+2*sealedChunkSize]
+		}},
+		{"SwappedChunks", func(b []byte) []byte {
+			first := encryptedHeaderSize
+			second := first + sealedChunkSize
+			tmp := bytes.Clone(b[first:second])
+			copy(b[first:second], b[second:second+sealedChunkSize])
+			copy(b[second:], tmp)
+			return b
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := readTampered(t, tt.tamper)
+			if !errors.Is(err, store.ErrCorruptObject) {
+				t.Fatalf("got %v, want %v", err, store.ErrCorruptObject)
+			}
+		})
+	}
+}
+
+func TestEncryptedRekey(t *testing.T) {
+	ctx := context.Background()
+	inner := memstore.MakeMemStore()
+	old := makeEncrypted(t, inner, "old")
+
+	data := bytes.Repeat([]byte("rekey me "), 20000)
+	put(t, old, "encrypted", data)
+	// Written before encryption was enabled.
+	put(t, inner, "plain", []byte("plaintext"))
+
+	e := makeEncrypted(t, inner, "new")
+	expectContents(t, e, "encrypted", data)
+	expectContents(t, e, "plain", []byte("plaintext"))
+
+	for _, path := range []string{"encrypted", "plain"} {
+		rekeyed, err := e.Rekey(ctx, path)
+		if err != nil || !rekeyed {
+			t.Fatalf("Rekey(%q) = %v, %v; want true", path, rekeyed, err)
+		}
+		rekeyed, err = e.Rekey(ctx, path)
+		if err != nil || rekeyed {
+			t.Fatalf("second Rekey(%q) = %v, %v; want false", path, rekeyed, err)
+		}
+	}
+
+	onlyNew, err := store.MakeEncryptedStore(
+		inner,
+		map[string][]byte{"new": testKeys["new"]},
+		"new",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectContents(t, onlyNew, "encrypted", data)
+	expectContents(t, onlyNew, "plain", []byte("plaintext"))
+
+	onlyOld, err := store.MakeEncryptedStore(
+		inner,
+		map[string][]byte{"old": testKeys["old"]},
+		"old",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := read(onlyOld, "encrypted"); !errors.Is(err, store.ErrUnknownKey) {
+		t.Fatalf("reading with the old key only: got %v, want %v", err, store.ErrUnknownKey)
+	}
+}
@@ -0,0 +1,57 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+)
+
+func put(t *testing.T, s store.Store, path string, data []byte) {
+	t.Helper()
+
+	if err := s.Store(context.Background(), bytes.NewReader(data), path); err != nil {
+		t.Fatalf("Store(%q): %v", path, err)
+	}
+}
+
+// Reads the whole object, returning the error the read failed with, if any.
+func read(s store.Store, path string) ([]byte, error) {
+	r, err := s.Retrieve(context.Background(), path)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	return io.ReadAll(r)
+}
+
+func get(t *testing.T, s store.Store, path string) []byte {
+	t.Helper()
+
+	data, err := read(s, path)
+	if err != nil {
+		t.Fatalf("reading %q: %v", path, err)
+	}
+	return data
+}
+
+func expectContents(t *testing.T, s store.Store, path string, want []byte) {
+	t.Helper()
+
+	if got := get(t, s, path); !bytes.Equal(got, want) {
+		t.Fatalf("%q: got %d bytes, want %d bytes", path, len(got), len(want))
+	}
+}
+
+func expectMissing(t *testing.T, s store.Store, path string) {
+	t.Helper()
+
+	if _, err := s.Size(context.Background(), path); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("Size(%q): got %v, want %v", path, err, fs.ErrNotExist)
+	}
+}
@@ -0,0 +1,110 @@
+package store
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// Fills out shard names for file names that are too short to provide every
+// shard level. It sorts below every character that is expected in a file
+// name, which keeps sharded paths in the same order as the paths they are
+// derived from.
+const SHARD_PADDING = '!'
+
+// Name of the file, at the root of a LocalStore, that records the layout
+// every object has been migrated to.
+const LAYOUT_MARKER = ".dogbox-layout"
+
+// A Layout decides where a LocalStore keeps each object, relative to the
+// store's root. Paths on both sides are slash-separated.
+type Layout interface {
+	// Describes the layout, as recorded in the layout marker.
+	String() string
+	// Returns the location of the object with the given path.
+	Physical(p string) string
+	// Returns the path of the object kept at the given location, or false if
+	// the layout never puts an object there.
+	Logical(physical string) (string, bool)
+}
+
+type flatLayout struct{}
+
+// Keeps every object at its own path.
+func FlatLayout() Layout {
+	return flatLayout{}
+}
+
+func (flatLayout) Physical(p string) string {
+	return p
+}
+
+func (flatLayout) Logical(physical string) (string, bool) {
+	return physical, true
+}
+
+func (flatLayout) String() string {
+	return "flat"
+}
+
+type shardedLayout struct {
+	levels int
+	width  int
+}
+
+// Fans objects out into levels of subdirectories within their directory,
+// named after consecutive width-character prefixes of the object's file name.
+// With two levels of width two, images/x7Kd93Lq.png is kept at
+// images/x7/Kd/x7Kd93Lq.png.
+//
+// Shards are taken from the file name rather than from a hash of it. Public
+// file names are generated from sqids identifiers, and blobs are named after
+// their SHA-256, so their prefixes are spread as evenly as a hash would
+// spread them, and unlike a hash, they keep the sharded paths in the same
+// order as the object paths. Listings can therefore still be paginated in
+// path order without reading every directory.
+func ShardedLayout(levels, width int) Layout {
+	return shardedLayout{levels: levels, width: width}
+}
+
+func (s shardedLayout) shards(name string) []string {
+	shards := make([]string, s.levels)
+	for i := range shards {
+		var sb strings.Builder
+		for j := i * s.width; j < (i+1)*s.width; j++ {
+			if j < len(name) {
+				sb.WriteByte(name[j])
+			} else {
+				sb.WriteByte(SHARD_PADDING)
+			}
+		}
+		shards[i] = sb.String()
+	}
+	return shards
+}
+
+func (s shardedLayout) Physical(p string) string {
+	dir, name := path.Split(p)
+	return path.Join(append(append([]string{dir}, s.shards(name)...), name)...)
+}
+
+func (s shardedLayout) Logical(physical string) (string, bool) {
+	parts := strings.Split(physical, "/")
+	if len(parts) < s.levels+1 {
+		return "", false
+	}
+
+	name := parts[len(parts)-1]
+	dir := parts[:len(parts)-1-s.levels]
+	for i, shard := range s.shards(name) {
+		if parts[len(dir)+i] != shard {
+			return "", false
+		}
+	}
+
+	return path.Join(append(dir, name)...), true
+}
+
+func (s shardedLayout) String() string {
+	return fmt.Sprintf("sharded %d %d", s.levels, s.width)
+}
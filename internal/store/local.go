@@ -1,10 +1,15 @@
 package store
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"sync"
 	"time"
 )
@@ -13,75 +18,197 @@ const DIR_PERMISSIONS fs.FileMode = 0744
 const DEFAULT_PERMISSIONS fs.FileMode = 0644
 
 type LocalStore struct {
-	mu   sync.RWMutex
-	url  string
-	root string
+	mu     sync.RWMutex
+	url    string
+	root   string
+	layout Layout
+	// The layout that objects were kept in before the current one. Objects
+	// that have not been migrated yet are still read from, and removed from,
+	// their old locations.
+	legacy Layout
 }
 
 var _ Store = (*LocalStore)(nil)
+var _ Lister = (*LocalStore)(nil)
 
-func MakeLocalStore(root string) *LocalStore {
-	return &LocalStore{
-		root: root,
+type LocalOption func(*LocalStore)
+
+// Keeps objects in the given layout. Objects already kept in the flat layout
+// remain available until they are moved with Migrate.
+func WithLayout(layout Layout) LocalOption {
+	return func(l *LocalStore) {
+		if _, flat := layout.(flatLayout); flat {
+			l.layout, l.legacy = layout, nil
+			return
+		}
+		l.layout, l.legacy = layout, FlatLayout()
 	}
 }
 
-func (l *LocalStore) BaseURL() string {
-	return l.url
+// Options of the "local" store type.
+type localOptions struct {
+	Root        string `mapstructure:"root"`
+	ShardLevels int    `mapstructure:"shard_levels"`
+	ShardWidth  int    `mapstructure:"shard_width"`
 }
 
-func (l *LocalStore) Store(r io.Reader, path string) error {
-	l.mu.Lock()
-	defer l.mu.Unlock()
+func init() {
+	Register("local", func(spec *Spec) (Builder, error) {
+		if err := spec.ExpectStores(0, 0); err != nil {
+			return nil, err
+		}
+
+		opts := localOptions{ShardWidth: 2}
+		if err := spec.Decode(&opts); err != nil {
+			return nil, err
+		}
+		if opts.Root == "" {
+			return nil, fmt.Errorf("%w: root is required", ErrInvalidSpec)
+		}
+		if opts.ShardLevels < 0 {
+			return nil, fmt.Errorf(
+				"%w: shard_levels must not be negative",
+				ErrInvalidSpec,
+			)
+		}
+		if opts.ShardLevels > 0 && opts.ShardWidth <= 0 {
+			return nil, fmt.Errorf(
+				"%w: shard_width must be positive",
+				ErrInvalidSpec,
+			)
+		}
 
-	err := os.MkdirAll(filepath.Dir(l.getPath(path)), DIR_PERMISSIONS)
+		layout := FlatLayout()
+		if opts.ShardLevels > 0 {
+			layout = ShardedLayout(opts.ShardLevels, opts.ShardWidth)
+		}
+
+		return func([]Store) (Store, error) {
+			return MakeLocalStore(opts.Root, WithLayout(layout)), nil
+		}, nil
+	})
+}
+
+func MakeLocalStore(root string, opts ...LocalOption) *LocalStore {
+	l := &LocalStore{
+		root:   root,
+		layout: FlatLayout(),
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+
+	// Once every object has been migrated, there is no legacy layout left to
+	// look in.
+	if l.legacy != nil && l.migrated() {
+		l.legacy = nil
+	}
+
+	return l
+}
+
+// Reports whether the layout marker says that every object has been moved
+// into the store's layout.
+func (l *LocalStore) migrated() bool {
+	data, err := os.ReadFile(filepath.Join(l.root, LAYOUT_MARKER))
 	if err != nil {
-		return err
+		return false
 	}
 
+	return strings.TrimSpace(string(data)) == l.layout.String()
+}
+
+func (l *LocalStore) BaseURL() string {
+	return l.url
+}
+
+// Writes the object to a temporary file next to its destination, then moves
+// it into place. Only the move holds the store's lock, so slow writers never
+// block each other or readers.
+func (l *LocalStore) Store(
+	ctx context.Context,
+	r io.Reader,
+	path string,
+) error {
 	tf, err := CreateTempFile(l.getPath(path))
 	if err != nil {
 		return err
 	}
 	defer tf.Cleanup()
 
-	_, err = io.Copy(tf, r)
+	_, err = ContextCopy(ctx, tf, r)
 	if err != nil {
 		return err
 	}
 
-	err = tf.Save(l.getPath(path))
+	err = tf.Chmod(DEFAULT_PERMISSIONS)
 	if err != nil {
 		return err
 	}
 
-	err = os.Chmod(l.getPath(path), DEFAULT_PERMISSIONS)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err = tf.Save(l.getPath(path))
 	if err != nil {
 		return err
 	}
 
+	// The new contents replace any copy that has not been migrated yet.
+	if l.legacy != nil {
+		err = os.Remove(l.getLegacyPath(path))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+
 	return nil
 }
 
-func (l *LocalStore) Delete(path string) error {
+func (l *LocalStore) Delete(ctx context.Context, path string) error {
 	l.mu.Lock()
 	defer l.mu.Unlock()
 
-	return nil
+	if l.legacy == nil {
+		return os.Remove(l.getPath(path))
+	}
+
+	// The legacy copy goes first, so that a concurrent migration cannot move
+	// it back into place after the current copy has been removed.
+	legacyErr := os.Remove(l.getLegacyPath(path))
+	if legacyErr != nil && !errors.Is(legacyErr, fs.ErrNotExist) {
+		return legacyErr
+	}
+
+	err := os.Remove(l.getPath(path))
+	if errors.Is(err, fs.ErrNotExist) && legacyErr == nil {
+		return nil
+	}
+
+	return err
 }
 
-func (l *LocalStore) Retrieve(path string) (ObjectReader, error) {
+func (l *LocalStore) Retrieve(
+	ctx context.Context,
+	path string,
+) (ObjectReader, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	return os.Open(l.getPath(path))
+	return findObject(l, path, func(p string) (ObjectReader, error) {
+		return os.Open(p)
+	})
 }
 
-func (l *LocalStore) Size(path string) (int64, error) {
+func (l *LocalStore) Size(ctx context.Context, path string) (int64, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	st, err := os.Stat(l.getPath(path))
+	st, err := findObject(l, path, os.Stat)
 	if err != nil {
 		return 0, err
 	}
@@ -89,17 +216,318 @@ func (l *LocalStore) Size(path string) (int64, error) {
 	return st.Size(), nil
 }
 
-func (l *LocalStore) ModTime(path string) (time.Time, error) {
+func (l *LocalStore) ModTime(
+	ctx context.Context,
+	path string,
+) (time.Time, error) {
 	l.mu.RLock()
 	defer l.mu.RUnlock()
 
-	if st, err := os.Stat(l.getPath(path)); err == nil {
+	if st, err := findObject(l, path, os.Stat); err == nil {
 		return st.ModTime(), nil
 	} else {
 		return time.Time{}, err
 	}
 }
 
+// Calls fn on the file holding the object at the given path, wherever the
+// object is currently kept.
+func findObject[T any](
+	l *LocalStore,
+	path string,
+	fn func(string) (T, error),
+) (T, error) {
+	res, err := fn(l.getPath(path))
+	if l.legacy == nil || !errors.Is(err, fs.ErrNotExist) {
+		return res, err
+	}
+
+	res, err = fn(l.getLegacyPath(path))
+	if !errors.Is(err, fs.ErrNotExist) {
+		return res, err
+	}
+
+	// A migration running in another process may have moved the object in
+	// between the two attempts.
+	return fn(l.getPath(path))
+}
+
+// Lists the objects under the store's root. Directories that sort entirely
+// before the cursor or cannot contain the prefix are skipped without being
+// read, so each page only touches the part of the tree it returns. Objects
+// that have not been migrated to the store's layout yet are listed as well,
+// which takes a walk over the rest of the tree until Migrate has finished.
+func (l *LocalStore) List(
+	ctx context.Context,
+	prefix, cursor string,
+	limit int,
+) ([]ObjectInfo, string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	if limit <= 0 {
+		limit = DEFAULT_LIST_PAGE_SIZE
+	}
+
+	objs, err := l.listLayout(ctx, false, prefix, cursor, limit)
+	if err != nil {
+		return nil, "", err
+	}
+
+	if l.legacy != nil {
+		legacy, err := l.listLayout(ctx, true, prefix, cursor, limit)
+		if err != nil {
+			return nil, "", err
+		}
+
+		// An object that is being migrated may briefly be in both places.
+		objs = append(objs, legacy...)
+		slices.SortStableFunc(objs, func(a, b ObjectInfo) int {
+			return ComparePaths(a.Path, b.Path)
+		})
+		objs = slices.CompactFunc(objs, func(a, b ObjectInfo) bool {
+			return a.Path == b.Path
+		})
+		objs = objs[:min(len(objs), limit)]
+	}
+
+	next := ""
+	if len(objs) == limit {
+		next = objs[len(objs)-1].Path
+	}
+
+	return objs, next, nil
+}
+
+// Lists up to limit objects kept in either the store's current layout or, if
+// legacy is set, its legacy layout. Layouts keep objects in the same order as
+// their paths, so the tree can be pruned by comparing directories against the
+// location of the cursor.
+func (l *LocalStore) listLayout(
+	ctx context.Context,
+	legacy bool,
+	prefix, cursor string,
+	limit int,
+) ([]ObjectInfo, error) {
+	layout := l.layout
+	if legacy {
+		layout = l.legacy
+	}
+
+	// Only the directories of a prefix can be compared against the directories
+	// of a layout that adds levels of its own.
+	dirPrefix := prefix
+	if _, flat := layout.(flatLayout); !flat {
+		dirPrefix = prefix[:strings.LastIndex(prefix, "/")+1]
+	}
+	physCursor := ""
+	if cursor != "" {
+		physCursor = layout.Physical(cursor)
+	}
+
+	var objs []ObjectInfo
+	err := filepath.WalkDir(l.root, func(
+		p string,
+		d fs.DirEntry,
+		err error,
+	) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			// A store that has never been written to has no root yet.
+			if p == l.root && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if d.IsDir() {
+			if rel == "." {
+				return nil
+			}
+			if !strings.HasPrefix(rel+"/", dirPrefix) &&
+				!strings.HasPrefix(dirPrefix, rel+"/") {
+				return fs.SkipDir
+			}
+			if physCursor != "" && ComparePaths(rel, physCursor) < 0 &&
+				!strings.HasPrefix(physCursor, rel+"/") {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		if isTempFile(rel) || rel == LAYOUT_MARKER {
+			return nil
+		}
+		logical, ok := layout.Logical(rel)
+		if !ok {
+			return nil
+		}
+		if legacy {
+			if _, current := l.layout.Logical(rel); current {
+				return nil
+			}
+		}
+		if !strings.HasPrefix(logical, prefix) {
+			return nil
+		}
+		if cursor != "" && ComparePaths(logical, cursor) <= 0 {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			// The file was removed after its directory was read.
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+
+		objs = append(objs, ObjectInfo{
+			Path:    logical,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		if len(objs) == limit {
+			return fs.SkipAll
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return objs, nil
+}
+
+// Moves every object that is still kept in the legacy layout to its location
+// in the current layout, and returns the number of objects that were moved.
+// Objects are hard-linked into place before their old copies are removed, and
+// an object that has been rewritten in the meantime is never overwritten, so
+// the migration can run while the store is in use, including from another
+// process.
+func (l *LocalStore) Migrate(ctx context.Context) (int, error) {
+	if l.legacy == nil {
+		return 0, nil
+	}
+
+	// Collect the objects first, since moving them changes the tree.
+	var paths []string
+	err := filepath.WalkDir(l.root, func(
+		p string,
+		d fs.DirEntry,
+		err error,
+	) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			if p == l.root && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(l.root, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if isTempFile(rel) || rel == LAYOUT_MARKER {
+			return nil
+		}
+		if _, current := l.layout.Logical(rel); current {
+			return nil
+		}
+		if logical, ok := l.legacy.Logical(rel); ok {
+			paths = append(paths, logical)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	moved := 0
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return moved, err
+		}
+
+		ok, err := l.migrateObject(path)
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+		}
+	}
+
+	return moved, l.markMigrated()
+}
+
+// Records that every object has been moved into the store's layout, so that
+// stores opened from now on stop looking for objects in the legacy layout.
+func (l *LocalStore) markMigrated() error {
+	tf, err := CreateTempFile(filepath.Join(l.root, LAYOUT_MARKER))
+	if err != nil {
+		return err
+	}
+	defer tf.Cleanup()
+
+	if _, err := fmt.Fprintln(tf, l.layout.String()); err != nil {
+		return err
+	}
+
+	return tf.Save(filepath.Join(l.root, LAYOUT_MARKER))
+}
+
+func (l *LocalStore) migrateObject(path string) (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	src, dst := l.getLegacyPath(path), l.getPath(path)
+	if err := os.MkdirAll(filepath.Dir(dst), DIR_PERMISSIONS); err != nil {
+		return false, err
+	}
+
+	err := os.Link(src, dst)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		// Deleted or rewritten since the walk.
+		return false, nil
+	case errors.Is(err, fs.ErrExist):
+		// Rewritten since the walk; the old copy is stale.
+	case err != nil:
+		return false, err
+	}
+
+	err = os.Remove(src)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	return true, nil
+}
+
 func (l *LocalStore) getPath(path string) string {
-	return filepath.Join(l.root, path)
+	return filepath.Join(l.root, filepath.FromSlash(l.layout.Physical(path)))
+}
+
+func (l *LocalStore) getLegacyPath(path string) string {
+	return filepath.Join(l.root, filepath.FromSlash(l.legacy.Physical(path)))
 }
@@ -0,0 +1,23 @@
+package store_test
+
+import (
+	"testing"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/storetest"
+)
+
+func TestLocalStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return store.MakeLocalStore(t.TempDir())
+	})
+}
+
+func TestShardedLocalStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return store.MakeLocalStore(
+			t.TempDir(),
+			store.WithLayout(store.ShardedLayout(2, 2)),
+		)
+	})
+}
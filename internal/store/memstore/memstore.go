@@ -0,0 +1,184 @@
+// Package memstore implements a store.Store that keeps objects in memory. It
+// is meant for development and for testing code that uses stores; everything
+// it holds is lost when the process exits.
+package memstore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/fs"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+)
+
+// A MemStore holds every object as an immutable byte slice. Writes build a
+// new slice and swap it in once complete, so readers of an object keep
+// seeing the version they opened.
+type MemStore struct {
+	mu      sync.RWMutex
+	url     string
+	objects map[string]*object
+}
+
+type object struct {
+	data    []byte
+	modTime time.Time
+}
+
+var _ store.Store = (*MemStore)(nil)
+var _ store.Lister = (*MemStore)(nil)
+
+func init() {
+	store.Register("memory", func(spec *store.Spec) (store.Builder, error) {
+		if err := spec.ExpectStores(0, 0); err != nil {
+			return nil, err
+		}
+		if err := spec.Decode(&struct{}{}); err != nil {
+			return nil, err
+		}
+
+		return func([]store.Store) (store.Store, error) {
+			return MakeMemStore(), nil
+		}, nil
+	})
+}
+
+func MakeMemStore() *MemStore {
+	return &MemStore{
+		objects: make(map[string]*object),
+	}
+}
+
+func (m *MemStore) BaseURL() string {
+	return m.url
+}
+
+func (m *MemStore) Store(ctx context.Context, r io.Reader, path string) error {
+	var buf bytes.Buffer
+	if _, err := store.ContextCopy(ctx, &buf, r); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.objects[path] = &object{
+		data:    buf.Bytes(),
+		modTime: time.Now(),
+	}
+
+	return nil
+}
+
+func (m *MemStore) Delete(ctx context.Context, path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.objects[path]; !ok {
+		return notExist("remove", path)
+	}
+	delete(m.objects, path)
+
+	return nil
+}
+
+func (m *MemStore) Retrieve(
+	ctx context.Context,
+	path string,
+) (store.ObjectReader, error) {
+	obj, err := m.get("open", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return reader{bytes.NewReader(obj.data)}, nil
+}
+
+func (m *MemStore) Size(ctx context.Context, path string) (int64, error) {
+	obj, err := m.get("stat", path)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(len(obj.data)), nil
+}
+
+func (m *MemStore) ModTime(
+	ctx context.Context,
+	path string,
+) (time.Time, error) {
+	obj, err := m.get("stat", path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return obj.modTime, nil
+}
+
+func (m *MemStore) List(
+	ctx context.Context,
+	prefix, cursor string,
+	limit int,
+) ([]store.ObjectInfo, string, error) {
+	if limit <= 0 {
+		limit = store.DEFAULT_LIST_PAGE_SIZE
+	}
+
+	m.mu.RLock()
+	var objs []store.ObjectInfo
+	for path, obj := range m.objects {
+		if !strings.HasPrefix(path, prefix) {
+			continue
+		}
+		if cursor != "" && store.ComparePaths(path, cursor) <= 0 {
+			continue
+		}
+		objs = append(objs, store.ObjectInfo{
+			Path:    path,
+			Size:    int64(len(obj.data)),
+			ModTime: obj.modTime,
+		})
+	}
+	m.mu.RUnlock()
+
+	slices.SortFunc(objs, func(a, b store.ObjectInfo) int {
+		return store.ComparePaths(a.Path, b.Path)
+	})
+
+	next := ""
+	if len(objs) >= limit {
+		objs = objs[:limit]
+		next = objs[len(objs)-1].Path
+	}
+
+	return objs, next, nil
+}
+
+func (m *MemStore) get(op, path string) (*object, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	obj, ok := m.objects[path]
+	if !ok {
+		return nil, notExist(op, path)
+	}
+
+	return obj, nil
+}
+
+func notExist(op, path string) error {
+	return &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+}
+
+type reader struct {
+	*bytes.Reader
+}
+
+func (reader) Close() error {
+	return nil
+}
@@ -0,0 +1,15 @@
+package memstore_test
+
+import (
+	"testing"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/memstore"
+	"github.com/Fekinox/dogbox-main/internal/store/storetest"
+)
+
+func TestMemStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return memstore.MakeMemStore()
+	})
+}
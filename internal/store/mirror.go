@@ -1,111 +1,502 @@
 package store
 
 import (
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/fs"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
 
 // A Mirror uses multiple backing stores to retrieve data.
 // Store operations will write the given file to all of the backing stores,
-// and returns true if at least one of the uploads is successful.
-// Retrieval operations (retrieval, exists, information, etc.) will try all of
-// the backing stores in sequential order given in the stores list.
+// and succeed if enough of them accept the write to satisfy the mirror's
+// WritePolicy. Otherwise the write is rolled back on the stores that accepted
+// it and did not hold the path before.
+// Retrieval operations (retrieval, exists, information, etc.) try the backing
+// stores in the order given by the mirror's ReadStrategy, moving stores that
+// keep failing to the back of the line.
 type Mirror struct {
 	stores []Store
 	url    string
+	policy WritePolicy
+	reads  ReadStrategy
+	health *healthTracker
 }
 
 var _ Store = (*Mirror)(nil)
+var _ Lister = (*Mirror)(nil)
+
+// A WritePolicy returns how many of a mirror's n backing stores must accept a
+// write for the write to succeed.
+type WritePolicy func(n int) int
+
+var (
+	// Every backing store must accept the write.
+	WriteAll WritePolicy = func(n int) int { return n }
+	// A strict majority of the backing stores must accept the write.
+	WriteQuorum WritePolicy = func(n int) int { return n/2 + 1 }
+)
+
+// Returns a policy that requires at least k backing stores (or all of them,
+// if there are fewer than k) to accept the write.
+func WriteAtLeast(k int) WritePolicy {
+	return func(n int) int { return max(1, min(k, n)) }
+}
+
+type MirrorOption func(*Mirror)
+
+func WithWritePolicy(p WritePolicy) MirrorOption {
+	return func(m *Mirror) {
+		m.policy = p
+	}
+}
+
+func WithReadStrategy(r ReadStrategy) MirrorOption {
+	return func(m *Mirror) {
+		m.reads = r
+	}
+}
+
+// Deprioritizes a backing store for the cooldown period once it has failed
+// threshold reads in a row.
+func WithHealthTracking(threshold int, cooldown time.Duration) MirrorOption {
+	return func(m *Mirror) {
+		m.health = newHealthTracker(len(m.stores), threshold, cooldown)
+	}
+}
+
+// Options of the "mirror" store type.
+type mirrorOptions struct {
+	// "all", "quorum", or the number of stores that must accept a write.
+	WritePolicy string `mapstructure:"write_policy"`
+	// "primary" or "round_robin".
+	ReadStrategy string `mapstructure:"read_strategy"`
+	// Hedges reads after this delay, if positive.
+	HedgeDelay      time.Duration `mapstructure:"hedge_delay"`
+	HealthThreshold int           `mapstructure:"health_threshold"`
+	HealthCooldown  time.Duration `mapstructure:"health_cooldown"`
+}
+
+func init() {
+	Register("mirror", func(spec *Spec) (Builder, error) {
+		if err := spec.ExpectStores(1, -1); err != nil {
+			return nil, err
+		}
+
+		opts := mirrorOptions{
+			WritePolicy:     "all",
+			ReadStrategy:    "primary",
+			HealthThreshold: DEFAULT_HEALTH_THRESHOLD,
+			HealthCooldown:  DEFAULT_HEALTH_COOLDOWN,
+		}
+		if err := spec.Decode(&opts); err != nil {
+			return nil, err
+		}
+
+		var mOpts []MirrorOption
+		switch opts.WritePolicy {
+		case "all":
+			mOpts = append(mOpts, WithWritePolicy(WriteAll))
+		case "quorum":
+			mOpts = append(mOpts, WithWritePolicy(WriteQuorum))
+		default:
+			k, err := strconv.Atoi(opts.WritePolicy)
+			if err != nil || k <= 0 {
+				return nil, fmt.Errorf(
+					"%w: write_policy must be all, quorum or a positive number",
+					ErrInvalidSpec,
+				)
+			}
+			mOpts = append(mOpts, WithWritePolicy(WriteAtLeast(k)))
+		}
+
+		var reads ReadStrategy
+		switch opts.ReadStrategy {
+		case "primary":
+			reads = PrimaryFirst()
+		case "round_robin":
+			reads = RoundRobin()
+		default:
+			return nil, fmt.Errorf(
+				"%w: read_strategy must be primary or round_robin",
+				ErrInvalidSpec,
+			)
+		}
+		if opts.HedgeDelay > 0 {
+			reads = Hedged(reads, opts.HedgeDelay)
+		}
+		mOpts = append(mOpts, WithReadStrategy(reads))
+
+		if opts.HealthThreshold <= 0 || opts.HealthCooldown < 0 {
+			return nil, fmt.Errorf(
+				"%w: health_threshold must be positive and health_cooldown "+
+					"must not be negative",
+				ErrInvalidSpec,
+			)
+		}
+
+		// Health tracking depends on the number of stores, so it has to be
+		// applied after them.
+		mOpts = append(mOpts, WithHealthTracking(
+			opts.HealthThreshold,
+			opts.HealthCooldown,
+		))
+
+		return func(stores []Store) (Store, error) {
+			return MakeMirror(stores, mOpts...), nil
+		}, nil
+	})
+}
+
+func MakeMirror(stores []Store, opts ...MirrorOption) *Mirror {
+	m := &Mirror{
+		stores: stores,
+		policy: WriteAll,
+		reads:  PrimaryFirst(),
+		health: newHealthTracker(
+			len(stores),
+			DEFAULT_HEALTH_THRESHOLD,
+			DEFAULT_HEALTH_COOLDOWN,
+		),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return m
+}
+
+// A ReplicaError is the error reported by one of a mirror's backing stores,
+// identified by its index in the stores list.
+type ReplicaError struct {
+	Index int
+	Err   error
+}
+
+func (e ReplicaError) Error() string {
+	return fmt.Sprintf("replica %d: %v", e.Index, e.Err)
+}
+
+func (e ReplicaError) Unwrap() error {
+	return e.Err
+}
+
+// A MirrorError is returned when a mirror operation could not be completed on
+// enough of the backing stores. It lists every replica that failed, as well as
+// any replica that could not be rolled back afterwards.
+type MirrorError struct {
+	Op       string
+	Path     string
+	Failed   []ReplicaError
+	Rollback []ReplicaError
+}
+
+func (e *MirrorError) Error() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "mirror %s %s: %d replica(s) failed", e.Op, e.Path,
+		len(e.Failed))
+	for _, f := range e.Failed {
+		sb.WriteString("; ")
+		sb.WriteString(f.Error())
+	}
+	for _, f := range e.Rollback {
+		sb.WriteString("; rollback of ")
+		sb.WriteString(f.Error())
+	}
+
+	return sb.String()
+}
+
+func (e *MirrorError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed)+len(e.Rollback))
+	for _, f := range e.Failed {
+		errs = append(errs, f)
+	}
+	for _, f := range e.Rollback {
+		errs = append(errs, f)
+	}
+
+	return errs
+}
+
+var errTooFewReplicas = errors.New("Too few replicas left to satisfy the write policy")
+
+// Number of chunks of data a backing store can fall behind the fastest one
+// before it holds up the write.
+const MIRROR_FEED_CHUNKS = 64
+
+// The data queued for a single backing store, read by that store's own
+// goroutine. Every store consumes its feed at its own pace, so a slow store
+// only holds up the others once its queue is full.
+type replicaFeed struct {
+	ch chan []byte
+	// Closed once the store's Store call has returned.
+	done chan struct{}
+	// Set before ch is closed: nil to end the stream normally, or the error
+	// that makes the store abandon its write.
+	err error
+	buf []byte
+	// Set once the store has read the whole stream.
+	eof bool
+}
+
+func newReplicaFeed() *replicaFeed {
+	return &replicaFeed{
+		ch:   make(chan []byte, MIRROR_FEED_CHUNKS),
+		done: make(chan struct{}),
+	}
+}
+
+func (f *replicaFeed) Read(p []byte) (int, error) {
+	for len(f.buf) == 0 {
+		chunk, ok := <-f.ch
+		if !ok {
+			if f.err != nil {
+				return 0, f.err
+			}
+			f.eof = true
+			return 0, io.EOF
+		}
+		f.buf = chunk
+	}
+
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
+
+// Queues writes on the feed of every backing store that is still accepting
+// data. A store that returns early is dropped from the fan-out instead of
+// stalling the remaining stores.
+type fanOut struct {
+	ctx      context.Context
+	feeds    []*replicaFeed
+	dropped  []bool
+	required int
+}
+
+func (f *fanOut) Write(p []byte) (int, error) {
+	// The chunk is shared by every feed, which only read from it.
+	chunk := bytes.Clone(p)
+
+	live := 0
+	for i, feed := range f.feeds {
+		if f.dropped[i] {
+			continue
+		}
+		select {
+		case feed.ch <- chunk:
+			live++
+		case <-feed.done:
+			f.dropped[i] = true
+		case <-f.ctx.Done():
+			return 0, f.ctx.Err()
+		}
+	}
+
+	if live < f.required {
+		return 0, errTooFewReplicas
+	}
+
+	return len(p), nil
+}
+
+// Ends every feed. Must not be called concurrently with Write.
+func (f *fanOut) close(err error) {
+	for _, feed := range f.feeds {
+		feed.err = err
+		close(feed.ch)
+	}
+}
 
 func (m *Mirror) BaseURL() string {
 	return m.url
 }
 
-func (m *Mirror) Store(r io.Reader, path string) error {
-	mirrorReaders := make([]io.Reader, len(m.stores))
-	mirrorWriters := make([]io.Writer, len(m.stores))
+func (m *Mirror) writePolicy() WritePolicy {
+	if m.policy == nil {
+		return WriteAll
+	}
+	return m.policy
+}
 
-	for i := 0; i < len(m.stores); i++ {
-		mirrorReaders[i], mirrorWriters[i] = io.Pipe()
+func (m *Mirror) Store(ctx context.Context, r io.Reader, path string) error {
+	if len(m.stores) == 0 {
+		return errors.New("Mirror has no backing stores")
 	}
 
-	joinWriter := io.MultiWriter(mirrorWriters...)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	readHeadErr := make(chan error)
+	fan := &fanOut{
+		ctx:      ctx,
+		feeds:    make([]*replicaFeed, len(m.stores)),
+		dropped:  make([]bool, len(m.stores)),
+		required: m.writePolicy()(len(m.stores)),
+	}
 	writeErrs := make([]error, len(m.stores))
-	finish := make(chan struct{})
-
-	go func() {
-		_, err := io.Copy(joinWriter, r)
-		if err != nil {
-			readHeadErr <- err
-		}
-	}()
+	existed := make([]bool, len(m.stores))
 
 	var wg sync.WaitGroup
-	for i := 0; i < len(m.stores); i++ {
+	for i, st := range m.stores {
+		feed := newReplicaFeed()
+		fan.feeds[i] = feed
+
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			err := m.stores[i].Store(mirrorReaders[i], path)
-			if err != nil {
-				writeErrs[i] = err
-			}
+			// Unblocks the fan-out if the store stops reading early.
+			defer close(feed.done)
+
+			// Anything but a confirmed absence counts as an existing object,
+			// which is never rolled back.
+			_, err := st.Size(ctx, path)
+			existed[i] = !errors.Is(err, fs.ErrNotExist)
+
+			writeErrs[i] = st.Store(ctx, feed, path)
 		}()
 	}
 
-	go func() {
-		wg.Wait()
-		finish <- struct{}{}
-	}()
+	_, copyErr := ContextCopy(ctx, fan, r)
+	// A nil error ends every stream normally; anything else makes the
+	// remaining stores abandon their writes.
+	fan.close(copyErr)
+	wg.Wait()
 
-	allErrs := errors.Join(writeErrs...)
+	var failed []ReplicaError
+	succeeded := 0
+	for i, err := range writeErrs {
+		// A store that returned without consuming the whole stream did not
+		// store all of the data.
+		if err == nil && !fan.feeds[i].eof {
+			err = io.ErrShortWrite
+			writeErrs[i] = err
+		}
+		switch {
+		case err == nil:
+			succeeded++
+		case !errors.Is(err, errTooFewReplicas):
+			// Stores that were only aborted because others failed are not
+			// reported.
+			failed = append(failed, ReplicaError{Index: i, Err: err})
+		}
+	}
 
-	select {
-	case err := <-readHeadErr:
-		allErrs = errors.Join(allErrs, err)
-	case <-finish:
+	if copyErr == nil && succeeded >= fan.required {
+		return nil
 	}
 
-	if allErrs != nil {
-		// Undo all stores that have succeeded if one of them has failed
-		for i := 0; i < len(m.stores); i++ {
-			if writeErrs[i] == nil {
-				dErr := m.stores[i].Delete(path)
-				if dErr != nil {
-					allErrs = errors.Join(allErrs, dErr)
-					return allErrs
-				}
-			}
+	// Undo the write on every store that accepted it. This has to happen even
+	// if the caller's context is already canceled. Stores that already held
+	// the path keep the new contents: deleting them would lose the object
+	// altogether, while a replica that differs from the others is fixed by
+	// the next repair.
+	mErr := &MirrorError{Op: "store", Path: path, Failed: failed}
+	for i, st := range m.stores {
+		if writeErrs[i] != nil || existed[i] {
+			continue
+		}
+		if err := st.Delete(context.WithoutCancel(ctx), path); err != nil {
+			mErr.Rollback = append(mErr.Rollback, ReplicaError{Index: i, Err: err})
 		}
 	}
 
-	return nil
-}
+	if copyErr != nil && !errors.Is(copyErr, errTooFewReplicas) {
+		return errors.Join(copyErr, mErr)
+	}
 
-func (m *Mirror) Delete(path string) error {
-	return nil
+	return mErr
 }
 
-func (m *Mirror) Retrieve(path string) (ObjectReader, error) {
-	for _, st := range m.stores {
-		r, err := st.Retrieve(path)
-		if err != nil {
+// Deletes the file from every backing store. Stores that do not hold the file
+// are not considered to have failed.
+func (m *Mirror) Delete(ctx context.Context, path string) error {
+	mErr := &MirrorError{Op: "delete", Path: path}
+	missing := 0
+	for i, st := range m.stores {
+		err := st.Delete(ctx, path)
+		if errors.Is(err, fs.ErrNotExist) {
+			missing++
 			continue
 		}
+		if err != nil {
+			mErr.Failed = append(mErr.Failed, ReplicaError{Index: i, Err: err})
+		}
+	}
 
-		return r, nil
+	if len(mErr.Failed) > 0 {
+		return mErr
+	}
+	if missing == len(m.stores) {
+		return fs.ErrNotExist
 	}
 
-	return nil, errors.New("Could not find file in any backing store")
+	return nil
+}
+
+func (m *Mirror) Retrieve(
+	ctx context.Context,
+	path string,
+) (ObjectReader, error) {
+	return readFrom(
+		ctx,
+		m,
+		"retrieve",
+		path,
+		func(ctx context.Context, st Store) (ObjectReader, error) {
+			return st.Retrieve(ctx, path)
+		},
+		func(r ObjectReader) { r.Close() },
+		func(r ObjectReader, cancel context.CancelFunc) ObjectReader {
+			return &cancelOnClose{ObjectReader: r, cancel: cancel}
+		},
+	)
+}
+
+func (m *Mirror) Size(ctx context.Context, path string) (int64, error) {
+	return readFrom(
+		ctx,
+		m,
+		"size",
+		path,
+		func(ctx context.Context, st Store) (int64, error) {
+			return st.Size(ctx, path)
+		},
+		nil,
+		nil,
+	)
 }
 
-func (m *Mirror) Size(path string) (int64, error) {
-	return 0, nil
+func (m *Mirror) ModTime(
+	ctx context.Context,
+	path string,
+) (time.Time, error) {
+	return readFrom(
+		ctx,
+		m,
+		"modtime",
+		path,
+		func(ctx context.Context, st Store) (time.Time, error) {
+			return st.ModTime(ctx, path)
+		},
+		nil,
+		nil,
+	)
 }
 
-func (m *Mirror) ModTime(path string) (time.Time, error) {
-	return time.Now(), nil
+// Lists the union of the objects held by every backing store that supports
+// listing. When several stores hold the same path, the information from the
+// earliest store in the list is returned.
+func (m *Mirror) List(
+	ctx context.Context,
+	prefix, cursor string,
+	limit int,
+) ([]ObjectInfo, string, error) {
+	return mergeListings(ctx, m.stores, prefix, cursor, limit)
 }
@@ -0,0 +1,328 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const DEFAULT_HEALTH_THRESHOLD = 3
+const DEFAULT_HEALTH_COOLDOWN = 30 * time.Second
+
+// A ReadStrategy decides the order in which a mirror tries its backing stores
+// when reading.
+type ReadStrategy interface {
+	// Returns the indices of n backing stores in the order they should be
+	// tried.
+	Order(n int) []int
+}
+
+type primaryFirst struct{}
+
+// Always tries the backing stores in the order they were given to the mirror.
+func PrimaryFirst() ReadStrategy {
+	return primaryFirst{}
+}
+
+func (primaryFirst) Order(n int) []int {
+	order := make([]int, n)
+	for i := range order {
+		order[i] = i
+	}
+	return order
+}
+
+type roundRobin struct {
+	next atomic.Uint64
+}
+
+// Starts each read at the next backing store in turn, spreading reads evenly
+// across all of them.
+func RoundRobin() ReadStrategy {
+	return &roundRobin{}
+}
+
+func (r *roundRobin) Order(n int) []int {
+	if n == 0 {
+		return nil
+	}
+
+	start := int(r.next.Add(1)-1) % n
+	order := make([]int, n)
+	for i := range order {
+		order[i] = (start + i) % n
+	}
+	return order
+}
+
+type hedged struct {
+	base  ReadStrategy
+	delay time.Duration
+}
+
+// Tries the backing stores in the order given by base, but does not wait for
+// a slow store: if a read has not finished after delay, the next store is
+// tried in parallel and whichever answers first wins.
+func Hedged(base ReadStrategy, delay time.Duration) ReadStrategy {
+	return &hedged{base: base, delay: delay}
+}
+
+func (h *hedged) Order(n int) []int {
+	return h.base.Order(n)
+}
+
+// Tracks consecutive read failures of each backing store in a mirror. A store
+// that has failed threshold times in a row is considered unhealthy until the
+// cooldown has passed, after which it is given another chance.
+type healthTracker struct {
+	mu        sync.Mutex
+	failures  []int
+	until     []time.Time
+	threshold int
+	cooldown  time.Duration
+}
+
+func newHealthTracker(
+	n int,
+	threshold int,
+	cooldown time.Duration,
+) *healthTracker {
+	return &healthTracker{
+		failures:  make([]int, n),
+		until:     make([]time.Time, n),
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+}
+
+func (h *healthTracker) healthy(i int) bool {
+	if h == nil {
+		return true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return time.Now().After(h.until[i])
+}
+
+func (h *healthTracker) success(i int) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures[i] = 0
+	h.until[i] = time.Time{}
+}
+
+func (h *healthTracker) failure(i int) {
+	if h == nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.failures[i]++
+	if h.failures[i] >= h.threshold {
+		h.until[i] = time.Now().Add(h.cooldown)
+	}
+}
+
+// Returns the order in which to try the backing stores: the order given by
+// the read strategy, with unhealthy stores moved to the end.
+func (m *Mirror) readOrder() []int {
+	reads := m.reads
+	if reads == nil {
+		reads = PrimaryFirst()
+	}
+
+	order := reads.Order(len(m.stores))
+	slices.SortStableFunc(order, func(a, b int) int {
+		ha, hb := m.health.healthy(a), m.health.healthy(b)
+		switch {
+		case ha == hb:
+			return 0
+		case ha:
+			return -1
+		default:
+			return 1
+		}
+	})
+
+	return order
+}
+
+// Records the outcome of a read against a backing store. Missing files and
+// reads that were canceled say nothing about the store's health.
+func (m *Mirror) recordRead(i int, err error) {
+	switch {
+	case err == nil:
+		m.health.success(i)
+	case errors.Is(err, fs.ErrNotExist), errors.Is(err, context.Canceled):
+	default:
+		m.health.failure(i)
+	}
+}
+
+type readResult[T any] struct {
+	index int
+	value T
+	err   error
+}
+
+// Runs fn against the mirror's backing stores according to its read strategy
+// until one of them succeeds. If the strategy is hedged, slow stores are
+// raced against the next ones in line and the values of the losers are passed
+// to release, if it is not nil. The winner's attempt is canceled once it has
+// returned, or, if bind is not nil, once the value bind wraps it in is done
+// with. If no store holds the file, the returned error wraps fs.ErrNotExist.
+func readFrom[T any](
+	ctx context.Context,
+	m *Mirror,
+	op string,
+	path string,
+	fn func(context.Context, Store) (T, error),
+	release func(T),
+	bind func(T, context.CancelFunc) T,
+) (T, error) {
+	var zero T
+	order := m.readOrder()
+	errs := make([]error, len(m.stores))
+
+	delay := time.Duration(-1)
+	if h, ok := m.reads.(*hedged); ok {
+		delay = h.delay
+	}
+
+	if delay < 0 {
+		for _, i := range order {
+			v, err := fn(ctx, m.stores[i])
+			m.recordRead(i, err)
+			if err == nil {
+				return v, nil
+			}
+			errs[i] = err
+		}
+
+		return zero, readError(op, path, errs)
+	}
+
+	results := make(chan readResult[T], len(order))
+	cancels := make([]context.CancelFunc, len(m.stores))
+	launched, pending := 0, 0
+
+	// Every attempt but the winner's ends with the read.
+	winner := -1
+	defer func() {
+		for i, cancel := range cancels {
+			if cancel != nil && i != winner {
+				cancel()
+			}
+		}
+	}()
+
+	launch := func() {
+		i := order[launched]
+		launched++
+		pending++
+
+		attemptCtx, cancel := context.WithCancel(ctx)
+		cancels[i] = cancel
+		go func() {
+			v, err := fn(attemptCtx, m.stores[i])
+			results <- readResult[T]{index: i, value: v, err: err}
+		}()
+	}
+
+	// Releases whatever the remaining attempts return once they finish.
+	abandon := func() {
+		go func(n int) {
+			for ; n > 0; n-- {
+				r := <-results
+				m.recordRead(r.index, r.err)
+				if r.err == nil && release != nil {
+					release(r.value)
+				}
+			}
+		}(pending)
+	}
+
+	if len(order) == 0 {
+		return zero, readError(op, path, errs)
+	}
+	launch()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			m.recordRead(r.index, r.err)
+			if r.err == nil {
+				winner = r.index
+				abandon()
+				if bind == nil {
+					cancels[winner]()
+					return r.value, nil
+				}
+				return bind(r.value, cancels[winner]), nil
+			}
+			errs[r.index] = r.err
+
+			// Don't wait out the delay when a store has already failed.
+			if launched < len(order) {
+				launch()
+				timer.Reset(delay)
+			}
+		case <-timer.C:
+			if launched < len(order) {
+				launch()
+				timer.Reset(delay)
+			}
+		case <-ctx.Done():
+			abandon()
+			return zero, ctx.Err()
+		}
+	}
+
+	return zero, readError(op, path, errs)
+}
+
+// Builds the error for a read that failed on every backing store. Stores that
+// simply did not have the file are not listed as failures.
+func readError(op, path string, errs []error) error {
+	mErr := &MirrorError{Op: op, Path: path}
+	for i, err := range errs {
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			mErr.Failed = append(mErr.Failed, ReplicaError{Index: i, Err: err})
+		}
+	}
+
+	if len(mErr.Failed) == 0 {
+		return &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+	}
+
+	return mErr
+}
+
+// Cancels the attempt that opened the reader once the reader is closed.
+type cancelOnClose struct {
+	ObjectReader
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ObjectReader.Close()
+	c.cancel()
+	return err
+}
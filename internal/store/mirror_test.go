@@ -0,0 +1,488 @@
+package store_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/memstore"
+	"github.com/Fekinox/dogbox-main/internal/store/storetest"
+)
+
+func TestMirror(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return store.MakeMirror([]store.Store{
+			store.MakeLocalStore(t.TempDir()),
+			store.MakeLocalStore(t.TempDir()),
+		})
+	})
+}
+
+var errFault = errors.New("injected fault")
+
+// A memory store whose operations can be made to fail or stall. Faults are set
+// up before the store is used.
+type faultyStore struct {
+	*memstore.MemStore
+
+	// Returned by writes, without reading the data, if set.
+	writeErr error
+	// Makes writes report success without reading the data.
+	shortWrite bool
+	deleteErr  error
+	// Returned by reads after readDelay, if set.
+	readErr error
+	// Reads wait this long, or until they are canceled.
+	readDelay time.Duration
+
+	reads atomic.Int64
+	// Receives the context of every read, as long as there is room.
+	contexts chan context.Context
+}
+
+func newFaultyStore() *faultyStore {
+	return &faultyStore{
+		MemStore: memstore.MakeMemStore(),
+		contexts: make(chan context.Context, 16),
+	}
+}
+
+func (s *faultyStore) Store(ctx context.Context, r io.Reader, path string) error {
+	if s.writeErr != nil {
+		return s.writeErr
+	}
+	if s.shortWrite {
+		return nil
+	}
+	return s.MemStore.Store(ctx, r, path)
+}
+
+func (s *faultyStore) Delete(ctx context.Context, path string) error {
+	if s.deleteErr != nil {
+		return s.deleteErr
+	}
+	return s.MemStore.Delete(ctx, path)
+}
+
+func (s *faultyStore) read(ctx context.Context) error {
+	s.reads.Add(1)
+	select {
+	case s.contexts <- ctx:
+	default:
+	}
+
+	if s.readDelay > 0 {
+		select {
+		case <-time.After(s.readDelay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return s.readErr
+}
+
+func (s *faultyStore) Retrieve(ctx context.Context, path string) (store.ObjectReader, error) {
+	if err := s.read(ctx); err != nil {
+		return nil, err
+	}
+	return s.MemStore.Retrieve(ctx, path)
+}
+
+func (s *faultyStore) Size(ctx context.Context, path string) (int64, error) {
+	if err := s.read(ctx); err != nil {
+		return 0, err
+	}
+	return s.MemStore.Size(ctx, path)
+}
+
+func makeFaultyMirror(n int, opts ...store.MirrorOption) (*store.Mirror, []*faultyStore) {
+	replicas := make([]*faultyStore, n)
+	stores := make([]store.Store, n)
+	for i := range replicas {
+		replicas[i] = newFaultyStore()
+		stores[i] = replicas[i]
+	}
+	return store.MakeMirror(stores, opts...), replicas
+}
+
+// Returns the indices of the replica errors.
+func replicaIndices(errs []store.ReplicaError) []int {
+	var indices []int
+	for _, e := range errs {
+		indices = append(indices, e.Index)
+	}
+	return indices
+}
+
+func TestMirrorWritePolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy store.WritePolicy
+		// Replicas whose writes fail.
+		failing []int
+		// Replicas that claim to store the data without reading it.
+		short []int
+		// Replicas that already hold the path.
+		existing []int
+		// Replicas whose rollback fails.
+		undeletable []int
+
+		ok bool
+		// Replicas listed in the MirrorError.
+		failed   []int
+		rollback []int
+		// Replicas that hold the new contents afterwards.
+		holding []int
+	}{
+		{
+			name:    "AllSucceed",
+			policy:  store.WriteAll,
+			ok:      true,
+			holding: []int{0, 1, 2},
+		},
+		{
+			name:    "AllOneFails",
+			policy:  store.WriteAll,
+			failing: []int{1},
+			failed:  []int{1},
+		},
+		{
+			name:   "AllShortWrite",
+			policy: store.WriteAll,
+			short:  []int{2},
+			failed: []int{2},
+		},
+		{
+			name:     "AllKeepsExisting",
+			policy:   store.WriteAll,
+			failing:  []int{1},
+			existing: []int{0},
+			failed:   []int{1},
+			holding:  []int{0},
+		},
+		{
+			name:        "AllRollbackFails",
+			policy:      store.WriteAll,
+			failing:     []int{1},
+			undeletable: []int{2},
+			failed:      []int{1},
+			rollback:    []int{2},
+			holding:     []int{2},
+		},
+		{
+			name:    "QuorumOneFails",
+			policy:  store.WriteQuorum,
+			failing: []int{1},
+			ok:      true,
+			holding: []int{0, 2},
+		},
+		{
+			name:    "QuorumTwoFail",
+			policy:  store.WriteQuorum,
+			failing: []int{0, 2},
+			failed:  []int{0, 2},
+		},
+		{
+			name:    "AtLeastOne",
+			policy:  store.WriteAtLeast(1),
+			failing: []int{0, 1},
+			ok:      true,
+			holding: []int{2},
+		},
+		{
+			name:    "AtLeastOneAllFail",
+			policy:  store.WriteAtLeast(1),
+			failing: []int{0, 1, 2},
+			failed:  []int{0, 1, 2},
+		},
+		{
+			name:    "AtLeastMoreThanReplicas",
+			policy:  store.WriteAtLeast(5),
+			failing: []int{2},
+			failed:  []int{2},
+		},
+	}
+
+	data := []byte("new contents")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, replicas := makeFaultyMirror(3, store.WithWritePolicy(tt.policy))
+			for _, i := range tt.existing {
+				put(t, replicas[i], "a", []byte("old contents"))
+			}
+			for _, i := range tt.failing {
+				replicas[i].writeErr = errFault
+			}
+			for _, i := range tt.short {
+				replicas[i].shortWrite = true
+			}
+			for _, i := range tt.undeletable {
+				replicas[i].deleteErr = errFault
+			}
+
+			err := m.Store(context.Background(), bytes.NewReader(data), "a")
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("Store: %v", err)
+				}
+			} else {
+				var mErr *store.MirrorError
+				if !errors.As(err, &mErr) {
+					t.Fatalf("Store: got %v, want a *MirrorError", err)
+				}
+				if mErr.Op != "store" || mErr.Path != "a" {
+					t.Errorf("MirrorError is for %s %s, want store a", mErr.Op, mErr.Path)
+				}
+				if got := replicaIndices(mErr.Failed); !slices.Equal(got, tt.failed) {
+					t.Errorf("failed replicas = %v, want %v", got, tt.failed)
+				}
+				if got := replicaIndices(mErr.Rollback); !slices.Equal(got, tt.rollback) {
+					t.Errorf("replicas that failed to roll back = %v, want %v", got, tt.rollback)
+				}
+				for _, f := range append(mErr.Failed, mErr.Rollback...) {
+					if f.Err == nil {
+						t.Errorf("replica %d failed without an error", f.Index)
+					}
+				}
+				if len(tt.failing) > 0 && !errors.Is(err, errFault) {
+					t.Errorf("error %v does not wrap the replica's error", err)
+				}
+			}
+
+			for i, r := range replicas {
+				got, err := read(r.MemStore, "a")
+				switch {
+				case slices.Contains(tt.holding, i):
+					if !bytes.Equal(got, data) {
+						t.Errorf("replica %d holds %q, %v; want %q", i, got, err, data)
+					}
+				case slices.Contains(tt.existing, i):
+					if string(got) != "old contents" {
+						t.Errorf("replica %d holds %q, %v; want the old contents", i, got, err)
+					}
+				default:
+					if !errors.Is(err, fs.ErrNotExist) {
+						t.Errorf("replica %d holds %q, %v; want nothing", i, got, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMirrorErrorMessage(t *testing.T) {
+	err := &store.MirrorError{
+		Op:       "store",
+		Path:     "a",
+		Failed:   []store.ReplicaError{{Index: 1, Err: errFault}},
+		Rollback: []store.ReplicaError{{Index: 2, Err: io.ErrClosedPipe}},
+	}
+
+	want := "mirror store a: 1 replica(s) failed; replica 1: injected fault; " +
+		"rollback of replica 2: io: read/write on closed pipe"
+	if got := err.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	if !errors.Is(err, errFault) || !errors.Is(err, io.ErrClosedPipe) {
+		t.Error("MirrorError does not wrap the replicas' errors")
+	}
+
+	var rErr store.ReplicaError
+	if !errors.As(err, &rErr) || rErr.Index != 1 {
+		t.Errorf("first ReplicaError = %+v, want replica 1", rErr)
+	}
+}
+
+func TestMirrorReadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		// Replicas whose reads fail, and those that hold the object.
+		failing []int
+		holding []int
+		// Replicas listed in the MirrorError, or nil if the object should
+		// be missing.
+		failed []int
+	}{
+		{"Missing", nil, nil, nil},
+		{"OneFailsRestMissing", []int{1}, nil, []int{1}},
+		{"AllFail", []int{0, 1}, nil, []int{0, 1}},
+		{"FallsBack", []int{0}, []int{1}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, replicas := makeFaultyMirror(2)
+			for _, i := range tt.holding {
+				put(t, replicas[i], "a", []byte("a"))
+			}
+			for _, i := range tt.failing {
+				replicas[i].readErr = errFault
+			}
+
+			_, err := read(m, "a")
+			switch {
+			case len(tt.holding) > 0:
+				if err != nil {
+					t.Fatalf("reading: %v", err)
+				}
+			case tt.failed == nil:
+				var mErr *store.MirrorError
+				if !errors.Is(err, fs.ErrNotExist) || errors.As(err, &mErr) {
+					t.Fatalf("reading: got %v, want %v", err, fs.ErrNotExist)
+				}
+			default:
+				var mErr *store.MirrorError
+				if !errors.As(err, &mErr) {
+					t.Fatalf("reading: got %v, want a *MirrorError", err)
+				}
+				if mErr.Op != "retrieve" {
+					t.Errorf("MirrorError is for %s, want retrieve", mErr.Op)
+				}
+				if got := replicaIndices(mErr.Failed); !slices.Equal(got, tt.failed) {
+					t.Errorf("failed replicas = %v, want %v", got, tt.failed)
+				}
+			}
+		})
+	}
+}
+
+func nextContext(t *testing.T, s *faultyStore) context.Context {
+	t.Helper()
+
+	select {
+	case ctx := <-s.contexts:
+		return ctx
+	case <-time.After(5 * time.Second):
+		t.Fatal("the store was never read")
+		return nil
+	}
+}
+
+func TestMirrorHedgedRead(t *testing.T) {
+	m, replicas := makeFaultyMirror(2,
+		store.WithReadStrategy(store.Hedged(store.PrimaryFirst(), 10*time.Millisecond)))
+	slow, fast := replicas[0], replicas[1]
+	for _, r := range replicas {
+		put(t, r, "a", []byte("hello"))
+	}
+	slow.readDelay = time.Minute
+
+	start := time.Now()
+	r, err := m.Retrieve(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 30*time.Second {
+		t.Fatalf("hedged read took %v", elapsed)
+	}
+
+	// The losing attempt is canceled as soon as the read has a winner.
+	select {
+	case <-nextContext(t, slow).Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the slow attempt was not canceled")
+	}
+
+	// The winner's attempt lasts until its reader is closed.
+	winner := nextContext(t, fast)
+	data, err := io.ReadAll(r)
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	if err := winner.Err(); err != nil {
+		t.Fatalf("winning attempt ended before its reader was closed: %v", err)
+	}
+	r.Close()
+	if err := winner.Err(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("winning attempt after Close: got %v, want %v", err, context.Canceled)
+	}
+
+	// Attempts that return plain values end as soon as they win.
+	if _, err := m.Size(context.Background(), "a"); err != nil {
+		t.Fatal(err)
+	}
+	nextContext(t, slow)
+	if err := nextContext(t, fast).Err(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("winning Size attempt: got %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestMirrorHedgedReadFailsOver(t *testing.T) {
+	// The next store is tried as soon as one fails, without waiting out the
+	// delay.
+	m, replicas := makeFaultyMirror(2,
+		store.WithReadStrategy(store.Hedged(store.PrimaryFirst(), time.Hour)))
+	put(t, replicas[1], "a", []byte("hello"))
+	replicas[0].readErr = errFault
+
+	expectContents(t, m, "a", []byte("hello"))
+}
+
+func TestMirrorHealth(t *testing.T) {
+	m, replicas := makeFaultyMirror(2, store.WithHealthTracking(2, time.Hour))
+	bad, good := replicas[0], replicas[1]
+	for _, r := range replicas {
+		put(t, r, "a", []byte("a"))
+	}
+	bad.readErr = errFault
+
+	// The failing store keeps being tried first until it reaches the
+	// threshold.
+	for range 4 {
+		expectContents(t, m, "a", []byte("a"))
+	}
+	if n := bad.reads.Load(); n != 2 {
+		t.Fatalf("failing store read %d times, want 2", n)
+	}
+	if n := good.reads.Load(); n != 4 {
+		t.Fatalf("healthy store read %d times, want 4", n)
+	}
+
+	// Missing objects say nothing about a store's health.
+	m, replicas = makeFaultyMirror(2, store.WithHealthTracking(1, time.Hour))
+	for range 2 {
+		if _, err := read(m, "missing"); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("reading a missing object: %v", err)
+		}
+	}
+	if n := replicas[0].reads.Load(); n != 2 {
+		t.Fatalf("first store read %d times, want 2", n)
+	}
+}
+
+func TestMirrorHealthCooldown(t *testing.T) {
+	m, replicas := makeFaultyMirror(2, store.WithHealthTracking(1, 20*time.Millisecond))
+	bad := replicas[0]
+	for _, r := range replicas {
+		put(t, r, "a", []byte("a"))
+	}
+	bad.readErr = errFault
+
+	expectContents(t, m, "a", []byte("a"))
+	expectContents(t, m, "a", []byte("a"))
+	if n := bad.reads.Load(); n != 1 {
+		t.Fatalf("failing store read %d times during its cooldown, want 1", n)
+	}
+
+	// After the cooldown the store gets another chance, and a success
+	// makes it healthy again.
+	time.Sleep(50 * time.Millisecond)
+	bad.readErr = nil
+	for range 2 {
+		expectContents(t, m, "a", []byte("a"))
+	}
+	if n := bad.reads.Load(); n != 3 {
+		t.Fatalf("recovered store read %d times, want 3", n)
+	}
+	if n := replicas[1].reads.Load(); n != 2 {
+		t.Fatalf("second store read %d times, want 2", n)
+	}
+}
@@ -0,0 +1,413 @@
+// Package pgstore implements a store.Store that keeps objects in the
+// application's Postgres database, so that small installs need no data
+// directory and a single database backup captures the whole instance.
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"time"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// Objects are split into chunks of this many bytes, each stored in its own
+// row, so that reads can fetch any part of an object without loading all of
+// it.
+const PG_CHUNK_SIZE = 256 * 1024
+
+var ErrObjectChanged = errors.New("Object changed while it was being read")
+
+// A DB is a connection pool, or any other handle that can be used
+// concurrently, to the database holding the store's tables.
+type DB interface {
+	db.DBTX
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// A PgStore keeps objects in the store_objects and blob_chunks tables created
+// by the application's migrations.
+//
+// Every write stores its chunks under a new object ID and then points the
+// object's path at them, all in one transaction, so that readers never see a
+// partially written object. Writes and deletions of the same path are
+// serialized with an advisory lock. Reads fetch one chunk at a time, and
+// refuse to continue if the object is replaced in the meantime.
+type PgStore struct {
+	conn DB
+	q    *db.Queries
+	url  string
+}
+
+var _ store.Store = (*PgStore)(nil)
+var _ store.Lister = (*PgStore)(nil)
+
+// Options of the "postgres" store type.
+type pgOptions struct {
+	// Connection string of a database the store opens its own pool to.
+	URL      string `mapstructure:"url"`
+	MaxConns int32  `mapstructure:"max_conns"`
+	// Pool of the database to use instead of opening one. Filled in with the
+	// application's own pool when the url is left out of a storage
+	// configuration file; it cannot be given in the file itself.
+	Pool DB `mapstructure:"pool"`
+}
+
+func init() {
+	store.Register("postgres", func(spec *store.Spec) (store.Builder, error) {
+		if err := spec.ExpectStores(0, 0); err != nil {
+			return nil, err
+		}
+
+		var opts pgOptions
+		if err := spec.Decode(&opts); err != nil {
+			return nil, err
+		}
+		if opts.MaxConns < 0 {
+			return nil, fmt.Errorf(
+				"%w: max_conns must not be negative",
+				store.ErrInvalidSpec,
+			)
+		}
+
+		if opts.Pool != nil {
+			if opts.URL != "" || opts.MaxConns != 0 {
+				return nil, fmt.Errorf(
+					"%w: url and max_conns cannot be combined with pool",
+					store.ErrInvalidSpec,
+				)
+			}
+
+			return func([]store.Store) (store.Store, error) {
+				return MakePgStore(opts.Pool), nil
+			}, nil
+		}
+		if opts.URL == "" {
+			return nil, fmt.Errorf("%w: url is required", store.ErrInvalidSpec)
+		}
+
+		poolCfg, err := pgxpool.ParseConfig(opts.URL)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", store.ErrInvalidSpec, err)
+		}
+		if opts.MaxConns > 0 {
+			poolCfg.MaxConns = opts.MaxConns
+		}
+
+		return func([]store.Store) (store.Store, error) {
+			// Connections are only opened once they are needed.
+			pool, err := pgxpool.NewWithConfig(context.Background(), poolCfg)
+			if err != nil {
+				return nil, err
+			}
+
+			return MakePgStore(pool), nil
+		}, nil
+	})
+}
+
+// Returns a store that keeps objects in the database behind conn.
+func MakePgStore(conn DB) *PgStore {
+	return &PgStore{
+		conn: conn,
+		q:    db.New(conn),
+	}
+}
+
+type txKey struct{}
+
+// Returns a context under which the store runs its queries in tx rather than
+// on connections of its own, so that a caller holding a connection of a
+// shared pool never waits for a second one. Writes and deletions become
+// savepoints of tx and take effect when tx commits. Since tx cannot be used
+// concurrently, at most one store operation may run under the context at a
+// time, and readers must be closed before tx ends.
+func WithTx(ctx context.Context, tx pgx.Tx) context.Context {
+	return context.WithValue(ctx, txKey{}, tx)
+}
+
+// Begins a transaction, or a savepoint of the caller's transaction.
+func (s *PgStore) begin(ctx context.Context) (pgx.Tx, error) {
+	if tx, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		return tx.Begin(ctx)
+	}
+	return s.conn.Begin(ctx)
+}
+
+// Returns the queries to run outside of a transaction of the store's own.
+func (s *PgStore) queries(ctx context.Context) *db.Queries {
+	if tx, ok := ctx.Value(txKey{}).(pgx.Tx); ok {
+		return s.q.WithTx(tx)
+	}
+	return s.q
+}
+
+func (s *PgStore) BaseURL() string {
+	return s.url
+}
+
+func (s *PgStore) Store(ctx context.Context, r io.Reader, path string) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+	qtx := s.q.WithTx(tx)
+
+	if err := qtx.LockStorePath(ctx, path); err != nil {
+		return err
+	}
+
+	id, err := qtx.NextStoreObjectID(ctx)
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, PG_CHUNK_SIZE)
+	size := int64(0)
+	for idx := int32(0); ; idx++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if err := qtx.InsertBlobChunk(ctx, db.InsertBlobChunkParams{
+				ObjectID: id,
+				Idx:      idx,
+				Data:     buf[:n],
+			}); err != nil {
+				return err
+			}
+			size += int64(n)
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	old, err := qtx.GetStoreObject(ctx, path)
+	switch {
+	case err == nil:
+		if err := qtx.DeleteBlobChunks(ctx, old.ObjectID); err != nil {
+			return err
+		}
+	case !errors.Is(err, pgx.ErrNoRows):
+		return err
+	}
+
+	if err := qtx.PutStoreObject(ctx, db.PutStoreObjectParams{
+		Path:      path,
+		ObjectID:  id,
+		Size:      size,
+		ChunkSize: PG_CHUNK_SIZE,
+	}); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (s *PgStore) Delete(ctx context.Context, path string) error {
+	tx, err := s.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(context.WithoutCancel(ctx))
+	qtx := s.q.WithTx(tx)
+
+	if err := qtx.LockStorePath(ctx, path); err != nil {
+		return err
+	}
+
+	obj, err := qtx.DeleteStoreObject(ctx, path)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return notExist("remove", path)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := qtx.DeleteBlobChunks(ctx, obj.ObjectID); err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+func (s *PgStore) Retrieve(
+	ctx context.Context,
+	path string,
+) (store.ObjectReader, error) {
+	obj, err := s.stat(ctx, "open", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pgReader{
+		ctx:   ctx,
+		s:     s,
+		obj:   obj,
+		chunk: -1,
+	}, nil
+}
+
+func (s *PgStore) Size(ctx context.Context, path string) (int64, error) {
+	obj, err := s.stat(ctx, "stat", path)
+	if err != nil {
+		return 0, err
+	}
+
+	return obj.Size, nil
+}
+
+func (s *PgStore) ModTime(
+	ctx context.Context,
+	path string,
+) (time.Time, error) {
+	obj, err := s.stat(ctx, "stat", path)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return obj.ModTime.Time, nil
+}
+
+func (s *PgStore) List(
+	ctx context.Context,
+	prefix, cursor string,
+	limit int,
+) ([]store.ObjectInfo, string, error) {
+	if limit <= 0 {
+		limit = store.DEFAULT_LIST_PAGE_SIZE
+	}
+
+	rows, err := s.queries(ctx).ListStoreObjects(ctx, db.ListStoreObjectsParams{
+		Prefix: prefix,
+		Cursor: cursor,
+		Limit:  int32(limit),
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	objs := make([]store.ObjectInfo, len(rows))
+	for i, row := range rows {
+		objs[i] = store.ObjectInfo{
+			Path:    row.Path,
+			Size:    row.Size,
+			ModTime: row.ModTime.Time,
+		}
+	}
+
+	next := ""
+	if len(objs) >= limit {
+		next = objs[len(objs)-1].Path
+	}
+
+	return objs, next, nil
+}
+
+func (s *PgStore) stat(
+	ctx context.Context,
+	op, path string,
+) (*db.StoreObject, error) {
+	obj, err := s.queries(ctx).GetStoreObject(ctx, path)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, notExist(op, path)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return obj, nil
+}
+
+func notExist(op, path string) error {
+	return &fs.PathError{Op: op, Path: path, Err: fs.ErrNotExist}
+}
+
+// Reads an object one chunk at a time, keeping the chunk that was read last.
+type pgReader struct {
+	ctx    context.Context
+	s      *PgStore
+	obj    *db.StoreObject
+	offset int64
+	chunk  int64
+	data   []byte
+}
+
+func (r *pgReader) Read(p []byte) (int, error) {
+	if r.offset >= r.obj.Size {
+		return 0, io.EOF
+	}
+
+	chunkSize := int64(r.obj.ChunkSize)
+	idx := r.offset / chunkSize
+	if idx != r.chunk {
+		data, err := r.s.queries(r.ctx).GetBlobChunk(r.ctx, db.GetBlobChunkParams{
+			ObjectID: r.obj.ObjectID,
+			Idx:      int32(idx),
+		})
+		if errors.Is(err, pgx.ErrNoRows) {
+			// The chunks of an object are only deleted once it has been
+			// replaced or deleted.
+			return 0, &fs.PathError{
+				Op:   "read",
+				Path: r.obj.Path,
+				Err:  ErrObjectChanged,
+			}
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		r.chunk = idx
+		r.data = data
+	}
+
+	start := r.offset - idx*chunkSize
+	if start >= int64(len(r.data)) {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	n := copy(p, r.data[start:])
+	r.offset += int64(n)
+
+	return n, nil
+}
+
+func (r *pgReader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.offset + offset
+	case io.SeekEnd:
+		abs = r.obj.Size + offset
+	default:
+		return 0, errors.New("pgstore: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("pgstore: negative position")
+	}
+
+	r.offset = abs
+
+	return abs, nil
+}
+
+func (r *pgReader) Close() error {
+	r.data = nil
+	return nil
+}
@@ -0,0 +1,108 @@
+package pgstore_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/Fekinox/dogbox-main/internal/dbtest"
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/pgstore"
+	"github.com/Fekinox/dogbox-main/internal/store/storetest"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+func TestPgStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return pgstore.MakePgStore(dbtest.New(t))
+	})
+}
+
+func TestObjectChanged(t *testing.T) {
+	ctx := context.Background()
+	s := pgstore.MakePgStore(dbtest.New(t))
+
+	data := bytes.Repeat([]byte("a"), 2*pgstore.PG_CHUNK_SIZE)
+	if err := s.Store(ctx, bytes.NewReader(data), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Retrieve(ctx, "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Read into the first chunk, then replace the object before the second
+	// one is fetched.
+	if _, err := io.ReadFull(r, make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Store(ctx, bytes.NewReader(data), "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = io.ReadAll(r)
+	if !errors.Is(err, pgstore.ErrObjectChanged) {
+		t.Fatalf("reading replaced object: got %v, want %v", err, pgstore.ErrObjectChanged)
+	}
+}
+
+// Returns a pool to the same database that hands out a single connection.
+func singleConnPool(t *testing.T) *pgxpool.Pool {
+	cfg := dbtest.New(t).Config()
+	cfg.MaxConns = 1
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(pool.Close)
+	return pool
+}
+
+func TestWithTx(t *testing.T) {
+	for _, commit := range []bool{true, false} {
+		pool := singleConnPool(t)
+		s := pgstore.MakePgStore(pool)
+
+		// With the only connection taken by tx, the store can only make
+		// progress by joining it.
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		tx, err := pool.Begin(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txCtx := pgstore.WithTx(ctx, tx)
+
+		if err := s.Store(txCtx, bytes.NewReader([]byte("hello")), "a"); err != nil {
+			t.Fatalf("Store: %v", err)
+		}
+		if size, err := s.Size(txCtx, "a"); err != nil || size != 5 {
+			t.Fatalf("Size in tx = %d, %v; want 5", size, err)
+		}
+
+		if commit {
+			err = tx.Commit(ctx)
+		} else {
+			err = tx.Rollback(ctx)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.Size(ctx, "a")
+		if commit && err != nil {
+			t.Fatalf("Size after commit: %v", err)
+		}
+		if !commit && !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("Size after rollback: got %v, want %v", err, fs.ErrNotExist)
+		}
+	}
+}
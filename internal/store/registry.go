@@ -0,0 +1,232 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/mitchellh/mapstructure"
+)
+
+var ErrInvalidSpec = errors.New("Invalid store configuration")
+
+// A Spec is the declarative description of a store: its type, the stores it
+// is built on, and the options of its type.
+type Spec struct {
+	Type string
+	// The stores this store is built on, in order.
+	Stores []*Spec
+	// The remaining configuration, decoded by the type's Factory.
+	Options map[string]any
+}
+
+// Turns a decoded YAML or JSON object into a Spec. The object has a "type",
+// either a single "store" or a list of "stores" it is built on, and any
+// number of options.
+func ParseSpec(raw map[string]any) (*Spec, error) {
+	spec := &Spec{Options: make(map[string]any)}
+
+	for k, v := range raw {
+		switch k {
+		case "type":
+			typ, ok := v.(string)
+			if !ok {
+				return nil, fmt.Errorf("%w: type must be a string", ErrInvalidSpec)
+			}
+			spec.Type = typ
+		case "store":
+			child, err := parseChild(v)
+			if err != nil {
+				return nil, fmt.Errorf("store: %w", err)
+			}
+			spec.Stores = append(spec.Stores, child)
+		case "stores":
+			list, ok := v.([]any)
+			if !ok {
+				return nil, fmt.Errorf("%w: stores must be a list", ErrInvalidSpec)
+			}
+			for i, item := range list {
+				child, err := parseChild(item)
+				if err != nil {
+					return nil, fmt.Errorf("stores[%d]: %w", i, err)
+				}
+				spec.Stores = append(spec.Stores, child)
+			}
+		default:
+			spec.Options[k] = v
+		}
+	}
+
+	if _, ok := raw["store"]; ok {
+		if _, ok := raw["stores"]; ok {
+			return nil, fmt.Errorf(
+				"%w: only one of store and stores may be given",
+				ErrInvalidSpec,
+			)
+		}
+	}
+	if spec.Type == "" {
+		return nil, fmt.Errorf("%w: missing type", ErrInvalidSpec)
+	}
+
+	return spec, nil
+}
+
+func parseChild(v any) (*Spec, error) {
+	raw, ok := v.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%w: expected an object", ErrInvalidSpec)
+	}
+	return ParseSpec(raw)
+}
+
+// Decodes the spec's options into the struct pointed to by dst, using the
+// struct's mapstructure tags. Unknown options are an error, and durations
+// may be given as strings such as "30s".
+func (s *Spec) Decode(dst any) error {
+	dec, err := mapstructure.NewDecoder(&mapstructure.DecoderConfig{
+		DecodeHook:       mapstructure.StringToTimeDurationHookFunc(),
+		ErrorUnused:      true,
+		WeaklyTypedInput: true,
+		Result:           dst,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := dec.Decode(s.Options); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSpec, err)
+	}
+	return nil
+}
+
+// Checks that the spec is built on at least min and at most max stores. A
+// negative max means there is no upper limit.
+func (s *Spec) ExpectStores(min, max int) error {
+	n := len(s.Stores)
+	if n >= min && (max < 0 || n <= max) {
+		return nil
+	}
+
+	switch {
+	case min == max:
+		return fmt.Errorf("%w: %s needs %d store(s), got %d",
+			ErrInvalidSpec, s.Type, min, n)
+	case max < 0:
+		return fmt.Errorf("%w: %s needs at least %d store(s), got %d",
+			ErrInvalidSpec, s.Type, min, n)
+	default:
+		return fmt.Errorf("%w: %s needs %d to %d stores, got %d",
+			ErrInvalidSpec, s.Type, min, max, n)
+	}
+}
+
+// Returns every spec of the given type in the tree rooted at s, in depth-first
+// order.
+func (s *Spec) Find(typ string) []*Spec {
+	var found []*Spec
+	if s.Type == typ {
+		found = append(found, s)
+	}
+	for _, child := range s.Stores {
+		found = append(found, child.Find(typ)...)
+	}
+
+	return found
+}
+
+// A Builder creates a store on top of the already built stores its Spec
+// lists.
+type Builder func(stores []Store) (Store, error)
+
+// A Factory checks a Spec of its type and returns the Builder for it. Every
+// configuration error should be reported here rather than by the Builder, so
+// that a configuration can be validated without creating any store.
+type Factory func(spec *Spec) (Builder, error)
+
+var (
+	factoriesMu sync.RWMutex
+	factories   = make(map[string]Factory)
+)
+
+// Makes a store type available to specs. Backends register themselves from
+// an init function. Registering the same type twice panics.
+func Register(typ string, f Factory) {
+	factoriesMu.Lock()
+	defer factoriesMu.Unlock()
+
+	if _, ok := factories[typ]; ok {
+		panic("store: Register called twice for type " + typ)
+	}
+	factories[typ] = f
+}
+
+// Returns the registered store types, sorted.
+func Types() []string {
+	factoriesMu.RLock()
+	defer factoriesMu.RUnlock()
+
+	types := make([]string, 0, len(factories))
+	for typ := range factories {
+		types = append(types, typ)
+	}
+	slices.Sort(types)
+
+	return types
+}
+
+// Checks the whole tree of specs without creating any store.
+func Validate(spec *Spec) error {
+	_, err := prepare(spec)
+	return err
+}
+
+// Validates the tree of specs, then creates its stores from the inside out.
+func Build(spec *Spec) (Store, error) {
+	build, err := prepare(spec)
+	if err != nil {
+		return nil, err
+	}
+
+	return build()
+}
+
+func prepare(spec *Spec) (func() (Store, error), error) {
+	factoriesMu.RLock()
+	f, ok := factories[spec.Type]
+	factoriesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown type %q", ErrInvalidSpec, spec.Type)
+	}
+
+	builder, err := f(spec)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", spec.Type, err)
+	}
+
+	children := make([]func() (Store, error), len(spec.Stores))
+	for i, child := range spec.Stores {
+		children[i], err = prepare(child)
+		if err != nil {
+			return nil, fmt.Errorf("%s: stores[%d]: %w", spec.Type, i, err)
+		}
+	}
+
+	return func() (Store, error) {
+		stores := make([]Store, len(children))
+		for i, build := range children {
+			st, err := build()
+			if err != nil {
+				return nil, err
+			}
+			stores[i] = st
+		}
+
+		st, err := builder(stores)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", spec.Type, err)
+		}
+		return st, nil
+	}, nil
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+
+	"golang.org/x/time/rate"
+)
+
+var (
+	ErrNoHealthyReplica = errors.New("No replica holds an intact copy")
+	ErrNotRewrappable   = errors.New(
+		"Mirror sits below a wrapper that cannot be applied to its replicas",
+	)
+)
+
+// The outcome of checking a single object across a mirror's backing stores.
+// Replicas are identified by their index in the mirror's stores list.
+type RepairResult struct {
+	Path string
+	// Replicas that did not hold the object.
+	Missing []int
+	// Replicas whose copy did not match the expected hash.
+	Corrupt []int
+	// Replicas that were given a fresh copy of the object.
+	Repaired []int
+	// Bytes read and written while checking and repairing the object.
+	Bytes int64
+}
+
+// Finds the mirror in the chain of wrappers starting at s. Also returns a
+// function that wraps one of the mirror's backing stores in every wrapper
+// above the mirror, so that its objects read the same as they do through s.
+// Returns a nil mirror if there is none, and ErrNotRewrappable if one of the
+// wrappers above it cannot wrap another store.
+func FindMirror(s Store) (*Mirror, func(Store) Store, error) {
+	var above []Rewrapper
+	for s != nil {
+		if m, ok := s.(*Mirror); ok {
+			view := func(st Store) Store {
+				for i := len(above) - 1; i >= 0; i-- {
+					st = above[i].Rewrap(st)
+				}
+				return st
+			}
+			return m, view, nil
+		}
+
+		w, ok := s.(Wrapper)
+		if !ok {
+			break
+		}
+		if rw, ok := w.(Rewrapper); ok {
+			above = append(above, rw)
+		} else if _, ok := As[*Mirror](s); ok {
+			return nil, nil, ErrNotRewrappable
+		}
+		s = w.Unwrap()
+	}
+
+	return nil, nil, nil
+}
+
+// Checks every backing store of the mirror for the object at path, and
+// re-copies it from an intact replica to every store where it is missing or
+// where its SHA-256 does not match wantHash. Replicas are hashed as seen
+// through view, which undoes whatever the wrappers above the mirror did to
+// the stored bytes; a nil view hashes them as they are. Copies are made of
+// the stored bytes. All reads and writes are throttled by the limiter, which
+// counts bytes; a nil limiter does not throttle.
+func (m *Mirror) Repair(
+	ctx context.Context,
+	path string,
+	wantHash string,
+	view func(Store) Store,
+	lim *rate.Limiter,
+) (RepairResult, error) {
+	res := RepairResult{Path: path}
+	source := -1
+
+	for i, st := range m.stores {
+		if view != nil {
+			st = view(st)
+		}
+
+		hash, n, err := HashObject(ctx, st, path, lim)
+		res.Bytes += n
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			res.Missing = append(res.Missing, i)
+		case isCorruption(err):
+			res.Corrupt = append(res.Corrupt, i)
+		case err != nil:
+			return res, ReplicaError{Index: i, Err: err}
+		case hash != wantHash:
+			res.Corrupt = append(res.Corrupt, i)
+		case source < 0:
+			source = i
+		}
+	}
+
+	broken := append(append([]int{}, res.Missing...), res.Corrupt...)
+	if len(broken) == 0 {
+		return res, nil
+	}
+	if source < 0 {
+		return res, fmt.Errorf("%s: %w", path, ErrNoHealthyReplica)
+	}
+
+	for _, i := range broken {
+		n, err := copyThrottled(ctx, m.stores[source], m.stores[i], path, lim)
+		res.Bytes += n
+		if err != nil {
+			return res, ReplicaError{Index: i, Err: err}
+		}
+		res.Repaired = append(res.Repaired, i)
+	}
+
+	return res, nil
+}
+
+// Reports whether a read failed because the stored bytes could not be decoded.
+func isCorruption(err error) bool {
+	var flateErr flate.CorruptInputError
+	return errors.Is(err, ErrCorruptObject) ||
+		errors.Is(err, errCorruptIndex) ||
+		errors.Is(err, gzip.ErrChecksum) ||
+		errors.Is(err, gzip.ErrHeader) ||
+		errors.As(err, &flateErr)
+}
+
+// Returns the hex-encoded SHA-256 of the object at path and the number of
+// bytes read, reading no faster than the limiter allows. A nil limiter does
+// not throttle.
+func HashObject(
+	ctx context.Context,
+	s Store,
+	path string,
+	lim *rate.Limiter,
+) (string, int64, error) {
+	r, err := s.Retrieve(ctx, path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer r.Close()
+
+	hasher := sha256.New()
+	n, err := ContextCopy(ctx, hasher, Throttle(ctx, r, lim))
+	if err != nil {
+		return "", n, err
+	}
+
+	return hex.EncodeToString(hasher.Sum(nil)), n, nil
+}
+
+// Copies the object at path from one store to another, returning the number
+// of bytes transferred.
+func copyThrottled(
+	ctx context.Context,
+	src, dst Store,
+	path string,
+	lim *rate.Limiter,
+) (int64, error) {
+	r, err := src.Retrieve(ctx, path)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	cr := &countingReader{r: Throttle(ctx, r, lim)}
+	err = dst.Store(ctx, cr, path)
+
+	return cr.n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type throttledReader struct {
+	ctx context.Context
+	r   io.Reader
+	lim *rate.Limiter
+}
+
+// Wraps the reader so that it reads no faster than the limiter allows, where
+// each token is one byte. A nil limiter returns the reader unchanged.
+func Throttle(ctx context.Context, r io.Reader, lim *rate.Limiter) io.Reader {
+	if lim == nil {
+		return r
+	}
+	return &throttledReader{ctx: ctx, r: r, lim: lim}
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if burst := t.lim.Burst(); burst > 0 && len(p) > burst {
+		p = p[:burst]
+	}
+
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.lim.WaitN(t.ctx, n); werr != nil {
+			return n, werr
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,581 @@
+// Package sftpstore implements a store.Store on top of an SFTP server.
+package sftpstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/google/uuid"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const DEFAULT_POOL_SIZE = 4
+const DEFAULT_DIAL_TIMEOUT = 30 * time.Second
+
+var ErrNoHostKey = errors.New("SFTP host key or known_hosts file required")
+
+// An SFTPStore keeps objects as files under a root directory on an SFTP
+// server.
+//
+// Requests are spread over a fixed pool of SSH connections, each of which
+// multiplexes any number of concurrent requests. A connection that fails is
+// dropped and dialed again on next use, and requests that can safely be
+// repeated are retried once on a fresh connection.
+//
+// Writes are uploaded to a temporary name next to their destination and then
+// renamed into place, so that readers never see a partially written object.
+type SFTPStore struct {
+	addr   string
+	root   string
+	url    string
+	config *ssh.ClientConfig
+
+	dialTimeout time.Duration
+	slots       []*slot
+	next        atomic.Uint64
+}
+
+var _ store.Store = (*SFTPStore)(nil)
+var _ store.Lister = (*SFTPStore)(nil)
+
+// One connection of the pool. A nil conn is dialed on next use.
+type slot struct {
+	mu   sync.Mutex
+	conn *conn
+}
+
+type conn struct {
+	ssh  *ssh.Client
+	sftp *sftp.Client
+}
+
+type SFTPOption func(*SFTPStore)
+
+// Sets the number of SSH connections the store keeps open.
+func WithPoolSize(n int) SFTPOption {
+	return func(s *SFTPStore) {
+		s.slots = make([]*slot, max(1, n))
+	}
+}
+
+func WithDialTimeout(timeout time.Duration) SFTPOption {
+	return func(s *SFTPStore) {
+		s.dialTimeout = timeout
+	}
+}
+
+// Options of the "sftp" store type.
+type sftpOptions struct {
+	Addr string `mapstructure:"addr"`
+	User string `mapstructure:"user"`
+	// Path of the private key used to log in.
+	KeyFile string `mapstructure:"key_file"`
+	// Path of an OpenSSH known_hosts file listing the server's key.
+	KnownHosts string `mapstructure:"known_hosts"`
+	// The server's public key, in authorized_keys format. An alternative to
+	// KnownHosts.
+	HostKey     string        `mapstructure:"host_key"`
+	Root        string        `mapstructure:"root"`
+	PoolSize    int           `mapstructure:"pool_size"`
+	DialTimeout time.Duration `mapstructure:"dial_timeout"`
+}
+
+func init() {
+	store.Register("sftp", func(spec *store.Spec) (store.Builder, error) {
+		if err := spec.ExpectStores(0, 0); err != nil {
+			return nil, err
+		}
+
+		opts := sftpOptions{
+			PoolSize:    DEFAULT_POOL_SIZE,
+			DialTimeout: DEFAULT_DIAL_TIMEOUT,
+		}
+		if err := spec.Decode(&opts); err != nil {
+			return nil, err
+		}
+		if opts.Addr == "" || opts.User == "" || opts.KeyFile == "" {
+			return nil, fmt.Errorf(
+				"%w: addr, user and key_file are required",
+				store.ErrInvalidSpec,
+			)
+		}
+
+		config, err := ClientConfig(
+			opts.User,
+			opts.KeyFile,
+			opts.KnownHosts,
+			opts.HostKey,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", store.ErrInvalidSpec, err)
+		}
+
+		return func([]store.Store) (store.Store, error) {
+			return MakeSFTPStore(
+				opts.Addr,
+				config,
+				opts.Root,
+				WithPoolSize(opts.PoolSize),
+				WithDialTimeout(opts.DialTimeout),
+			), nil
+		}, nil
+	})
+}
+
+// Builds an SSH client configuration that logs in as user with the private
+// key in keyFile. The server's key is checked against the known_hosts file
+// at knownHosts, or against hostKey, given in authorized_keys format.
+func ClientConfig(
+	user, keyFile, knownHosts, hostKey string,
+) (*ssh.ClientConfig, error) {
+	pem, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", keyFile, err)
+	}
+
+	var callback ssh.HostKeyCallback
+	switch {
+	case knownHosts != "":
+		callback, err = knownhosts.New(knownHosts)
+		if err != nil {
+			return nil, err
+		}
+	case hostKey != "":
+		key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+		if err != nil {
+			return nil, fmt.Errorf("host key: %w", err)
+		}
+		callback = ssh.FixedHostKey(key)
+	default:
+		return nil, ErrNoHostKey
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: callback,
+	}, nil
+}
+
+// Returns a store that keeps objects under root on the SFTP server at addr.
+// Connections are dialed when they are first needed.
+func MakeSFTPStore(
+	addr string,
+	config *ssh.ClientConfig,
+	root string,
+	opts ...SFTPOption,
+) *SFTPStore {
+	s := &SFTPStore{
+		addr:        addr,
+		root:        root,
+		config:      config,
+		dialTimeout: DEFAULT_DIAL_TIMEOUT,
+		slots:       make([]*slot, DEFAULT_POOL_SIZE),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	for i := range s.slots {
+		s.slots[i] = &slot{}
+	}
+
+	return s
+}
+
+// Closes every open connection. The store dials new connections if it is
+// used again.
+func (s *SFTPStore) Close() error {
+	var errs []error
+	for _, sl := range s.slots {
+		sl.mu.Lock()
+		if sl.conn != nil {
+			errs = append(errs, sl.conn.close())
+			sl.conn = nil
+		}
+		sl.mu.Unlock()
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *SFTPStore) BaseURL() string {
+	return s.url
+}
+
+func (s *SFTPStore) Store(ctx context.Context, r io.Reader, p string) error {
+	dst := s.getPath(p)
+	tmp := dst + "-" + uuid.NewString() + ".tmp"
+
+	// The upload consumes r, so it cannot be retried.
+	return s.with(ctx, false, func(c *sftp.Client) error {
+		if err := c.MkdirAll(path.Dir(dst)); err != nil {
+			return err
+		}
+
+		f, err := c.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+		if err != nil {
+			return err
+		}
+
+		_, err = store.ContextCopy(ctx, f, sourceReader{r})
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = rename(c, tmp, dst)
+		}
+		if err != nil {
+			c.Remove(tmp)
+			return err
+		}
+
+		return nil
+	})
+}
+
+// Renames oldname to newname, replacing newname if it exists. Without the
+// posix-rename extension, the replacement is not atomic: newname is briefly
+// missing.
+func rename(c *sftp.Client, oldname, newname string) error {
+	if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+		return c.PosixRename(oldname, newname)
+	}
+
+	if err := c.Remove(newname); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return c.Rename(oldname, newname)
+}
+
+func (s *SFTPStore) Delete(ctx context.Context, p string) error {
+	return s.with(ctx, true, func(c *sftp.Client) error {
+		return pathError("remove", p, c.Remove(s.getPath(p)))
+	})
+}
+
+func (s *SFTPStore) Retrieve(
+	ctx context.Context,
+	p string,
+) (store.ObjectReader, error) {
+	var f *sftp.File
+	err := s.with(ctx, true, func(c *sftp.Client) error {
+		var err error
+		f, err = c.Open(s.getPath(p))
+		return pathError("open", p, err)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+func (s *SFTPStore) stat(ctx context.Context, p string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	err := s.with(ctx, true, func(c *sftp.Client) error {
+		var err error
+		info, err = c.Stat(s.getPath(p))
+		if err == nil && info.IsDir() {
+			err = fs.ErrNotExist
+		}
+		return pathError("stat", p, err)
+	})
+
+	return info, err
+}
+
+func (s *SFTPStore) Size(ctx context.Context, p string) (int64, error) {
+	info, err := s.stat(ctx, p)
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+func (s *SFTPStore) ModTime(ctx context.Context, p string) (time.Time, error) {
+	info, err := s.stat(ctx, p)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return info.ModTime(), nil
+}
+
+// Lists the files under the store's root, one directory at a time.
+// Directories that sort entirely before the cursor or cannot contain the
+// prefix are not read.
+func (s *SFTPStore) List(
+	ctx context.Context,
+	prefix, cursor string,
+	limit int,
+) ([]store.ObjectInfo, string, error) {
+	if limit <= 0 {
+		limit = store.DEFAULT_LIST_PAGE_SIZE
+	}
+
+	var objs []store.ObjectInfo
+	err := s.with(ctx, true, func(c *sftp.Client) error {
+		objs = objs[:0]
+
+		var walk func(dir string) error
+		walk = func(dir string) error {
+			entries, err := c.ReadDirContext(ctx, s.getPath(dir))
+			if errors.Is(err, fs.ErrNotExist) && dir == "" {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			slices.SortFunc(entries, func(a, b fs.FileInfo) int {
+				return strings.Compare(a.Name(), b.Name())
+			})
+
+			for _, e := range entries {
+				rel := path.Join(dir, e.Name())
+
+				if e.IsDir() {
+					if !strings.HasPrefix(rel+"/", prefix) &&
+						!strings.HasPrefix(prefix, rel+"/") {
+						continue
+					}
+					if cursor != "" && store.ComparePaths(rel, cursor) < 0 &&
+						!strings.HasPrefix(cursor, rel+"/") {
+						continue
+					}
+					if err := walk(rel); err != nil {
+						return err
+					}
+				} else {
+					if !strings.HasPrefix(rel, prefix) || isTempPath(rel) {
+						continue
+					}
+					if cursor != "" && store.ComparePaths(rel, cursor) <= 0 {
+						continue
+					}
+					objs = append(objs, store.ObjectInfo{
+						Path:    rel,
+						Size:    e.Size(),
+						ModTime: e.ModTime(),
+					})
+				}
+
+				if len(objs) == limit {
+					return errLimitReached
+				}
+			}
+
+			return nil
+		}
+
+		err := walk("")
+		if errors.Is(err, errLimitReached) {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	next := ""
+	if len(objs) == limit {
+		next = objs[len(objs)-1].Path
+	}
+
+	return objs, next, nil
+}
+
+var errLimitReached = errors.New("limit reached")
+
+// Runs fn with a client from the pool. If the connection fails, it is
+// dropped, and fn is run once more on a new connection if it is safe to
+// repeat.
+func (s *SFTPStore) with(
+	ctx context.Context,
+	retry bool,
+	fn func(*sftp.Client) error,
+) error {
+	sl := s.slots[s.next.Add(1)%uint64(len(s.slots))]
+
+	for attempt := 0; ; attempt++ {
+		c, err := sl.get(ctx, s)
+		if err != nil {
+			return err
+		}
+
+		err = fn(c.sftp)
+		if !isConnError(err) {
+			return err
+		}
+
+		sl.drop(c)
+		if !retry || attempt > 0 || ctx.Err() != nil {
+			return err
+		}
+	}
+}
+
+// Returns the slot's connection, dialing it if necessary.
+func (sl *slot) get(ctx context.Context, s *SFTPStore) (*conn, error) {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+
+	if sl.conn != nil {
+		return sl.conn, nil
+	}
+
+	c, err := s.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sl.conn = c
+
+	// Notice connections that the server closes while they are idle.
+	go func() {
+		c.ssh.Wait()
+		sl.drop(c)
+	}()
+
+	return c, nil
+}
+
+// Closes the connection and removes it from the slot, unless it has already
+// been replaced.
+func (sl *slot) drop(c *conn) {
+	sl.mu.Lock()
+	if sl.conn == c {
+		sl.conn = nil
+	}
+	sl.mu.Unlock()
+
+	c.close()
+}
+
+func (s *SFTPStore) dial(ctx context.Context) (*conn, error) {
+	dialCtx, cancel := context.WithTimeout(ctx, s.dialTimeout)
+	defer cancel()
+
+	var d net.Dialer
+	nc, err := d.DialContext(dialCtx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The SSH handshake does not take a context.
+	if deadline, ok := dialCtx.Deadline(); ok {
+		nc.SetDeadline(deadline)
+	}
+	sc, chans, reqs, err := ssh.NewClientConn(nc, s.addr, s.config)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	nc.SetDeadline(time.Time{})
+
+	sshClient := ssh.NewClient(sc, chans, reqs)
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		sshClient.Close()
+		return nil, err
+	}
+
+	return &conn{ssh: sshClient, sftp: sftpClient}, nil
+}
+
+func (c *conn) close() error {
+	c.sftp.Close()
+	return c.ssh.Close()
+}
+
+// Marks errors returned by the reader an object is uploaded from, which say
+// nothing about the connection.
+type sourceError struct {
+	error
+}
+
+func (e sourceError) Unwrap() error {
+	return e.error
+}
+
+type sourceReader struct {
+	r io.Reader
+}
+
+func (s sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = sourceError{err}
+	}
+	return n, err
+}
+
+// Reports whether err means that the connection it happened on is unusable.
+// Errors reported by the server about the request itself are not.
+func isConnError(err error) bool {
+	var srcErr sourceError
+	if err == nil ||
+		errors.As(err, &srcErr) ||
+		errors.Is(err, fs.ErrNotExist) ||
+		errors.Is(err, fs.ErrExist) ||
+		errors.Is(err, fs.ErrPermission) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var se *sftp.StatusError
+	if errors.As(err, &se) {
+		return se.FxCode() == sftp.ErrSSHFxConnectionLost ||
+			se.FxCode() == sftp.ErrSSHFxNoConnection
+	}
+
+	return true
+}
+
+func (s *SFTPStore) getPath(p string) string {
+	return path.Join(s.root, p)
+}
+
+// Reports whether the given path is an upload that has not been renamed into
+// place yet.
+func isTempPath(p string) bool {
+	base, ok := strings.CutSuffix(path.Base(p), ".tmp")
+	if !ok || len(base) < 37 || base[len(base)-37] != '-' {
+		return false
+	}
+
+	_, err := uuid.Parse(base[len(base)-36:])
+	return err == nil
+}
+
+// Reports errors in terms of the object's path rather than its location on
+// the server.
+func pathError(op, p string, err error) error {
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+	return err
+}
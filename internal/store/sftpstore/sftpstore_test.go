@@ -0,0 +1,194 @@
+package sftpstore_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"sync"
+	"testing"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/sftpstore"
+	"github.com/Fekinox/dogbox-main/internal/store/storetest"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// An in-process SFTP server that serves the local file system to a single
+// client key.
+type testServer struct {
+	addr   string
+	client *ssh.ClientConfig
+
+	mu       sync.Mutex
+	conns    []net.Conn
+	accepted int
+}
+
+func newSigner(t *testing.T) ssh.Signer {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func startServer(t *testing.T) *testServer {
+	hostKey := newSigner(t)
+	clientKey := newSigner(t)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(
+			_ ssh.ConnMetadata,
+			key ssh.PublicKey,
+		) (*ssh.Permissions, error) {
+			if !bytes.Equal(key.Marshal(), clientKey.PublicKey().Marshal()) {
+				return nil, ssh.ErrNoAuth
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostKey)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := &testServer{
+		addr: l.Addr().String(),
+		client: &ssh.ClientConfig{
+			User:            "dogbox",
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(clientKey)},
+			HostKeyCallback: ssh.FixedHostKey(hostKey.PublicKey()),
+		},
+	}
+	t.Cleanup(func() {
+		l.Close()
+		srv.dropConnections()
+	})
+
+	go func() {
+		for {
+			nc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			srv.mu.Lock()
+			srv.conns = append(srv.conns, nc)
+			srv.accepted++
+			srv.mu.Unlock()
+
+			go serveConn(nc, config)
+		}
+	}()
+
+	return srv
+}
+
+func serveConn(nc net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(nc, config)
+	if err != nil {
+		nc.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for nch := range chans {
+		if nch.ChannelType() != "session" {
+			nch.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		ch, reqs, err := nch.Accept()
+		if err != nil {
+			continue
+		}
+
+		go func() {
+			for req := range reqs {
+				// The payload is the subsystem name as an SSH string.
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 &&
+					string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+
+				server, err := sftp.NewServer(ch)
+				if err != nil {
+					ch.Close()
+					return
+				}
+				server.Serve()
+				server.Close()
+				return
+			}
+		}()
+	}
+}
+
+// Closes every connection the server has accepted so far.
+func (srv *testServer) dropConnections() {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	for _, nc := range srv.conns {
+		nc.Close()
+	}
+	srv.conns = nil
+}
+
+func (srv *testServer) acceptedConnections() int {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	return srv.accepted
+}
+
+func TestSFTPStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		srv := startServer(t)
+		s := sftpstore.MakeSFTPStore(srv.addr, srv.client, t.TempDir())
+		t.Cleanup(func() { s.Close() })
+		return s
+	})
+}
+
+func TestReconnectAfterDroppedConnection(t *testing.T) {
+	ctx := context.Background()
+	srv := startServer(t)
+	s := sftpstore.MakeSFTPStore(
+		srv.addr,
+		srv.client,
+		t.TempDir(),
+		sftpstore.WithPoolSize(1),
+	)
+	t.Cleanup(func() { s.Close() })
+
+	data := []byte("hello, dogbox")
+	if err := s.Store(ctx, bytes.NewReader(data), "a.txt"); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+	if n := srv.acceptedConnections(); n != 1 {
+		t.Fatalf("server accepted %d connections, want 1", n)
+	}
+
+	srv.dropConnections()
+
+	size, err := s.Size(ctx, "a.txt")
+	if err != nil {
+		t.Fatalf("Size after dropped connection: %v", err)
+	}
+	if size != int64(len(data)) {
+		t.Fatalf("Size = %d, want %d", size, len(data))
+	}
+	if n := srv.acceptedConnections(); n != 2 {
+		t.Fatalf("server accepted %d connections, want 2", n)
+	}
+}
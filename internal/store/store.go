@@ -1,14 +1,23 @@
 package store
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"io"
 	"path/filepath"
+	"slices"
+	"strings"
 	"time"
 )
 
 const CTX_COPY_BUF_SIZE int64 = 32 * 1024
+const DEFAULT_LIST_PAGE_SIZE = 1000
+
+var (
+	ErrListingUnsupported = errors.New("Store does not support listing")
+	ErrWriteAborted       = errors.New("Write aborted")
+)
 
 type ObjectReader interface {
 	io.Reader
@@ -16,37 +25,187 @@ type ObjectReader interface {
 	io.Closer
 }
 
-type ObjectWriter struct {
-	*io.PipeWriter
-}
-
 type Store interface {
 	// Returns the base URL where images in the store are served from.
 	BaseURL() string
 	// Write the contents of the io.Reader into the store at the given
 	// location. If a file exists at that location, it should be overwritten.
 	// Writes should be atomic- either the file is completely written to the
-	// store
-	Store(r io.Reader, path string) error
+	// store or nothing is. If the context is canceled before the write
+	// completes, the write is abandoned and the location left untouched.
+	Store(ctx context.Context, r io.Reader, path string) error
 
 	// Delete the file at the given path.
-	Delete(path string) error
+	Delete(ctx context.Context, path string) error
 
 	// Returns an object that reads the file at the given string.
-	Retrieve(path string) (ObjectReader, error)
+	Retrieve(ctx context.Context, path string) (ObjectReader, error)
+
+	Size(ctx context.Context, path string) (int64, error)
+	ModTime(ctx context.Context, path string) (time.Time, error)
+}
+
+type noTransformKey struct{}
+
+// Marks writes made with the returned context as opaque: the written bytes
+// must be stored exactly as given, without being inspected, compressed or
+// otherwise transformed. Encryption at rest still applies, since it is undone
+// on every read.
+func WithNoTransform(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noTransformKey{}, true)
+}
 
-	Size(path string) (int64, error)
-	ModTime(path string) (time.Time, error)
+// Reports whether writes made with the context must not be transformed.
+func NoTransform(ctx context.Context) bool {
+	v, _ := ctx.Value(noTransformKey{}).(bool)
+	return v
 }
 
-func Copy(s Store, src, dst string) error {
-	reader, err := s.Retrieve(src)
+type noCacheKey struct{}
+
+// Marks reads made with the returned context as bypassing any cache: they are
+// served by the backing store, and leave the cache as it was. Meant for jobs
+// that read every object once, such as integrity checks.
+func WithNoCache(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noCacheKey{}, true)
+}
+
+// Reports whether reads made with the context must bypass caches.
+func NoCache(ctx context.Context) bool {
+	v, _ := ctx.Value(noCacheKey{}).(bool)
+	return v
+}
+
+// A Wrapper is a Store that decorates a single backing store.
+type Wrapper interface {
+	Unwrap() Store
+}
+
+// A Rewrapper is a Wrapper that can decorate another store the same way, so
+// that the objects of a store further down the chain can be read as they look
+// from above it. Wrappers that do not transform objects return the store as
+// is.
+type Rewrapper interface {
+	Wrapper
+	Rewrap(inner Store) Store
+}
+
+// Finds the first store of type T, which may also be an interface such as
+// EncodedRetriever, in the chain of wrappers starting at s.
+func As[T any](s Store) (T, bool) {
+	for s != nil {
+		if t, ok := s.(T); ok {
+			return t, true
+		}
+
+		w, ok := s.(Wrapper)
+		if !ok {
+			break
+		}
+		s = w.Unwrap()
+	}
+
+	var zero T
+	return zero, false
+}
+
+// Information about a single object in a store.
+type ObjectInfo struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	// Hex-encoded SHA-256 of the object, if the backend can provide it
+	// without reading the object. Empty otherwise.
+	Hash string `json:"hash,omitempty"`
+}
+
+// A Lister is a Store that can enumerate the objects it holds.
+type Lister interface {
+	// Returns up to limit objects whose paths start with prefix, in the
+	// order defined by ComparePaths, starting strictly after cursor. An empty
+	// cursor starts from the beginning. The returned cursor is passed to the
+	// next call to continue the listing; it is empty once there is nothing
+	// left to list.
+	List(
+		ctx context.Context,
+		prefix, cursor string,
+		limit int,
+	) ([]ObjectInfo, string, error)
+}
+
+// Calls fn on every object in the store whose path starts with prefix,
+// fetching the listing one page at a time. Stops at the first error returned
+// by fn.
+func Walk(
+	ctx context.Context,
+	s Store,
+	prefix string,
+	fn func(ObjectInfo) error,
+) error {
+	l, ok := s.(Lister)
+	if !ok {
+		return ErrListingUnsupported
+	}
+
+	cursor := ""
+	for {
+		objs, next, err := l.List(ctx, prefix, cursor, DEFAULT_LIST_PAGE_SIZE)
+		if err != nil {
+			return err
+		}
+
+		for _, o := range objs {
+			if err := fn(o); err != nil {
+				return err
+			}
+		}
+
+		if next == "" {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// Compares two slash-separated paths component by component, so that every
+// path in a directory sorts before the paths following that directory. This
+// is the order in which listings are returned.
+func ComparePaths(a, b string) int {
+	as := strings.Split(a, "/")
+	bs := strings.Split(b, "/")
+
+	for i := 0; i < len(as) && i < len(bs); i++ {
+		if c := strings.Compare(as[i], bs[i]); c != 0 {
+			return c
+		}
+	}
+
+	return cmp.Compare(len(as), len(bs))
+}
+
+func Copy(ctx context.Context, s Store, src, dst string) error {
+	return Transfer(ctx, s, src, s, dst)
+}
+
+func Move(ctx context.Context, s Store, src, dst string) error {
+	return TransferMove(ctx, s, src, s, dst)
+}
+
+// Copies the object at srcPath in one store to dstPath in another.
+func Transfer(
+	ctx context.Context,
+	src Store,
+	srcPath string,
+	dst Store,
+	dstPath string,
+) error {
+	reader, err := src.Retrieve(ctx, srcPath)
 	if err != nil {
 		return err
 	}
 	defer reader.Close()
 
-	err = s.Store(reader, dst)
+	err = dst.Store(ctx, reader, dstPath)
 
 	if err != nil {
 		return err
@@ -55,12 +214,20 @@ func Copy(s Store, src, dst string) error {
 	return nil
 }
 
-func Move(s Store, src, dst string) error {
-	err := Copy(s, src, dst)
+// Copies the object at srcPath in one store to dstPath in another, then
+// deletes the original.
+func TransferMove(
+	ctx context.Context,
+	src Store,
+	srcPath string,
+	dst Store,
+	dstPath string,
+) error {
+	err := Transfer(ctx, src, srcPath, dst, dstPath)
 	if err != nil {
 		return err
 	}
-	return s.Delete(src)
+	return src.Delete(ctx, srcPath)
 }
 
 func FileURL(s Store, path string) string {
@@ -93,18 +260,54 @@ func ContextCopy(
 	}
 }
 
-func NewWriter(s Store, path string) *ObjectWriter {
-	r, w := io.Pipe()
-	go func() {
-		err := s.Store(r, path)
+// Lists the union of the objects held by every store in the list that
+// supports listing. When several stores hold the same path, the information
+// from the earliest store in the list is returned.
+func mergeListings(
+	ctx context.Context,
+	stores []Store,
+	prefix, cursor string,
+	limit int,
+) ([]ObjectInfo, string, error) {
+	if limit <= 0 {
+		limit = DEFAULT_LIST_PAGE_SIZE
+	}
+
+	var all []ObjectInfo
+	listed := false
+	for _, st := range stores {
+		l, ok := st.(Lister)
+		if !ok {
+			continue
+		}
+		listed = true
+
+		// Every object within the first limit entries of the union is also
+		// within the first limit entries of its own store, so one page from
+		// each store is enough.
+		objs, _, err := l.List(ctx, prefix, cursor, limit)
 		if err != nil {
-			r.CloseWithError(err)
-			return
+			return nil, "", err
 		}
-		r.Close()
-	}()
+		all = append(all, objs...)
+	}
 
-	return &ObjectWriter{
-		w,
+	if !listed {
+		return nil, "", ErrListingUnsupported
 	}
+
+	slices.SortStableFunc(all, func(a, b ObjectInfo) int {
+		return ComparePaths(a.Path, b.Path)
+	})
+	all = slices.CompactFunc(all, func(a, b ObjectInfo) bool {
+		return a.Path == b.Path
+	})
+
+	next := ""
+	if len(all) >= limit {
+		all = all[:limit]
+		next = all[len(all)-1].Path
+	}
+
+	return all, next, nil
 }
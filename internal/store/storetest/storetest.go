@@ -0,0 +1,583 @@
+// Package storetest checks that a store.Store implementation keeps the
+// promises of the store.Store interface. Backends run the suite from their
+// tests:
+//
+//	func TestConformance(t *testing.T) {
+//		storetest.Run(t, func(t *testing.T) store.Store {
+//			return store.MakeLocalStore(t.TempDir())
+//		})
+//	}
+package storetest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math/rand"
+	"sync"
+	"testing"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+)
+
+// Size of the object written by the large file test. Not a multiple of any
+// common buffer or chunk size, so that partial final chunks are exercised.
+const LARGE_OBJECT_SIZE = 8*1024*1024 + 12345
+
+// Number of goroutines used by the concurrency tests.
+const CONCURRENCY = 16
+
+// Creates an empty store for a single test. Cleanup, if any, should be
+// registered with t.Cleanup.
+type Factory func(t *testing.T) store.Store
+
+// Runs the conformance suite against stores created by newStore. Every test
+// gets a store of its own. Listing is only tested if the store implements
+// store.Lister.
+func Run(t *testing.T, newStore Factory) {
+	tests := []struct {
+		name string
+		fn   func(*testing.T, store.Store)
+	}{
+		{"RoundTrip", testRoundTrip},
+		{"NestedPaths", testNestedPaths},
+		{"Overwrite", testOverwrite},
+		{"Delete", testDelete},
+		{"MissingPaths", testMissingPaths},
+		{"Seek", testSeek},
+		{"LargeObject", testLargeObject},
+		{"FailedWriteKeepsOldObject", testFailedWriteKeepsOld},
+		{"FailedWriteLeavesNothing", testFailedWriteLeavesNothing},
+		{"CanceledWrite", testCanceledWrite},
+		{"ConcurrentWrites", testConcurrentWrites},
+		{"ConcurrentOverwrites", testConcurrentOverwrites},
+		{"ConcurrentReads", testConcurrentReads},
+		{"List", testList},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newStore(t))
+		})
+	}
+}
+
+func testRoundTrip(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	data := []byte("hello, dogbox")
+
+	mustStore(t, s, "images/a.txt", data)
+	expectContents(t, s, "images/a.txt", data)
+
+	size, err := s.Size(ctx, "images/a.txt")
+	if err != nil {
+		t.Fatalf("Size: %v", err)
+	}
+	if size != int64(len(data)) {
+		t.Errorf("Size = %d, want %d", size, len(data))
+	}
+
+	modTime, err := s.ModTime(ctx, "images/a.txt")
+	if err != nil {
+		t.Fatalf("ModTime: %v", err)
+	}
+	if modTime.IsZero() {
+		t.Errorf("ModTime is zero")
+	}
+
+	mustStore(t, s, "images/empty.txt", nil)
+	expectContents(t, s, "images/empty.txt", nil)
+}
+
+func testNestedPaths(t *testing.T, s store.Store) {
+	paths := []string{"a/b/c/d.txt", "a/b/e.txt", "a/f.txt", "g.txt"}
+	for _, p := range paths {
+		mustStore(t, s, p, []byte(p))
+	}
+	for _, p := range paths {
+		expectContents(t, s, p, []byte(p))
+	}
+}
+
+func testOverwrite(t *testing.T, s store.Store) {
+	ctx := context.Background()
+
+	mustStore(t, s, "images/a.txt", []byte("a much longer first version"))
+	mustStore(t, s, "images/a.txt", []byte("second"))
+	expectContents(t, s, "images/a.txt", []byte("second"))
+
+	size, err := s.Size(ctx, "images/a.txt")
+	if err != nil {
+		t.Fatalf("Size: %v", err)
+	}
+	if size != int64(len("second")) {
+		t.Errorf("Size after overwrite = %d, want %d", size, len("second"))
+	}
+}
+
+func testDelete(t *testing.T, s store.Store) {
+	ctx := context.Background()
+
+	mustStore(t, s, "images/a.txt", []byte("a"))
+	mustStore(t, s, "images/b.txt", []byte("b"))
+
+	if err := s.Delete(ctx, "images/a.txt"); err != nil {
+		t.Fatalf("Delete: %v", err)
+	}
+	expectMissing(t, s, "images/a.txt")
+	expectContents(t, s, "images/b.txt", []byte("b"))
+
+	// A deleted path can be written again.
+	mustStore(t, s, "images/a.txt", []byte("again"))
+	expectContents(t, s, "images/a.txt", []byte("again"))
+}
+
+func testMissingPaths(t *testing.T, s store.Store) {
+	ctx := context.Background()
+
+	expectMissing(t, s, "images/missing.txt")
+	expectMissing(t, s, "missing/dir/file.txt")
+
+	err := s.Delete(ctx, "images/missing.txt")
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Delete of missing path: got %v, want fs.ErrNotExist", err)
+	}
+}
+
+func testSeek(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	data := randomBytes(1, 100_000)
+	mustStore(t, s, "images/seek.bin", data)
+
+	r, err := s.Retrieve(ctx, "images/seek.bin")
+	if err != nil {
+		t.Fatalf("Retrieve: %v", err)
+	}
+	defer r.Close()
+
+	end, err := r.Seek(0, io.SeekEnd)
+	if err != nil {
+		t.Fatalf("Seek to end: %v", err)
+	}
+	if end != int64(len(data)) {
+		t.Fatalf("Seek to end = %d, want %d", end, len(data))
+	}
+
+	seeks := []struct {
+		offset int64
+		whence int
+		want   int64
+	}{
+		{50_000, io.SeekStart, 50_000},
+		{-1000, io.SeekEnd, int64(len(data)) - 1000},
+		{0, io.SeekStart, 0},
+		{70_001, io.SeekStart, 70_001},
+		{-20_000, io.SeekCurrent, 50_001 + 100},
+	}
+	for _, sk := range seeks {
+		pos, err := r.Seek(sk.offset, sk.whence)
+		if err != nil {
+			t.Fatalf("Seek(%d, %d): %v", sk.offset, sk.whence, err)
+		}
+		if pos != sk.want {
+			t.Fatalf("Seek(%d, %d) = %d, want %d", sk.offset, sk.whence, pos, sk.want)
+		}
+
+		buf := make([]byte, 100)
+		n, err := io.ReadFull(r, buf)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("Read at %d: %v", pos, err)
+		}
+		if !bytes.Equal(buf[:n], data[pos:min(pos+100, int64(len(data)))]) {
+			t.Fatalf("Read at %d returned the wrong bytes", pos)
+		}
+	}
+
+	// Reading at the end of the object returns io.EOF.
+	if _, err := r.Seek(0, io.SeekEnd); err != nil {
+		t.Fatalf("Seek to end: %v", err)
+	}
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		t.Errorf("Read at end = %d, %v, want 0, io.EOF", n, err)
+	}
+}
+
+func testLargeObject(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	data := randomBytes(2, LARGE_OBJECT_SIZE)
+
+	// Hide the size and the underlying bytes from the store.
+	r := io.MultiReader(bytes.NewReader(data))
+	if err := s.Store(ctx, r, "images/large.bin"); err != nil {
+		t.Fatalf("Store: %v", err)
+	}
+
+	obj, err := s.Retrieve(ctx, "images/large.bin")
+	if err != nil {
+		t.Fatalf("Retrieve: %v", err)
+	}
+	defer obj.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, obj); err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if want := sha256.Sum256(data); !bytes.Equal(h.Sum(nil), want[:]) {
+		t.Fatalf("large object was corrupted")
+	}
+
+	size, err := s.Size(ctx, "images/large.bin")
+	if err != nil {
+		t.Fatalf("Size: %v", err)
+	}
+	if size != LARGE_OBJECT_SIZE {
+		t.Errorf("Size = %d, want %d", size, LARGE_OBJECT_SIZE)
+	}
+}
+
+var errReaderFailed = errors.New("storetest: reader failed")
+
+// Returns a reader that yields the first n bytes of data and then fails.
+func failingReader(data []byte, n int) io.Reader {
+	return io.MultiReader(
+		bytes.NewReader(data[:n]),
+		errReader{errReaderFailed},
+	)
+}
+
+type errReader struct {
+	err error
+}
+
+func (r errReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func testFailedWriteKeepsOld(t *testing.T, s store.Store) {
+	ctx := context.Background()
+	old := []byte("the original contents")
+	mustStore(t, s, "images/a.txt", old)
+
+	data := randomBytes(3, 1024*1024)
+	err := s.Store(ctx, failingReader(data, len(data)/2), "images/a.txt")
+	if err == nil {
+		t.Fatalf("Store with failing reader succeeded")
+	}
+
+	expectContents(t, s, "images/a.txt", old)
+}
+
+func testFailedWriteLeavesNothing(t *testing.T, s store.Store) {
+	ctx := context.Background()
+
+	data := randomBytes(4, 1024*1024)
+	err := s.Store(ctx, failingReader(data, len(data)/2), "images/a.txt")
+	if err == nil {
+		t.Fatalf("Store with failing reader succeeded")
+	}
+
+	expectMissing(t, s, "images/a.txt")
+	expectListed(t, s, "images/", nil)
+}
+
+// A reader that cancels a context once it has been read from a few times.
+type cancelingReader struct {
+	r      io.Reader
+	reads  int
+	cancel context.CancelFunc
+}
+
+func (c *cancelingReader) Read(p []byte) (int, error) {
+	c.reads++
+	if c.reads == 3 {
+		c.cancel()
+	}
+	return c.r.Read(p)
+}
+
+func testCanceledWrite(t *testing.T, s store.Store) {
+	old := []byte("the original contents")
+	mustStore(t, s, "images/a.txt", old)
+
+	for _, path := range []string{"images/a.txt", "images/b.txt"} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		// Large enough to take more than a few reads with any buffer size
+		// a store is likely to use.
+		data := randomBytes(5, 4*1024*1024)
+		r := &cancelingReader{
+			r:      slowReader{bytes.NewReader(data)},
+			cancel: cancel,
+		}
+
+		err := s.Store(ctx, r, path)
+		cancel()
+		if err == nil {
+			t.Fatalf("Store of %s with canceled context succeeded", path)
+		}
+	}
+
+	expectContents(t, s, "images/a.txt", old)
+	expectMissing(t, s, "images/b.txt")
+}
+
+// Returns at most 1KiB per read.
+type slowReader struct {
+	r io.Reader
+}
+
+func (r slowReader) Read(p []byte) (int, error) {
+	return r.r.Read(p[:min(len(p), 1024)])
+}
+
+func testConcurrentWrites(t *testing.T, s store.Store) {
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	errs := make([]error, CONCURRENCY)
+	for i := range CONCURRENCY {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			path := fmt.Sprintf("images/%02d.bin", i)
+			r := bytes.NewReader(randomBytes(int64(i), 64*1024))
+			errs[i] = s.Store(ctx, r, path)
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Store %d: %v", i, err)
+		}
+	}
+	for i := range CONCURRENCY {
+		path := fmt.Sprintf("images/%02d.bin", i)
+		expectContents(t, s, path, randomBytes(int64(i), 64*1024))
+	}
+}
+
+func testConcurrentOverwrites(t *testing.T, s store.Store) {
+	ctx := context.Background()
+
+	versions := make([][]byte, CONCURRENCY)
+	for i := range versions {
+		versions[i] = randomBytes(int64(100+i), 256*1024)
+	}
+
+	var wg sync.WaitGroup
+	errs := make([]error, CONCURRENCY)
+	for i := range CONCURRENCY {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := slowReader{bytes.NewReader(versions[i])}
+			errs[i] = s.Store(ctx, r, "images/a.bin")
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("Store %d: %v", i, err)
+		}
+	}
+
+	// The object has to be exactly one of the versions, never a mix.
+	got := readAll(t, s, "images/a.bin")
+	for _, v := range versions {
+		if bytes.Equal(got, v) {
+			return
+		}
+	}
+	t.Fatalf("concurrent overwrites left an object matching no write")
+}
+
+func testConcurrentReads(t *testing.T, s store.Store) {
+	data := randomBytes(6, 512*1024)
+	mustStore(t, s, "images/a.bin", data)
+
+	var wg sync.WaitGroup
+	failed := make(chan string, CONCURRENCY)
+	for range CONCURRENCY {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := s.Retrieve(context.Background(), "images/a.bin")
+			if err != nil {
+				failed <- err.Error()
+				return
+			}
+			defer r.Close()
+
+			got, err := io.ReadAll(slowReader{r})
+			if err != nil {
+				failed <- err.Error()
+				return
+			}
+			if !bytes.Equal(got, data) {
+				failed <- "concurrent read returned the wrong bytes"
+			}
+		}()
+	}
+	wg.Wait()
+	close(failed)
+
+	for msg := range failed {
+		t.Error(msg)
+	}
+}
+
+func testList(t *testing.T, s store.Store) {
+	if _, ok := s.(store.Lister); !ok {
+		t.Skip("store does not implement store.Lister")
+	}
+
+	paths := []string{
+		"images/b.txt",
+		"images/a.txt",
+		"images/sub/c.txt",
+		"images/c.txt",
+		"other/d.txt",
+	}
+	for _, p := range paths {
+		mustStore(t, s, p, []byte(p))
+	}
+
+	expectListed(t, s, "images/", []string{
+		"images/a.txt",
+		"images/b.txt",
+		"images/c.txt",
+		"images/sub/c.txt",
+	})
+	expectListed(t, s, "", []string{
+		"images/a.txt",
+		"images/b.txt",
+		"images/c.txt",
+		"images/sub/c.txt",
+		"other/d.txt",
+	})
+	expectListed(t, s, "nothing/", nil)
+
+	// Paging one object at a time has to return the same listing.
+	l := s.(store.Lister)
+	var paged []string
+	cursor := ""
+	for range len(paths) + 1 {
+		objs, next, err := l.List(context.Background(), "", cursor, 1)
+		if err != nil {
+			t.Fatalf("List: %v", err)
+		}
+		for _, o := range objs {
+			paged = append(paged, o.Path)
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if fmt.Sprint(paged) != fmt.Sprint([]string{
+		"images/a.txt",
+		"images/b.txt",
+		"images/c.txt",
+		"images/sub/c.txt",
+		"other/d.txt",
+	}) {
+		t.Errorf("paged listing = %v", paged)
+	}
+}
+
+func mustStore(t *testing.T, s store.Store, path string, data []byte) {
+	t.Helper()
+
+	err := s.Store(context.Background(), bytes.NewReader(data), path)
+	if err != nil {
+		t.Fatalf("Store %s: %v", path, err)
+	}
+}
+
+func readAll(t *testing.T, s store.Store, path string) []byte {
+	t.Helper()
+
+	r, err := s.Retrieve(context.Background(), path)
+	if err != nil {
+		t.Fatalf("Retrieve %s: %v", path, err)
+	}
+	defer r.Close()
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatalf("Read %s: %v", path, err)
+	}
+
+	return data
+}
+
+func expectContents(t *testing.T, s store.Store, path string, want []byte) {
+	t.Helper()
+
+	if got := readAll(t, s, path); !bytes.Equal(got, want) {
+		t.Fatalf(
+			"%s: got %d bytes, want %d matching bytes",
+			path,
+			len(got),
+			len(want),
+		)
+	}
+}
+
+func expectMissing(t *testing.T, s store.Store, path string) {
+	t.Helper()
+	ctx := context.Background()
+
+	r, err := s.Retrieve(ctx, path)
+	if err == nil {
+		r.Close()
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Retrieve %s: got %v, want fs.ErrNotExist", path, err)
+	}
+	if _, err := s.Size(ctx, path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Size %s: got %v, want fs.ErrNotExist", path, err)
+	}
+	if _, err := s.ModTime(ctx, path); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("ModTime %s: got %v, want fs.ErrNotExist", path, err)
+	}
+}
+
+// Checks the full listing of prefix, if the store supports listing.
+func expectListed(t *testing.T, s store.Store, prefix string, want []string) {
+	t.Helper()
+
+	if _, ok := s.(store.Lister); !ok {
+		return
+	}
+
+	var got []string
+	err := store.Walk(
+		context.Background(),
+		s,
+		prefix,
+		func(o store.ObjectInfo) error {
+			got = append(got, o.Path)
+			return nil
+		},
+	)
+	if err != nil {
+		t.Fatalf("List %q: %v", prefix, err)
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("List %q = %v, want %v", prefix, got, want)
+	}
+}
+
+// Returns n pseudo-random bytes, the same for every call with the same seed.
+func randomBytes(seed int64, n int) []byte {
+	data := make([]byte, n)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
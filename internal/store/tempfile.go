@@ -3,6 +3,7 @@ package store
 import (
 	"os"
 	"path/filepath"
+	"strings"
 
 	"github.com/google/uuid"
 )
@@ -50,3 +51,14 @@ func (t *TempFile) Save(path string) error {
 	t.closed = true
 	return os.Rename(t.Path, path)
 }
+
+// Reports whether the given file name was generated by CreateTempFile.
+func isTempFile(name string) bool {
+	base, ok := strings.CutSuffix(filepath.Base(name), ".tmp")
+	if !ok || len(base) < 37 || base[len(base)-37] != '-' {
+		return false
+	}
+
+	_, err := uuid.Parse(base[len(base)-36:])
+	return err == nil
+}
@@ -0,0 +1,157 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"time"
+)
+
+// A TieredStore splits objects between a fast hot store and a cheaper cold
+// store. New objects are always written to the hot store, and objects are
+// moved to the cold store with Demote once they are no longer in demand.
+// Reads check the hot store first and fall back to the cold store, so callers
+// do not need to know which tier an object is in.
+type TieredStore struct {
+	hot  Store
+	cold Store
+}
+
+var _ Store = (*TieredStore)(nil)
+var _ Lister = (*TieredStore)(nil)
+
+func init() {
+	// Built on the hot store, then the cold store.
+	Register("tiered", func(spec *Spec) (Builder, error) {
+		if err := spec.ExpectStores(2, 2); err != nil {
+			return nil, err
+		}
+		if err := spec.Decode(&struct{}{}); err != nil {
+			return nil, err
+		}
+
+		return func(stores []Store) (Store, error) {
+			return MakeTieredStore(stores[0], stores[1]), nil
+		}, nil
+	})
+}
+
+func MakeTieredStore(hot, cold Store) *TieredStore {
+	return &TieredStore{
+		hot:  hot,
+		cold: cold,
+	}
+}
+
+func (t *TieredStore) BaseURL() string {
+	return t.hot.BaseURL()
+}
+
+func (t *TieredStore) Store(
+	ctx context.Context,
+	r io.Reader,
+	path string,
+) error {
+	if err := t.hot.Store(ctx, r, path); err != nil {
+		return err
+	}
+
+	// An older copy in the cold tier is shadowed by the new one, so failing
+	// to remove it only wastes space.
+	t.cold.Delete(ctx, path)
+
+	return nil
+}
+
+// Deletes the object from both tiers. The object only counts as missing if
+// neither tier held it.
+func (t *TieredStore) Delete(ctx context.Context, path string) error {
+	var errs []error
+	missing := 0
+	for _, st := range []Store{t.hot, t.cold} {
+		err := st.Delete(ctx, path)
+		switch {
+		case errors.Is(err, fs.ErrNotExist):
+			missing++
+		case err != nil:
+			errs = append(errs, err)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if missing == 2 {
+		return &fs.PathError{Op: "delete", Path: path, Err: fs.ErrNotExist}
+	}
+
+	return nil
+}
+
+func (t *TieredStore) Retrieve(
+	ctx context.Context,
+	path string,
+) (ObjectReader, error) {
+	r, err := t.hot.Retrieve(ctx, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return t.cold.Retrieve(ctx, path)
+	}
+	return r, err
+}
+
+func (t *TieredStore) Size(ctx context.Context, path string) (int64, error) {
+	size, err := t.hot.Size(ctx, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return t.cold.Size(ctx, path)
+	}
+	return size, err
+}
+
+func (t *TieredStore) ModTime(
+	ctx context.Context,
+	path string,
+) (time.Time, error) {
+	modTime, err := t.hot.ModTime(ctx, path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return t.cold.ModTime(ctx, path)
+	}
+	return modTime, err
+}
+
+// Lists the objects of both tiers.
+func (t *TieredStore) List(
+	ctx context.Context,
+	prefix, cursor string,
+	limit int,
+) ([]ObjectInfo, string, error) {
+	return mergeListings(ctx, []Store{t.hot, t.cold}, prefix, cursor, limit)
+}
+
+// Reports whether the object is held by the cold tier only.
+func (t *TieredStore) IsCold(ctx context.Context, path string) (bool, error) {
+	_, err := t.hot.Size(ctx, path)
+	if err == nil {
+		return false, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return false, err
+	}
+
+	if _, err := t.cold.Size(ctx, path); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Moves the object from the hot tier to the cold tier. The object stays
+// readable throughout, since it is only removed from the hot tier once the
+// cold copy is complete.
+func (t *TieredStore) Demote(ctx context.Context, path string) error {
+	return TransferMove(ctx, t.hot, path, t.cold, path)
+}
+
+// Moves the object from the cold tier back to the hot tier.
+func (t *TieredStore) Promote(ctx context.Context, path string) error {
+	return TransferMove(ctx, t.cold, path, t.hot, path)
+}
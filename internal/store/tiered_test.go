@@ -0,0 +1,109 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"testing"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/memstore"
+	"github.com/Fekinox/dogbox-main/internal/store/storetest"
+)
+
+func TestTieredStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return store.MakeTieredStore(memstore.MakeMemStore(), memstore.MakeMemStore())
+	})
+}
+
+func TestTieredMoves(t *testing.T) {
+	ctx := context.Background()
+	hot, cold := memstore.MakeMemStore(), memstore.MakeMemStore()
+	s := store.MakeTieredStore(hot, cold)
+	data := []byte("hello")
+
+	put(t, s, "a", data)
+	expectContents(t, hot, "a", data)
+	expectMissing(t, cold, "a")
+
+	if cold, err := s.IsCold(ctx, "a"); err != nil || cold {
+		t.Fatalf("IsCold before demotion = %v, %v", cold, err)
+	}
+
+	if err := s.Demote(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	expectMissing(t, hot, "a")
+	expectContents(t, cold, "a", data)
+	if cold, err := s.IsCold(ctx, "a"); err != nil || !cold {
+		t.Fatalf("IsCold after demotion = %v, %v", cold, err)
+	}
+	expectContents(t, s, "a", data)
+	if size, err := s.Size(ctx, "a"); err != nil || size != int64(len(data)) {
+		t.Fatalf("Size = %d, %v; want %d", size, err, len(data))
+	}
+	if _, err := s.ModTime(ctx, "a"); err != nil {
+		t.Fatalf("ModTime: %v", err)
+	}
+
+	if err := s.Promote(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	expectContents(t, hot, "a", data)
+	expectMissing(t, cold, "a")
+
+	if _, err := s.IsCold(ctx, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("IsCold of a missing object: got %v, want %v", err, fs.ErrNotExist)
+	}
+	if err := s.Demote(ctx, "missing"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("demoting a missing object: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
+
+func TestTieredWriteReplacesColdCopy(t *testing.T) {
+	ctx := context.Background()
+	hot, cold := memstore.MakeMemStore(), memstore.MakeMemStore()
+	s := store.MakeTieredStore(hot, cold)
+
+	put(t, s, "a", []byte("old"))
+	if err := s.Demote(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	put(t, s, "a", []byte("new"))
+	expectContents(t, s, "a", []byte("new"))
+	expectContents(t, hot, "a", []byte("new"))
+	expectMissing(t, cold, "a")
+}
+
+func TestTieredDelete(t *testing.T) {
+	ctx := context.Background()
+	hot, cold := memstore.MakeMemStore(), memstore.MakeMemStore()
+	s := store.MakeTieredStore(hot, cold)
+
+	// A copy in each tier, as left by a demotion that was cut short.
+	put(t, hot, "a", []byte("a"))
+	put(t, cold, "a", []byte("a"))
+	put(t, cold, "b", []byte("b"))
+
+	objects, _, err := s.List(ctx, "", "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 2 {
+		t.Fatalf("listed %d objects, want 2", len(objects))
+	}
+
+	for _, path := range []string{"a", "b"} {
+		if err := s.Delete(ctx, path); err != nil {
+			t.Fatalf("Delete(%q): %v", path, err)
+		}
+		expectMissing(t, hot, path)
+		expectMissing(t, cold, path)
+	}
+
+	if err := s.Delete(ctx, "a"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("deleting a missing object: got %v, want %v", err, fs.ErrNotExist)
+	}
+}
@@ -0,0 +1,72 @@
+package store
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// An ObjectWriter streams data into a store. The data only becomes visible at
+// the destination once Commit returns successfully; until then the write can
+// be abandoned with Abort. One of the two must always be called, otherwise
+// the goroutine running the underlying Store call is leaked.
+type ObjectWriter struct {
+	pw     *io.PipeWriter
+	cancel context.CancelFunc
+	done   chan struct{}
+	once   sync.Once
+	err    error
+}
+
+// Returns a writer whose contents are stored at the given path. Canceling
+// the context aborts the underlying Store call, after which writes fail.
+func NewWriter(ctx context.Context, s Store, path string) *ObjectWriter {
+	ctx, cancel := context.WithCancel(ctx)
+	pr, pw := io.Pipe()
+
+	w := &ObjectWriter{
+		pw:     pw,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+		w.err = s.Store(ctx, pr, path)
+		// Unblock any pending writes if the store stopped reading early.
+		pr.CloseWithError(w.err)
+	}()
+
+	return w
+}
+
+func (w *ObjectWriter) Write(p []byte) (int, error) {
+	return w.pw.Write(p)
+}
+
+// Marks the end of the data and blocks until the store has finished writing
+// it, returning the error reported by the store. Once Commit returns nil the
+// object is durable and a later Abort has no effect.
+func (w *ObjectWriter) Commit() error {
+	return w.finish(nil)
+}
+
+// Abandons the write and blocks until the store has given up on it, so that
+// nothing is left at the destination. Calling Abort after Commit is a no-op,
+// which makes it safe to defer.
+func (w *ObjectWriter) Abort() {
+	w.finish(ErrWriteAborted)
+}
+
+func (w *ObjectWriter) finish(cause error) error {
+	w.once.Do(func() {
+		if cause != nil {
+			w.cancel()
+		}
+		w.pw.CloseWithError(cause)
+		<-w.done
+		w.cancel()
+	})
+
+	return w.err
+}
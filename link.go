@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Longest target URL accepted, in bytes.
+const MAX_LINK_LENGTH = 2048
+
+var (
+	InvalidLinkError = errors.New(
+		"Links need an http or https URL of at most 2048 bytes",
+	)
+	BlockedLinkError   = errors.New("Links to this domain are not allowed")
+	EncryptedLinkError = errors.New("Links cannot be encrypted")
+)
+
+// Returns the path a link redirects from.
+func linkURL(slug string) string {
+	return "/l/" + url.PathEscape(slug)
+}
+
+// Checks the target of a new link: an absolute http or https URL with a host
+// and no credentials, outside the domains in DOGBOX_LINK_BLOCKLIST.
+func (dc *DogboxController) parseLinkTarget(s string) (string, error) {
+	if s == "" || len(s) > MAX_LINK_LENGTH {
+		return "", InvalidLinkError
+	}
+
+	u, err := url.Parse(s)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") ||
+		u.Hostname() == "" || u.User != nil {
+		return "", InvalidLinkError
+	}
+
+	if dc.linkBlocked(u.Hostname()) {
+		return "", BlockedLinkError
+	}
+
+	return u.String(), nil
+}
+
+// Reports whether the host is one of the blocked domains or a subdomain of
+// one.
+func (dc *DogboxController) linkBlocked(host string) bool {
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	for _, domain := range dc.cfg.LinkBlocklist {
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Creates a link from the url field of a form. The remaining fields are the
+// same as for file uploads, except that links cannot be encrypted.
+func (dc *DogboxController) CreateLink(c *gin.Context) {
+	target, err := dc.parseLinkTarget(c.PostForm("url"))
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+
+	opts, err := parsePostOptions(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if opts.Encrypted {
+		c.AbortWithError(http.StatusBadRequest, EncryptedLinkError)
+		return
+	}
+	opts.Kind = db.PostKindLink
+
+	final, err := dc.createLink(
+		c.Request.Context(),
+		target,
+		requestApiKey(c),
+		opts,
+	)
+	if err != nil {
+		c.AbortWithError(uploadErrorStatus(err), err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": final,
+		"url":     linkURL(*final.Filename),
+	})
+}
+
+// Creates a link post. Links have no contents, but count towards their
+// owner's quota of files.
+func (dc *DogboxController) createLink(
+	ctx context.Context,
+	target string,
+	owner *db.ApiKey,
+	opts postOptions,
+) (*db.Post, error) {
+	tx, err := dc.pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	qtx := dc.db.WithTx(tx)
+
+	i, err := qtx.CreatePost(ctx, db.CreatePostParams{
+		Filename: nil,
+		Delkey:   nil,
+		Hash:     nil,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slug, err := dc.sqids.Encode([]uint64{
+		uint64(i.ID),
+		uint64(i.CreatedAt.Time.Unix()),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var size int64
+	var ownerID *int64
+	if owner != nil {
+		ownerID = &owner.ID
+
+		_, err := qtx.ReserveUsage(ctx, db.ReserveUsageParams{
+			Size: size,
+			ID:   *ownerID,
+		})
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, QuotaExceededError
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dKey, err := dc.genDeletionKey(i.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	final, err := qtx.UpdatePost(ctx, db.UpdatePostParams{
+		Filename:     &slug,
+		DeletionKey:  &dKey,
+		OwnerID:      ownerID,
+		Size:         &size,
+		PasswordHash: opts.PasswordHash,
+		MaxDownloads: opts.MaxDownloads,
+		Kind:         db.NullPostKind{PostKind: opts.Kind, Valid: true},
+		TargetUrl:    &target,
+		ExpiresAt:    opts.ExpiresAt,
+		Status:       db.NullPostStatus{PostStatus: db.PostStatusOk, Valid: true},
+		Visibility: db.NullPostVisibility{
+			PostVisibility: opts.Visibility,
+			Valid:          true,
+		},
+		ID: i.ID,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err = tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+
+	return final, nil
+}
+
+// Redirects to a link's target and counts the hit. Links follow the same
+// visibility, password and download limit rules as other posts, with every
+// redirect counting as a download.
+func (dc *DogboxController) FollowLink(c *gin.Context) {
+	slug := c.Param("slug")
+
+	p, err := dc.db.GetPostByFilename(c.Request.Context(), &slug)
+	if err != nil || !postAvailable(p) || p.Kind != db.PostKindLink ||
+		p.TargetUrl == nil {
+		c.AbortWithError(http.StatusNotFound, NotFoundError(slug))
+		return
+	}
+
+	if _, ok := dc.checkVisibility(c, p); !ok {
+		return
+	}
+	if !dc.checkUnlocked(c, p) {
+		return
+	}
+
+	if p.MaxDownloads != nil {
+		last, ok := dc.claimDownload(c, p)
+		if !ok {
+			return
+		}
+		if last {
+			defer dc.burnPost(c.Request.Context(), p)
+		}
+	}
+
+	if err := dc.db.CountLinkHit(c.Request.Context(), p.ID); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	// Every hit has to reach the server to be counted.
+	c.Header("Cache-Control", "no-store")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Redirect(http.StatusFound, *p.TargetUrl)
+}
@@ -23,8 +23,21 @@ func main() {
 	}
 	defer dc.Close()
 
+	if len(os.Args) > 1 {
+		if err := runCommand(dc, os.Args[1], os.Args[2:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	dc.MountHandlers()
 
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	dc.StartScrubber(bgCtx)
+	dc.StartTierMover(bgCtx)
+	dc.StartExpirer(bgCtx)
+
 	addr := fmt.Sprintf(":%s", config.Port)
 
 	srv := &http.Server{
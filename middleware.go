@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/sha256"
 	"crypto/subtle"
 	"errors"
@@ -8,19 +9,33 @@ import (
 	"strings"
 	"time"
 
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/time/rate"
 )
 
 const MAX_API_KEY_LENGTH = 64
 
+// Context keys set by ApiKeyMiddleware.
+const (
+	// The *db.ApiKey the request was authenticated with. Not set for requests
+	// authenticated with the server's own API key.
+	CTX_API_KEY = "dogbox.api_key"
+	// Set to true for requests authenticated with the server's own API key.
+	CTX_IS_ADMIN = "dogbox.is_admin"
+)
+
 var (
 	MissingAPIKeyError         = errors.New("Could not find API key")
 	InvalidAuthenticationError = errors.New("Invalid authentication")
 	RateLimitExceededError     = errors.New("Rate limit exceeded")
 	TimeoutError               = errors.New("Timeout")
+	AdminRequiredError         = errors.New("Admin API key required")
 )
 
+// Looks up an issued API key by the SHA-256 hash of its raw value.
+type ApiKeyLookup func(ctx context.Context, keyHash []byte) (*db.ApiKey, error)
+
 // Extracts the token from the given header in the request.
 func extractToken(c *gin.Context, header string) (string, error) {
 	authString := c.GetHeader(header)
@@ -49,8 +64,10 @@ func verifyApiKey(cfg *Config, s string) bool {
 	return subtle.ConstantTimeCompare(cfg.DecodedAPIKey, key) == 1
 }
 
-// Rejects all requests that do not have a valid API key.
-func ApiKeyMiddleware(cfg *Config) gin.HandlerFunc {
+// Rejects all requests that do not have a valid API key. The server's own API
+// key is accepted as the admin key; any other key is looked up among the
+// issued keys and stored in the context under CTX_API_KEY.
+func ApiKeyMiddleware(cfg *Config, lookup ApiKeyLookup) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		key, err := extractToken(c, "Authorization")
 		if err != nil {
@@ -58,7 +75,17 @@ func ApiKeyMiddleware(cfg *Config) gin.HandlerFunc {
 			return
 		}
 
-		if !verifyApiKey(cfg, key) {
+		if verifyApiKey(cfg, key) {
+			c.Set(CTX_IS_ADMIN, true)
+			c.Next()
+			return
+		}
+
+		// Issued keys are random, so they can be found by their hash without
+		// a constant-time comparison.
+		hash := sha256.Sum256([]byte(key))
+		apiKey, err := lookup(c.Request.Context(), hash[:])
+		if err != nil {
 			c.AbortWithError(
 				http.StatusUnauthorized,
 				InvalidAuthenticationError,
@@ -66,10 +93,33 @@ func ApiKeyMiddleware(cfg *Config) gin.HandlerFunc {
 			return
 		}
 
+		c.Set(CTX_API_KEY, apiKey)
 		c.Next()
 	}
 }
 
+// Rejects all requests that were not authenticated with the admin key. Must
+// run after ApiKeyMiddleware.
+func AdminMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !c.GetBool(CTX_IS_ADMIN) {
+			c.AbortWithError(http.StatusForbidden, AdminRequiredError)
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// Returns the issued API key the request was authenticated with, or nil if
+// it was authenticated with the admin key.
+func requestApiKey(c *gin.Context) *db.ApiKey {
+	if k, ok := c.Get(CTX_API_KEY); ok {
+		return k.(*db.ApiKey)
+	}
+	return nil
+}
+
 // Applies a rate limiter to the http handler. At most r events will be sent to
 // the handler per second, and it also permits bursts of up to b events.
 func RateLimiter(r rate.Limit, b int) gin.HandlerFunc {
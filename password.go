@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	// Name of the cookie that lets a browser read a password-protected post
+	// after unlocking it.
+	UNLOCK_COOKIE = "dogbox_unlock"
+	UNLOCK_TTL    = time.Hour
+	// bcrypt ignores everything past this many bytes.
+	MAX_PASSWORD_LENGTH = 72
+)
+
+var (
+	PasswordRequiredError = errors.New("Password required")
+	WrongPasswordError    = errors.New("Wrong password")
+	PasswordTooLongError  = fmt.Errorf(
+		"Password must be at most %d bytes",
+		MAX_PASSWORD_LENGTH,
+	)
+)
+
+var unlockPage = template.Must(template.New("unlock").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Name}}</title></head>
+<body>
+<form method="post" action="{{.Action}}">
+<p>{{.Message}}</p>
+<input type="hidden" name="next" value="{{.Next}}">
+<input type="password" name="password" autofocus required>
+<button type="submit">Unlock</button>
+</form>
+</body>
+</html>
+`))
+
+// Returns the bcrypt hash of an upload's password, or nil if it has none.
+func hashPassword(password string) (*string, error) {
+	if password == "" {
+		return nil, nil
+	}
+	if len(password) > MAX_PASSWORD_LENGTH {
+		return nil, PasswordTooLongError
+	}
+
+	hash, err := bcrypt.GenerateFromPassword(
+		[]byte(password),
+		bcrypt.DefaultCost,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	s := string(hash)
+	return &s, nil
+}
+
+func checkPassword(p *db.Post, password string) bool {
+	if len(password) > MAX_PASSWORD_LENGTH {
+		return false
+	}
+
+	err := bcrypt.CompareHashAndPassword(
+		[]byte(*p.PasswordHash),
+		[]byte(password),
+	)
+	return err == nil
+}
+
+// Returns the signature of an unlock cookie for the post that expires at the
+// given Unix time. The password hash is part of the signature, so changing
+// the password locks the post again.
+func signUnlock(key []byte, p *db.Post, exp int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "unlock\n%s\n%d\n%s", *p.Filename, exp, *p.PasswordHash)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Reports whether the request carries a valid unlock cookie for the post.
+func (dc *DogboxController) unlocked(c *gin.Context, p *db.Post) bool {
+	cookie, err := c.Cookie(UNLOCK_COOKIE)
+	if err != nil {
+		return false
+	}
+
+	exp, sig, ok := strings.Cut(cookie, ".")
+	if !ok {
+		return false
+	}
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || time.Now().Unix() >= expUnix {
+		return false
+	}
+
+	expected := signUnlock(dc.cfg.SigningKey, p, expUnix)
+	return hmac.Equal([]byte(sig), []byte(expected))
+}
+
+// Issues an unlock cookie for the post, scoped to the post's URLs.
+func (dc *DogboxController) setUnlockCookie(c *gin.Context, p *db.Post) {
+	exp := time.Now().Add(UNLOCK_TTL).Unix()
+	value := strconv.FormatInt(exp, 10) + "." +
+		signUnlock(dc.cfg.SigningKey, p, exp)
+
+	for _, path := range postPaths(p) {
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     UNLOCK_COOKIE,
+			Value:    value,
+			Path:     path,
+			MaxAge:   int(UNLOCK_TTL.Seconds()),
+			HttpOnly: true,
+			Secure: c.Request.TLS != nil ||
+				c.GetHeader("X-Forwarded-Proto") == "https",
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+}
+
+// Returns the path a post is served from.
+func postURL(name string) string {
+	return "/api/posts/" + url.PathEscape(name)
+}
+
+// Returns every path under which a post's contents are served, starting with
+// the main one.
+func postPaths(p *db.Post) []string {
+	switch p.Kind {
+	case db.PostKindLink:
+		return []string{linkURL(*p.Filename)}
+	case db.PostKindPaste:
+		return []string{postURL(*p.Filename), pasteURL(*p.Filename)}
+	default:
+		return []string{postURL(*p.Filename)}
+	}
+}
+
+// Reports whether the path is one of the pages a post is served on, so that
+// the unlock form can send the browser back there.
+func servesPost(p *db.Post, path string) bool {
+	for _, prefix := range postPaths(p) {
+		if path == prefix {
+			return true
+		}
+	}
+
+	return p.Kind == db.PostKindPaste && path == pasteURL(*p.Filename)+"/raw"
+}
+
+// Lets the request through if the post has no password, the request carries
+// a valid unlock cookie, or the X-Dogbox-Password header holds the password.
+// Otherwise responds with 401 and reports false. Must be called before
+// anything about the post's contents is sent, such as its ETag.
+func (dc *DogboxController) checkUnlocked(c *gin.Context, p *db.Post) bool {
+	if p.PasswordHash == nil || dc.unlocked(c, p) {
+		return true
+	}
+
+	password := c.GetHeader("X-Dogbox-Password")
+	if password == "" {
+		dc.passwordChallenge(c, p, PasswordRequiredError)
+		return false
+	}
+	if !checkPassword(p, password) {
+		dc.passwordChallenge(c, p, WrongPasswordError)
+		return false
+	}
+
+	dc.setUnlockCookie(c, p)
+	return true
+}
+
+// Responds with 401: an unlock form for browsers, an error for API clients.
+func (dc *DogboxController) passwordChallenge(
+	c *gin.Context,
+	p *db.Post,
+	err error,
+) {
+	c.Header("Cache-Control", "no-store")
+
+	if c.NegotiateFormat(gin.MIMEJSON, gin.MIMEHTML) != gin.MIMEHTML {
+		c.AbortWithError(http.StatusUnauthorized, err)
+		return
+	}
+
+	// Signed link parameters are passed on, so that private posts can be
+	// unlocked too.
+	action := postURL(*p.Filename) + "/unlock"
+	if c.Request.URL.RawQuery != "" {
+		action += "?" + c.Request.URL.RawQuery
+	}
+
+	// A failed attempt at the unlock form keeps the page it came from.
+	next := c.Request.URL.Path
+	if posted := c.PostForm("next"); servesPost(p, posted) {
+		next = posted
+	}
+
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusUnauthorized)
+	unlockPage.Execute(c.Writer, gin.H{
+		"Name":    *p.Filename,
+		"Action":  action,
+		"Next":    next,
+		"Message": err.Error(),
+	})
+	c.Abort()
+}
+
+// Handles the unlock form: checks the password, issues an unlock cookie and
+// sends the browser back to the page it came from.
+func (dc *DogboxController) UnlockPost(c *gin.Context) {
+	name := c.Param("name")
+
+	p, err := dc.db.GetPostByFilename(c.Request.Context(), &name)
+	if err != nil || !postAvailable(p) {
+		c.AbortWithError(http.StatusNotFound, NotFoundError(name))
+		return
+	}
+
+	// Private posts can only be unlocked through a signed link.
+	if _, ok := dc.checkVisibility(c, p); !ok {
+		return
+	}
+
+	if p.PasswordHash != nil {
+		if !checkPassword(p, c.PostForm("password")) {
+			dc.passwordChallenge(c, p, WrongPasswordError)
+			return
+		}
+		dc.setUnlockCookie(c, p)
+	}
+
+	target := postPaths(p)[0]
+	if next := c.PostForm("next"); servesPost(p, next) {
+		target = next
+	}
+	if c.Request.URL.RawQuery != "" {
+		target += "?" + c.Request.URL.RawQuery
+	}
+	c.Redirect(http.StatusSeeOther, target)
+}
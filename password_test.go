@@ -0,0 +1,113 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Returns a post protected by the given password.
+func lockedPost(t *testing.T, name, password string) *db.Post {
+	t.Helper()
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := string(hash)
+	return &db.Post{Filename: &name, PasswordHash: &s, Kind: db.PostKindFile}
+}
+
+func TestUnlocked(t *testing.T) {
+	dc := &DogboxController{cfg: Config{SigningKey: []byte("signing key")}}
+	p := lockedPost(t, "a.png", "hunter2")
+	other := lockedPost(t, "b.png", "hunter2")
+	changed := lockedPost(t, "a.png", "correct horse")
+
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Second).Unix()
+	cookie := func(p *db.Post, exp int64) string {
+		return strconv.FormatInt(exp, 10) + "." + signUnlock(dc.cfg.SigningKey, p, exp)
+	}
+	valid := cookie(p, future)
+	sig := signUnlock(dc.cfg.SigningKey, p, future)
+
+	tests := []struct {
+		name   string
+		cookie string
+		want   bool
+	}{
+		{"Valid", valid, true},
+		{"None", "", false},
+		{"Expired", cookie(p, past), false},
+		{"ExtendedExpiry", strconv.FormatInt(future+3600, 10) + "." + sig, false},
+		{"TamperedSignature", valid[:len(valid)-1] + "x", false},
+		{"OtherPost", cookie(other, future), false},
+		{"PasswordChanged", cookie(changed, future), false},
+		{"Malformed", "garbage", false},
+		{"InvalidExpiry", "soon." + sig, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testContext(postURL("a.png"))
+			if tt.cookie != "" {
+				c.Request.AddCookie(&http.Cookie{Name: UNLOCK_COOKIE, Value: tt.cookie})
+			}
+
+			if got := dc.unlocked(c, p); got != tt.want {
+				t.Fatalf("unlocked = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckUnlocked(t *testing.T) {
+	dc := &DogboxController{cfg: Config{SigningKey: []byte("signing key")}}
+	p := lockedPost(t, "a.png", "hunter2")
+
+	name := "open.png"
+	open := &db.Post{Filename: &name, Kind: db.PostKindFile}
+	c, _ := testContext(postURL(name))
+	if !dc.checkUnlocked(c, open) {
+		t.Fatal("a post without a password is locked")
+	}
+
+	for _, password := range []string{"", "wrong"} {
+		c, w := testContext(postURL("a.png"))
+		if password != "" {
+			c.Request.Header.Set("X-Dogbox-Password", password)
+		}
+		if dc.checkUnlocked(c, p) {
+			t.Fatalf("unlocked with password %q", password)
+		}
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("password %q: status %d, want %d", password, w.Code, http.StatusUnauthorized)
+		}
+	}
+
+	c, w := testContext(postURL("a.png"))
+	c.Request.Header.Set("X-Dogbox-Password", "hunter2")
+	if !dc.checkUnlocked(c, p) {
+		t.Fatal("the right password did not unlock the post")
+	}
+
+	// The cookie issued with the password unlocks the post on its own.
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != UNLOCK_COOKIE {
+		t.Fatalf("got cookies %v, want an unlock cookie", cookies)
+	}
+	if cookies[0].Path != postURL("a.png") || !cookies[0].HttpOnly {
+		t.Fatalf("unlock cookie has path %q and HttpOnly %v", cookies[0].Path, cookies[0].HttpOnly)
+	}
+
+	c, _ = testContext(postURL("a.png"))
+	c.Request.AddCookie(cookies[0])
+	if !dc.checkUnlocked(c, p) {
+		t.Fatal("the unlock cookie did not unlock the post")
+	}
+}
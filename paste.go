@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/formatters/html"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/gin-gonic/gin"
+)
+
+// Largest paste accepted, in bytes. Pastes are highlighted in memory on every
+// view, so they are kept small.
+const MAX_PASTE_SIZE = 1024 * 1024
+
+const PASTE_STYLE = "github"
+
+var (
+	EmptyPasteError      = errors.New("Paste text is empty")
+	PasteTooLargeError   = errors.New("Paste text is larger than 1 MiB")
+	EncryptedPasteError  = errors.New("Pastes cannot be encrypted")
+	UnknownLanguageError = func(lang string) error {
+		return fmt.Errorf("Unknown language: %s", lang)
+	}
+)
+
+var pasteFormatter = html.New(
+	html.WithClasses(true),
+	html.WithLineNumbers(true),
+	html.LineNumbersInTable(true),
+	html.WithLinkableLineNumbers(true, "L"),
+)
+
+// Stylesheet of the highlighted pastes.
+var pasteCSS = func() template.CSS {
+	var buf bytes.Buffer
+	err := pasteFormatter.WriteCSS(&buf, styles.Get(PASTE_STYLE))
+	if err != nil {
+		panic(err)
+	}
+	return template.CSS(buf.String())
+}()
+
+var pastePage = template.Must(template.New("paste").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>
+{{.CSS}}
+body { margin: 0; font-family: sans-serif; }
+header { padding: 0.5em 1em; border-bottom: 1px solid #ddd; }
+.chroma { padding: 0.5em 0; overflow-x: auto; }
+.chroma :target { background-color: #fff8c5; }
+</style>
+</head>
+<body>
+<header>
+{{.Name}}{{with .Language}} &middot; {{.}}{{end}} &middot; <a href="{{.Raw}}">raw</a>
+</header>
+{{.Code}}
+</body>
+</html>
+`))
+
+// Returns the path of a paste's highlighted page.
+func pasteURL(name string) string {
+	return "/p/" + url.PathEscape(name)
+}
+
+// Creates a paste from the text and language fields of a form. The remaining
+// fields are the same as for file uploads. An unknown language is an error;
+// pastes without one are highlighted as whatever they look like.
+func (dc *DogboxController) CreatePaste(c *gin.Context) {
+	text := c.PostForm("text")
+	if text == "" {
+		c.AbortWithError(http.StatusBadRequest, EmptyPasteError)
+		return
+	}
+	if len(text) > MAX_PASTE_SIZE {
+		c.AbortWithError(http.StatusRequestEntityTooLarge, PasteTooLargeError)
+		return
+	}
+
+	opts, err := parsePostOptions(c)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, err)
+		return
+	}
+	if opts.Encrypted {
+		c.AbortWithError(http.StatusBadRequest, EncryptedPasteError)
+		return
+	}
+	opts.Kind = db.PostKindPaste
+
+	if lang := c.PostForm("language"); lang != "" {
+		lexer := lexers.Get(lang)
+		if lexer == nil {
+			c.AbortWithError(http.StatusBadRequest, UnknownLanguageError(lang))
+			return
+		}
+		name := lexer.Config().Name
+		opts.Language = &name
+	}
+
+	final, err := dc.createPost(
+		c.Request.Context(),
+		strings.NewReader(text),
+		".txt",
+		dc.store,
+		requestApiKey(c),
+		opts,
+	)
+	if err != nil {
+		c.AbortWithError(uploadErrorStatus(err), err)
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": final,
+	})
+}
+
+// Serves a paste as a highlighted page with linkable line numbers.
+func (dc *DogboxController) GetPaste(c *gin.Context) {
+	p, text, ok := dc.readPaste(c)
+	if !ok {
+		return
+	}
+
+	code, err := highlight(text, p.Language)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	raw := pasteURL(*p.Filename) + "/raw"
+	if c.Request.URL.RawQuery != "" {
+		raw += "?" + c.Request.URL.RawQuery
+	}
+
+	c.Header("Content-Security-Policy", "default-src 'none'; "+
+		"style-src 'unsafe-inline'")
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	pastePage.Execute(c.Writer, gin.H{
+		"Name":     *p.Filename,
+		"Language": p.Language,
+		"Raw":      raw,
+		"CSS":      pasteCSS,
+		"Code":     code,
+	})
+}
+
+// Serves a paste as plain text.
+func (dc *DogboxController) GetPasteRaw(c *gin.Context) {
+	_, text, ok := dc.readPaste(c)
+	if !ok {
+		return
+	}
+
+	setUploadHeaders(c)
+	c.Data(http.StatusOK, "text/plain; charset=utf-8", []byte(text))
+}
+
+// Loads the paste named in the request, applying the same quarantine,
+// visibility, password and download limit rules as GetFile, and sets the
+// response's caching headers. Aborts the request and reports false if the
+// paste cannot be served.
+func (dc *DogboxController) readPaste(
+	c *gin.Context,
+) (*db.Post, string, bool) {
+	name := c.Param("name")
+
+	p, err := dc.db.GetPostByFilename(c.Request.Context(), &name)
+	if err != nil || !postAvailable(p) || p.Kind != db.PostKindPaste {
+		c.AbortWithError(http.StatusNotFound, NotFoundError(name))
+		return nil, "", false
+	}
+
+	// Don't serve data that is known to be damaged.
+	if dc.cfg.DogboxScrubQuarantine &&
+		p.IntegrityStatus == db.IntegrityStatusCorrupt {
+		c.AbortWithError(http.StatusServiceUnavailable, QuarantinedError)
+		return nil, "", false
+	}
+
+	cacheControl, ok := dc.checkVisibility(c, p)
+	if !ok {
+		return nil, "", false
+	}
+	if !dc.checkUnlocked(c, p) {
+		return nil, "", false
+	}
+	if p.PasswordHash != nil {
+		cacheControl = "private, no-cache"
+	}
+	if p.MaxDownloads != nil {
+		cacheControl = "no-store"
+	}
+
+	reader, err := dc.store.Retrieve(c.Request.Context(), dc.objectPath(p))
+	if err != nil {
+		c.AbortWithError(http.StatusNotFound, NotFoundError(name))
+		return nil, "", false
+	}
+	defer reader.Close()
+
+	text, err := io.ReadAll(reader)
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return nil, "", false
+	}
+
+	// The paste has been read in full, so it can be removed right away after
+	// its last view.
+	if p.MaxDownloads != nil {
+		last, ok := dc.claimDownload(c, p)
+		if !ok {
+			return nil, "", false
+		}
+		if last {
+			dc.burnPost(c.Request.Context(), p)
+		}
+	}
+
+	c.Header("Cache-Control", cacheControl)
+	c.Header("X-Content-Type-Options", "nosniff")
+
+	return p, string(text), true
+}
+
+// Renders text as highlighted HTML. Text without a known language is
+// highlighted as the language it looks like, if any.
+func highlight(text string, language *string) (template.HTML, error) {
+	var lexer chroma.Lexer
+	if language != nil {
+		lexer = lexers.Get(*language)
+	}
+	if lexer == nil {
+		lexer = lexers.Analyse(text)
+	}
+	if lexer == nil {
+		lexer = lexers.Fallback
+	}
+
+	it, err := chroma.Coalesce(lexer).Tokenise(nil, text)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	if err := pasteFormatter.Format(
+		&buf,
+		styles.Get(PASTE_STYLE),
+		it,
+	); err != nil {
+		return "", err
+	}
+
+	// The formatter escapes the text.
+	return template.HTML(buf.String()), nil
+}
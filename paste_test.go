@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+)
+
+func TestHighlight(t *testing.T) {
+	goLang := "Go"
+
+	code, err := highlight("package main\n\nfunc main() {}\n", &goLang)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{`class="kd"`, `id="L1"`, `id="L3"`} {
+		if !strings.Contains(string(code), want) {
+			t.Errorf("highlighted Go is missing %s", want)
+		}
+	}
+
+	// The text is escaped whatever it is highlighted as.
+	for _, lang := range []*string{nil, &goLang} {
+		code, err := highlight("<script>alert(1)</script>", lang)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(code), "<script>") {
+			t.Errorf("highlighted text contains an unescaped tag: %s", code)
+		}
+	}
+}
+
+// Creates a paste with the given form fields and returns its name.
+func createPaste(t *testing.T, dc *DogboxController, form url.Values) string {
+	t.Helper()
+
+	w := serve(dc, http.MethodPost, "/api/pastes", form.Encode())
+	if w.Code != http.StatusCreated {
+		t.Fatalf("creating paste: %d %s", w.Code, w.Body)
+	}
+
+	var res struct {
+		Message db.Post `json:"message"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Fatal(err)
+	}
+	return *res.Message.Filename
+}
+
+func TestPaste(t *testing.T) {
+	dc := newTestController(t)
+	text := "fn main() {}\n"
+
+	w := serve(dc, http.MethodPost, "/api/pastes", url.Values{
+		"text":     {text},
+		"language": {"not a language"},
+	}.Encode())
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("creating paste in an unknown language: %d, want %d", w.Code, http.StatusBadRequest)
+	}
+
+	name := createPaste(t, dc, url.Values{
+		"text":     {text},
+		"language": {"rust"},
+	})
+
+	w = serve(dc, http.MethodGet, pasteURL(name), "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("paste page: %d %s", w.Code, w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "Rust") {
+		t.Error("paste page does not name the paste's language")
+	}
+
+	w = serve(dc, http.MethodGet, pasteURL(name)+"/raw", "")
+	if w.Code != http.StatusOK || w.Body.String() != text {
+		t.Fatalf("raw paste: %d %q, want %q", w.Code, w.Body, text)
+	}
+
+	// A paste is a post too, and can be downloaded as one.
+	w = serve(dc, http.MethodGet, postURL(name), "")
+	if w.Code != http.StatusOK || w.Body.String() != text {
+		t.Fatalf("paste as a post: %d %q, want %q", w.Code, w.Body, text)
+	}
+}
+
+func TestExpiredPaste(t *testing.T) {
+	dc := newTestController(t)
+
+	name := createPaste(t, dc, url.Values{
+		"text":       {"gone soon"},
+		"expires_in": {"1ns"},
+	})
+
+	for _, path := range []string{pasteURL(name), pasteURL(name) + "/raw", postURL(name)} {
+		if w := serve(dc, http.MethodGet, path, ""); w.Code != http.StatusNotFound {
+			t.Errorf("%s: %d, want %d", path, w.Code, http.StatusNotFound)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+)
+
+// Number of random bytes in an issued API key.
+const API_KEY_BYTES = 32
+
+var (
+	QuotaExceededError = errors.New(
+		"Storage quota exceeded: delete files or ask for a larger quota",
+	)
+	FileTooLargeError = errors.New("File is larger than the storage quota")
+	NotOwnerError     = errors.New("Post belongs to another API key")
+)
+
+// The storage used by an API key, and its limits. A nil quota is unlimited.
+type Usage struct {
+	UsedBytes  int64  `json:"used_bytes"`
+	UsedFiles  int64  `json:"used_files"`
+	QuotaBytes *int64 `json:"quota_bytes"`
+	QuotaFiles *int64 `json:"quota_files"`
+}
+
+// An issued API key as reported to admins. The raw key is only included when
+// the key is created, since only its hash is stored.
+type ApiKeyInfo struct {
+	ID        int64     `json:"id"`
+	Name      string    `json:"name"`
+	Key       string    `json:"key,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	Usage
+}
+
+func keyUsage(k *db.ApiKey) Usage {
+	return Usage{
+		UsedBytes:  k.UsedBytes,
+		UsedFiles:  k.UsedFiles,
+		QuotaBytes: k.QuotaBytes,
+		QuotaFiles: k.QuotaFiles,
+	}
+}
+
+func keyInfo(k *db.ApiKey) ApiKeyInfo {
+	return ApiKeyInfo{
+		ID:        k.ID,
+		Name:      k.Name,
+		CreatedAt: k.CreatedAt.Time,
+		Usage:     keyUsage(k),
+	}
+}
+
+// Converts a quota from a request or the configuration, where zero or less
+// means no limit, to its database representation.
+func quotaParam(v int64) *int64 {
+	if v <= 0 {
+		return nil
+	}
+	return &v
+}
+
+// Reports the storage used by the requesting API key. For the admin key, this
+// is the storage used by posts that do not belong to an issued key.
+func (dc *DogboxController) GetUsage(c *gin.Context) {
+	if key := requestApiKey(c); key != nil {
+		c.JSON(http.StatusOK, keyUsage(key))
+		return
+	}
+
+	used, err := dc.db.GetUnownedUsage(c.Request.Context())
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, Usage{
+		UsedBytes: used.UsedBytes,
+		UsedFiles: used.UsedFiles,
+	})
+}
+
+type createApiKeyRequest struct {
+	Name       string `json:"name" binding:"required"`
+	QuotaBytes *int64 `json:"quota_bytes"`
+	QuotaFiles *int64 `json:"quota_files"`
+}
+
+// Issues a new API key. Quotas that are not given default to
+// DOGBOX_DEFAULT_QUOTA_BYTES and DOGBOX_DEFAULT_QUOTA_FILES; a quota of 0 is
+// unlimited.
+func (dc *DogboxController) CreateApiKey(c *gin.Context) {
+	var req createApiKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithError(http.StatusBadRequest, BadRequestError)
+		return
+	}
+
+	quotaBytes := dc.cfg.DogboxDefaultQuotaBytes
+	if req.QuotaBytes != nil {
+		quotaBytes = *req.QuotaBytes
+	}
+	quotaFiles := dc.cfg.DogboxDefaultQuotaFiles
+	if req.QuotaFiles != nil {
+		quotaFiles = *req.QuotaFiles
+	}
+
+	raw := make([]byte, API_KEY_BYTES)
+	if _, err := rand.Read(raw); err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+	key := base64.RawURLEncoding.EncodeToString(raw)
+	hash := sha256.Sum256([]byte(key))
+
+	k, err := dc.db.CreateApiKey(c.Request.Context(), db.CreateApiKeyParams{
+		Name:       req.Name,
+		KeyHash:    hash[:],
+		QuotaBytes: quotaParam(quotaBytes),
+		QuotaFiles: quotaParam(quotaFiles),
+	})
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	info := keyInfo(k)
+	info.Key = key
+	c.JSON(http.StatusCreated, info)
+}
+
+type setQuotaRequest struct {
+	QuotaBytes int64 `json:"quota_bytes"`
+	QuotaFiles int64 `json:"quota_files"`
+}
+
+// Replaces the quotas of an issued API key. A quota of 0 is unlimited. Usage
+// above a lowered quota is kept, but blocks further uploads.
+func (dc *DogboxController) SetApiKeyQuota(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.AbortWithError(http.StatusBadRequest, BadRequestError)
+		return
+	}
+
+	var req setQuotaRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithError(http.StatusBadRequest, BadRequestError)
+		return
+	}
+
+	k, err := dc.db.SetApiKeyQuota(c.Request.Context(), db.SetApiKeyQuotaParams{
+		QuotaBytes: quotaParam(req.QuotaBytes),
+		QuotaFiles: quotaParam(req.QuotaFiles),
+		ID:         id,
+	})
+	if errors.Is(err, pgx.ErrNoRows) {
+		c.AbortWithError(http.StatusNotFound, NotFoundError(c.Param("id")))
+		return
+	}
+	if err != nil {
+		c.AbortWithError(http.StatusInternalServerError, err)
+		return
+	}
+
+	c.JSON(http.StatusOK, keyInfo(k))
+}
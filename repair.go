@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"time"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"golang.org/x/time/rate"
+)
+
+const POST_BATCH_SIZE = 500
+const REPAIR_PROGRESS_INTERVAL = 10 * time.Second
+
+var NotAMirrorError = errors.New("Storage is not a mirror")
+
+// Progress of a repair run, reported periodically and once it finishes.
+type RepairProgress struct {
+	Checked  int
+	Repaired int
+	Failed   int
+	Bytes    int64
+	LastID   int64
+}
+
+// Calls fn on every post with status ok, in order of increasing id, starting
+// after the given id. Posts are fetched in batches so that the whole table is
+// never held in memory.
+func (dc *DogboxController) forEachPost(
+	ctx context.Context,
+	afterID int64,
+	fn func(*db.Post) error,
+) error {
+	for {
+		posts, err := dc.db.ListPostsAfter(ctx, db.ListPostsAfterParams{
+			AfterID:  afterID,
+			PageSize: POST_BATCH_SIZE,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, p := range posts {
+			if err := fn(p); err != nil {
+				return err
+			}
+			afterID = p.ID
+		}
+
+		if len(posts) < POST_BATCH_SIZE {
+			return nil
+		}
+	}
+}
+
+// Checks every post's object on each replica of the mirror against the hash
+// recorded in the database, and re-copies missing or corrupt objects from an
+// intact replica. Failures are logged and do not stop the run. The limiter
+// caps the number of bytes read and written per second; a nil limiter does not
+// throttle. The progress callback, if not nil, is called periodically and once
+// the run is over.
+func (dc *DogboxController) RepairMirror(
+	ctx context.Context,
+	afterID int64,
+	lim *rate.Limiter,
+	progress func(RepairProgress),
+) (RepairProgress, error) {
+	var prog RepairProgress
+
+	// Replicas are checked through the wrappers above the mirror, since
+	// posts.hash is the hash of the contents before encryption or
+	// compression.
+	m, view, err := store.FindMirror(dc.store)
+	if err != nil {
+		return prog, err
+	}
+	if m == nil {
+		return prog, NotAMirrorError
+	}
+
+	lastReport := time.Now()
+	err = dc.forEachPost(ctx, afterID, func(p *db.Post) error {
+		res, err := m.Repair(
+			ctx,
+			dc.objectPath(p),
+			*p.Hash,
+			view,
+			lim,
+		)
+
+		prog.Checked++
+		prog.Bytes += res.Bytes
+		prog.LastID = p.ID
+		prog.Repaired += len(res.Repaired)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			prog.Failed++
+			log.Printf("repair: post %d (%s): %v\n", p.ID, res.Path, err)
+		} else if len(res.Repaired) > 0 {
+			log.Printf(
+				"repair: post %d (%s): repaired replicas %v\n",
+				p.ID,
+				res.Path,
+				res.Repaired,
+			)
+		}
+
+		if progress != nil && time.Since(lastReport) > REPAIR_PROGRESS_INTERVAL {
+			progress(prog)
+			lastReport = time.Now()
+		}
+
+		return nil
+	})
+
+	if progress != nil {
+		progress(prog)
+	}
+
+	return prog, err
+}
+
+// Command-line entry point for the mirror repair job.
+func runRepair(ctx context.Context, dc *DogboxController, args []string) error {
+	flags := flag.NewFlagSet("repair", flag.ContinueOnError)
+	bytesPerSec := flags.Int(
+		"rate",
+		64*1024*1024,
+		"maximum bytes read and written per second (0 for no limit)",
+	)
+	afterID := flags.Int64("after", 0, "only check posts with a greater id")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var lim *rate.Limiter
+	if *bytesPerSec > 0 {
+		lim = rate.NewLimiter(rate.Limit(*bytesPerSec), *bytesPerSec)
+	}
+
+	_, err := dc.RepairMirror(ctx, *afterID, lim, func(p RepairProgress) {
+		log.Printf(
+			"repair: checked %d posts (up to id %d), repaired %d replicas, "+
+				"%d failures, %d bytes\n",
+			p.Checked,
+			p.LastID,
+			p.Repaired,
+			p.Failed,
+			p.Bytes,
+		)
+	})
+
+	return err
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+	"net/http"
+	"time"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/jackc/pgx/v5/pgtype"
+	"golang.org/x/time/rate"
+)
+
+const ALERT_TIMEOUT = 10 * time.Second
+
+var QuarantinedError = errors.New("File failed its integrity check")
+
+// Totals for a single scrub pass.
+type ScrubStats struct {
+	Checked int
+	Corrupt int
+	Missing int
+	Bytes   int64
+}
+
+// An integrity alert, as sent to the alert webhook.
+type IntegrityAlert struct {
+	PostID   int64              `json:"post_id"`
+	Filename string             `json:"filename"`
+	Hash     string             `json:"hash"`
+	Status   db.IntegrityStatus `json:"status"`
+	Detected time.Time          `json:"detected"`
+}
+
+// Re-reads every post that has not been verified within maxAge, recomputes
+// its SHA-256 and records whether it still matches posts.hash. Mismatches and
+// missing objects are reported through alertIntegrity. The limiter caps the
+// number of bytes read per second; a nil limiter does not throttle.
+func (dc *DogboxController) Scrub(
+	ctx context.Context,
+	maxAge time.Duration,
+	lim *rate.Limiter,
+) (ScrubStats, error) {
+	var stats ScrubStats
+	before := pgtype.Timestamptz{Time: time.Now().Add(-maxAge), Valid: true}
+	afterID := int64(0)
+
+	for {
+		posts, err := dc.db.ListPostsToScrub(ctx, db.ListPostsToScrubParams{
+			AfterID:        afterID,
+			VerifiedBefore: before,
+			PageSize:       POST_BATCH_SIZE,
+		})
+		if err != nil {
+			return stats, err
+		}
+		if len(posts) == 0 {
+			return stats, nil
+		}
+
+		for _, p := range posts {
+			afterID = p.ID
+
+			status, n, err := dc.scrubPost(ctx, p, lim)
+			stats.Bytes += n
+			if err != nil {
+				if ctx.Err() != nil {
+					return stats, ctx.Err()
+				}
+				// Leave the post unverified so that it is retried on the
+				// next pass.
+				log.Printf("scrub: post %d: %v\n", p.ID, err)
+				continue
+			}
+
+			stats.Checked++
+			switch status {
+			case db.IntegrityStatusCorrupt:
+				stats.Corrupt++
+			case db.IntegrityStatusMissing:
+				stats.Missing++
+			}
+
+			if err := dc.db.SetPostIntegrity(ctx, db.SetPostIntegrityParams{
+				IntegrityStatus: status,
+				ID:              p.ID,
+			}); err != nil {
+				return stats, err
+			}
+
+			if status != db.IntegrityStatusOk {
+				dc.alertIntegrity(ctx, p, status)
+			}
+		}
+	}
+}
+
+// Checks a single post's object against its recorded hash. The object is
+// read from the backing store, not from the cache in front of it.
+func (dc *DogboxController) scrubPost(
+	ctx context.Context,
+	p *db.Post,
+	lim *rate.Limiter,
+) (db.IntegrityStatus, int64, error) {
+	hash, n, err := store.HashObject(
+		store.WithNoCache(ctx),
+		dc.store,
+		dc.objectPath(p),
+		lim,
+	)
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return db.IntegrityStatusMissing, n, nil
+	case err != nil:
+		return "", n, err
+	case hash != *p.Hash:
+		return db.IntegrityStatusCorrupt, n, nil
+	default:
+		return db.IntegrityStatusOk, n, nil
+	}
+}
+
+// Logs a failed integrity check and, if configured, posts it to the alert
+// webhook.
+func (dc *DogboxController) alertIntegrity(
+	ctx context.Context,
+	p *db.Post,
+	status db.IntegrityStatus,
+) {
+	alert := IntegrityAlert{
+		PostID:   p.ID,
+		Filename: *p.Filename,
+		Hash:     *p.Hash,
+		Status:   status,
+		Detected: time.Now(),
+	}
+	log.Printf(
+		"scrub: post %d (%s) is %s\n",
+		alert.PostID,
+		alert.Filename,
+		alert.Status,
+	)
+
+	if dc.cfg.DogboxAlertWebhook == "" {
+		return
+	}
+
+	body, err := json.Marshal(alert)
+	if err != nil {
+		log.Printf("scrub: alert: %v\n", err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ALERT_TIMEOUT)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(
+		ctx,
+		http.MethodPost,
+		dc.cfg.DogboxAlertWebhook,
+		bytes.NewReader(body),
+	)
+	if err != nil {
+		log.Printf("scrub: alert: %v\n", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		log.Printf("scrub: alert: %v\n", err)
+		return
+	}
+	res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		log.Printf("scrub: alert: webhook returned %s\n", res.Status)
+	}
+}
+
+func (dc *DogboxController) scrubLimiter() *rate.Limiter {
+	if dc.cfg.DogboxScrubRate <= 0 {
+		return nil
+	}
+	return rate.NewLimiter(
+		rate.Limit(dc.cfg.DogboxScrubRate),
+		dc.cfg.DogboxScrubRate,
+	)
+}
+
+// Runs a scrub pass in the background every DOGBOX_SCRUB_INTERVAL until the
+// context is canceled. Each pass verifies every post that was last checked
+// more than one interval ago.
+func (dc *DogboxController) StartScrubber(ctx context.Context) {
+	interval := dc.cfg.DogboxScrubInterval
+	if interval <= 0 {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			stats, err := dc.Scrub(ctx, interval, dc.scrubLimiter())
+			if err != nil && ctx.Err() == nil {
+				log.Printf("scrub: %v\n", err)
+			}
+			log.Printf(
+				"scrub: checked %d posts, %d corrupt, %d missing\n",
+				stats.Checked,
+				stats.Corrupt,
+				stats.Missing,
+			)
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Command-line entry point for a single scrub pass.
+func runScrub(ctx context.Context, dc *DogboxController, args []string) error {
+	flags := flag.NewFlagSet("scrub", flag.ContinueOnError)
+	maxAge := flags.Duration(
+		"max-age",
+		0,
+		"only check posts last verified longer ago than this",
+	)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	stats, err := dc.Scrub(ctx, *maxAge, dc.scrubLimiter())
+	log.Printf(
+		"scrub: checked %d posts, %d corrupt, %d missing, %d bytes\n",
+		stats.Checked,
+		stats.Corrupt,
+		stats.Missing,
+		stats.Bytes,
+	)
+
+	return err
+}
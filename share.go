@@ -0,0 +1,228 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var (
+	InvalidVisibilityError = errors.New(
+		"Visibility must be public, unlisted or private",
+	)
+	InvalidTTLError = errors.New(
+		"TTL must be a positive duration no longer than the maximum",
+	)
+	InvalidSignatureError = errors.New("Invalid or expired link")
+)
+
+// Settings chosen by the uploader of a post.
+type postOptions struct {
+	Visibility db.PostVisibility
+	// Hash of the password readers have to give, if any.
+	PasswordHash *string
+	// Number of times the post can be downloaded before it is removed, if
+	// limited.
+	MaxDownloads *int32
+	// Set for files encrypted by the client, which the server must store
+	// and serve as opaque bytes, along with the envelope needed to decrypt
+	// them.
+	Encrypted bool
+	Envelope  *string
+	// When the post is removed, if ever.
+	ExpiresAt pgtype.Timestamptz
+	Kind      db.PostKind
+	// Language of a paste, used to highlight it.
+	Language *string
+}
+
+// Reads the post settings from the fields of an upload form.
+func parsePostOptions(c *gin.Context) (postOptions, error) {
+	opts := postOptions{
+		Visibility: db.PostVisibilityPublic,
+		Kind:       db.PostKindFile,
+	}
+
+	switch v := db.PostVisibility(c.PostForm("visibility")); v {
+	case "":
+	case db.PostVisibilityPublic,
+		db.PostVisibilityUnlisted,
+		db.PostVisibilityPrivate:
+		opts.Visibility = v
+	default:
+		return opts, InvalidVisibilityError
+	}
+
+	hash, err := hashPassword(c.PostForm("password"))
+	if err != nil {
+		return opts, err
+	}
+	opts.PasswordHash = hash
+
+	opts.MaxDownloads, err = parseMaxDownloads(c.PostForm("max_downloads"))
+	if err != nil {
+		return opts, err
+	}
+
+	opts.ExpiresAt, err = parseExpiry(c.PostForm("expires_in"))
+	if err != nil {
+		return opts, err
+	}
+
+	if c.PostForm("encrypted") == "true" {
+		opts.Encrypted = true
+		opts.Envelope, err = parseEnvelope(c.PostForm("envelope"))
+		if err != nil {
+			return opts, err
+		}
+	}
+
+	return opts, nil
+}
+
+// Lets the request through if the post's visibility allows it, and returns
+// the Cache-Control header for the response. Otherwise aborts the request and
+// reports false. Private posts are only served through signed links, and may
+// only be cached by the client, for as long as the link is valid.
+func (dc *DogboxController) checkVisibility(
+	c *gin.Context,
+	p *db.Post,
+) (string, bool) {
+	if p.Visibility != db.PostVisibilityPrivate {
+		return "public, max-age=31536000", true
+	}
+
+	sig, exp := c.Query("sig"), c.Query("exp")
+	if sig == "" {
+		c.AbortWithError(http.StatusNotFound, NotFoundError(*p.Filename))
+		return "", false
+	}
+
+	expires, err := verifyPostSignature(
+		dc.cfg.SigningKey,
+		*p.Filename,
+		sig,
+		exp,
+		time.Now(),
+	)
+	if err != nil {
+		c.AbortWithError(http.StatusForbidden, err)
+		return "", false
+	}
+
+	return fmt.Sprintf(
+		"private, max-age=%d",
+		int64(time.Until(expires).Seconds()),
+	), true
+}
+
+// Returns the signature that lets the holder of a link read the named post
+// until the given Unix time.
+func signPost(key []byte, name string, exp int64) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\n%d", name, exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Checks the sig and exp query parameters of a request for the named post.
+// Returns when the signature expires.
+func verifyPostSignature(
+	key []byte,
+	name, sig, exp string,
+	now time.Time,
+) (time.Time, error) {
+	expUnix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return time.Time{}, InvalidSignatureError
+	}
+
+	expected := signPost(key, name, expUnix)
+	if !hmac.Equal([]byte(sig), []byte(expected)) {
+		return time.Time{}, InvalidSignatureError
+	}
+
+	expires := time.Unix(expUnix, 0)
+	if !now.Before(expires) {
+		return time.Time{}, InvalidSignatureError
+	}
+
+	return expires, nil
+}
+
+// Reports whether the API key may manage the post. The admin key, passed as
+// nil, may manage every post; issued keys only their own.
+func ownsPost(key *db.ApiKey, p *db.Post) bool {
+	return key == nil || (p.OwnerID != nil && *p.OwnerID == key.ID)
+}
+
+type sharePostRequest struct {
+	// How long the link stays valid, such as "1h". Defaults to
+	// DOGBOX_SHARE_DEFAULT_TTL.
+	TTL string `json:"ttl"`
+}
+
+type sharePostResponse struct {
+	URL       string    `json:"url"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// Issues a link that serves a post, whatever its visibility, until the
+// requested TTL has passed.
+func (dc *DogboxController) SharePost(c *gin.Context) {
+	name := c.Param("name")
+
+	var req sharePostRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.AbortWithError(http.StatusBadRequest, BadRequestError)
+			return
+		}
+	}
+
+	ttl := dc.cfg.DogboxShareDefaultTTL
+	if req.TTL != "" {
+		d, err := time.ParseDuration(req.TTL)
+		if err != nil {
+			c.AbortWithError(http.StatusBadRequest, InvalidTTLError)
+			return
+		}
+		ttl = d
+	}
+	if ttl <= 0 || ttl > dc.cfg.DogboxShareMaxTTL {
+		c.AbortWithError(http.StatusBadRequest, InvalidTTLError)
+		return
+	}
+
+	p, err := dc.db.GetPostByFilename(c.Request.Context(), &name)
+	if err != nil || !postAvailable(p) {
+		c.AbortWithError(http.StatusNotFound, NotFoundError(name))
+		return
+	}
+
+	if !ownsPost(requestApiKey(c), p) {
+		c.AbortWithError(http.StatusForbidden, NotOwnerError)
+		return
+	}
+
+	expires := time.Now().Add(ttl).Truncate(time.Second)
+
+	exp := expires.Unix()
+	q := url.Values{}
+	q.Set("exp", strconv.FormatInt(exp, 10))
+	q.Set("sig", signPost(dc.cfg.SigningKey, name, exp))
+
+	c.JSON(http.StatusOK, sharePostResponse{
+		URL:       postPaths(p)[0] + "?" + q.Encode(),
+		ExpiresAt: expires,
+	})
+}
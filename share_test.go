@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	"github.com/gin-gonic/gin"
+)
+
+func TestVerifyPostSignature(t *testing.T) {
+	key := []byte("signing key")
+	now := time.Unix(1_700_000_000, 0)
+	exp := now.Add(time.Hour).Unix()
+	sig := signPost(key, "a.png", exp)
+
+	// Flips the first character of the signature.
+	tampered := "A" + sig[1:]
+	if sig[0] == 'A' {
+		tampered = "B" + sig[1:]
+	}
+
+	tests := []struct {
+		name    string
+		key     []byte
+		post    string
+		sig     string
+		exp     string
+		now     time.Time
+		wantErr bool
+	}{
+		{"Valid", key, "a.png", sig, strconv.FormatInt(exp, 10), now, false},
+		{"LastSecond", key, "a.png", sig, strconv.FormatInt(exp, 10), time.Unix(exp-1, 0), false},
+		{"Expired", key, "a.png", sig, strconv.FormatInt(exp, 10), time.Unix(exp, 0), true},
+		{"TamperedSignature", key, "a.png", tampered, strconv.FormatInt(exp, 10), now, true},
+		{"ExtendedExpiry", key, "a.png", sig, strconv.FormatInt(exp+3600, 10), now, true},
+		{"OtherPost", key, "b.png", sig, strconv.FormatInt(exp, 10), now, true},
+		{"OtherKey", []byte("other key"), "a.png", sig, strconv.FormatInt(exp, 10), now, true},
+		{"MissingSignature", key, "a.png", "", strconv.FormatInt(exp, 10), now, true},
+		{"InvalidExpiry", key, "a.png", sig, "soon", now, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			expires, err := verifyPostSignature(tt.key, tt.post, tt.sig, tt.exp, tt.now)
+			if tt.wantErr {
+				if err != InvalidSignatureError {
+					t.Fatalf("got %v, want %v", err, InvalidSignatureError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expires.Unix() != exp {
+				t.Fatalf("expires at %d, want %d", expires.Unix(), exp)
+			}
+		})
+	}
+}
+
+func TestOwnsPost(t *testing.T) {
+	owner := int64(1)
+	owned := &db.Post{OwnerID: &owner}
+	unowned := &db.Post{}
+
+	tests := []struct {
+		name string
+		key  *db.ApiKey
+		post *db.Post
+		want bool
+	}{
+		{"AdminOwned", nil, owned, true},
+		{"AdminUnowned", nil, unowned, true},
+		{"Owner", &db.ApiKey{ID: 1}, owned, true},
+		{"OtherKey", &db.ApiKey{ID: 2}, owned, false},
+		{"Unowned", &db.ApiKey{ID: 1}, unowned, false},
+	}
+
+	for _, tt := range tests {
+		if got := ownsPost(tt.key, tt.post); got != tt.want {
+			t.Errorf("%s: ownsPost = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Returns a context for a GET request to the target.
+func testContext(target string) (*gin.Context, *httptest.ResponseRecorder) {
+	gin.SetMode(gin.TestMode)
+
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, target, nil)
+	return c, w
+}
+
+func TestCheckVisibility(t *testing.T) {
+	dc := &DogboxController{cfg: Config{SigningKey: []byte("signing key")}}
+	name := "a.png"
+	exp := time.Now().Add(time.Hour).Unix()
+
+	signed := url.Values{}
+	signed.Set("exp", strconv.FormatInt(exp, 10))
+	signed.Set("sig", signPost(dc.cfg.SigningKey, name, exp))
+
+	forOther := url.Values{}
+	forOther.Set("exp", strconv.FormatInt(exp, 10))
+	forOther.Set("sig", signPost(dc.cfg.SigningKey, "b.png", exp))
+
+	tests := []struct {
+		name       string
+		visibility db.PostVisibility
+		query      string
+		ok         bool
+		status     int
+		cache      string
+	}{
+		{"Public", db.PostVisibilityPublic, "", true, 0, "public"},
+		{"Unlisted", db.PostVisibilityUnlisted, "", true, 0, "public"},
+		{"PrivateUnsigned", db.PostVisibilityPrivate, "", false, http.StatusNotFound, ""},
+		{"PrivateSigned", db.PostVisibilityPrivate, signed.Encode(), true, 0, "private"},
+		{"PrivateSignedForOther", db.PostVisibilityPrivate, forOther.Encode(), false, http.StatusForbidden, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := testContext(postURL(name) + "?" + tt.query)
+			p := &db.Post{Filename: &name, Visibility: tt.visibility}
+
+			cacheControl, ok := dc.checkVisibility(c, p)
+			if ok != tt.ok {
+				t.Fatalf("checkVisibility = %v, want %v", ok, tt.ok)
+			}
+			if !ok {
+				if c.Writer.Status() != tt.status {
+					t.Fatalf("status %d, want %d", c.Writer.Status(), tt.status)
+				}
+				return
+			}
+			if !strings.HasPrefix(cacheControl, tt.cache+",") {
+				t.Fatalf("Cache-Control = %q, want %s", cacheControl, tt.cache)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	_ "github.com/Fekinox/dogbox-main/internal/store/davstore"
+	_ "github.com/Fekinox/dogbox-main/internal/store/memstore"
+	"github.com/Fekinox/dogbox-main/internal/store/pgstore"
+	_ "github.com/Fekinox/dogbox-main/internal/store/sftpstore"
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	NotEncryptedError = errors.New("Storage is not encrypted")
+	NotCachedError    = errors.New("Storage is not cached")
+	SFTPTieringError  = errors.New(
+		"DOGBOX_SFTP_ADDR cannot be combined with DOGBOX_COLD_DATA_DIR; " +
+			"use DOGBOX_STORAGE_CONFIG instead",
+	)
+)
+
+// Builds the storage backend described by DOGBOX_STORAGE_CONFIG, or by the
+// individual storage settings if no storage configuration file is given. The
+// whole description is validated before any store is created.
+func buildStore(cfg Config, pool pgstore.DB) (store.Store, error) {
+	spec, err := storageSpec(cfg, pool)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.Build(spec)
+}
+
+// Returns the description of the storage backend. A storage configuration
+// file is read as YAML, which includes JSON, after expanding environment
+// variables, so that secrets such as encryption keys can be kept out of it.
+// Postgres stores without a url share the application's connection pool.
+func storageSpec(cfg Config, pool pgstore.DB) (*store.Spec, error) {
+	spec, err := readStorageSpec(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range spec.Find("postgres") {
+		if _, ok := s.Options["url"]; !ok {
+			s.Options["pool"] = pool
+		}
+	}
+
+	return spec, nil
+}
+
+func readStorageSpec(cfg Config) (*store.Spec, error) {
+	if cfg.DogboxStorageConfig == "" {
+		return defaultStorageSpec(cfg)
+	}
+
+	data, err := os.ReadFile(cfg.DogboxStorageConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw map[string]any
+	if err := yaml.Unmarshal([]byte(os.ExpandEnv(string(data))), &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.DogboxStorageConfig, err)
+	}
+
+	spec, err := store.ParseSpec(raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", cfg.DogboxStorageConfig, err)
+	}
+
+	return spec, nil
+}
+
+// Describes the storage backend set up by the individual storage settings: a
+// local store rooted at the data directory, or the database if database
+// storage is enabled, tiered with a second local store if a cold data
+// directory is configured, mirrored to an SFTP server if one is configured,
+// cached if a cache directory is configured, encrypted if a keyring is
+// configured, and compressed if compression is enabled. The cache sits inside
+// the encryption so that it only ever holds ciphertext, and compression has
+// to sit outside of encryption, since ciphertext does not compress.
+func defaultStorageSpec(cfg Config) (*store.Spec, error) {
+	local := func(root string) *store.Spec {
+		return &store.Spec{
+			Type: "local",
+			Options: map[string]any{
+				"root":         root,
+				"shard_levels": cfg.DogboxShardLevels,
+				"shard_width":  cfg.DogboxShardWidth,
+			},
+		}
+	}
+	wrap := func(typ string, inner *store.Spec, opts map[string]any) *store.Spec {
+		return &store.Spec{
+			Type:    typ,
+			Stores:  []*store.Spec{inner},
+			Options: opts,
+		}
+	}
+
+	spec := local(cfg.DogboxDataDir)
+	if cfg.DogboxDatabaseStorage {
+		spec = &store.Spec{Type: "postgres", Options: map[string]any{}}
+	}
+
+	if cfg.DogboxColdDataDir != "" {
+		spec = &store.Spec{
+			Type:   "tiered",
+			Stores: []*store.Spec{spec, local(cfg.DogboxColdDataDir)},
+		}
+	}
+
+	if cfg.DogboxSFTPAddr != "" {
+		// The tiering job could not find a tiered store inside a mirror.
+		if cfg.DogboxColdDataDir != "" {
+			return nil, SFTPTieringError
+		}
+
+		spec = &store.Spec{
+			Type: "mirror",
+			Stores: []*store.Spec{spec, {
+				Type: "sftp",
+				Options: map[string]any{
+					"addr":        cfg.DogboxSFTPAddr,
+					"user":        cfg.DogboxSFTPUser,
+					"key_file":    cfg.DogboxSFTPKeyFile,
+					"known_hosts": cfg.DogboxSFTPKnownHosts,
+					"root":        cfg.DogboxSFTPRoot,
+					"pool_size":   cfg.DogboxSFTPPoolSize,
+				},
+			}},
+		}
+	}
+
+	if cfg.DogboxCacheDir != "" {
+		spec = wrap("cached", spec, map[string]any{
+			"dir":         cfg.DogboxCacheDir,
+			"disk_size":   cfg.DogboxCacheDiskSize,
+			"memory_size": cfg.DogboxCacheMemorySize,
+		})
+	}
+
+	if cfg.DogboxEncryptionKeys != "" {
+		spec = wrap("encrypted", spec, map[string]any{
+			"keys":   cfg.DogboxEncryptionKeys,
+			"key_id": cfg.DogboxEncryptionKeyID,
+		})
+	}
+
+	if cfg.DogboxCompression {
+		spec = wrap("compressed", spec, nil)
+	}
+
+	return spec, nil
+}
+
+// Returns every local store in the storage backend.
+func localStores(cfg Config) ([]*store.LocalStore, error) {
+	// Local stores never touch the database.
+	spec, err := storageSpec(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var stores []*store.LocalStore
+	for _, s := range spec.Find("local") {
+		st, err := store.Build(s)
+		if err != nil {
+			return nil, err
+		}
+		stores = append(stores, st.(*store.LocalStore))
+	}
+
+	return stores, nil
+}
+
+// Command-line entry point that moves every stored file into the configured
+// directory layout. Safe to run while the server is up.
+func runRelayout(ctx context.Context, dc *DogboxController, args []string) error {
+	stores, err := localStores(dc.cfg)
+	if err != nil {
+		return err
+	}
+
+	for _, l := range stores {
+		moved, err := l.Migrate(ctx)
+		log.Printf("relayout: moved %d files\n", moved)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Command-line entry point that rewrites every stored object under the
+// current encryption key.
+func runRekey(ctx context.Context, dc *DogboxController, args []string) error {
+	e, ok := store.As[*store.EncryptedStore](dc.store)
+	if !ok {
+		return NotEncryptedError
+	}
+
+	rewritten, failed := 0, 0
+	err := store.Walk(ctx, e, "", func(o store.ObjectInfo) error {
+		ok, err := e.Rekey(ctx, o.Path)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			failed++
+			log.Printf("rekey: %s: %v\n", o.Path, err)
+			return nil
+		}
+		if ok {
+			rewritten++
+		}
+		return nil
+	})
+
+	log.Printf("rekey: rewrote %d objects, %d failures\n", rewritten, failed)
+
+	return err
+}
+
+// Reports the hit and miss statistics of the storage cache.
+func (dc *DogboxController) GetCacheStats(c *gin.Context) {
+	cache, ok := store.As[*store.CachedStore](dc.store)
+	if !ok {
+		c.AbortWithError(http.StatusNotFound, NotCachedError)
+		return
+	}
+
+	c.JSON(http.StatusOK, cache.Stats())
+}
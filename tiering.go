@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log"
+	"time"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/jackc/pgx/v5/pgtype"
+)
+
+var NotTieredError = errors.New("Storage is not tiered")
+
+// Returns the tier that holds the object of a blob. Storage that is not
+// tiered only has a hot tier.
+func (dc *DogboxController) blobTier(
+	ctx context.Context,
+	st store.Store,
+	hash string,
+) (db.StorageTier, error) {
+	tiered, ok := store.As[*store.TieredStore](st)
+	if !ok {
+		return db.StorageTierHot, nil
+	}
+
+	cold, err := tiered.IsCold(ctx, dc.getBlobPath(hash))
+	if err != nil {
+		return "", err
+	}
+	if cold {
+		return db.StorageTierCold, nil
+	}
+	return db.StorageTierHot, nil
+}
+
+// Moves every hot post that is older than DOGBOX_TIER_MAX_AGE, or has not
+// been read for DOGBOX_TIER_MAX_IDLE, to the cold tier and records the move
+// in the database. Either limit can be disabled by setting it to zero.
+// Returns the number of posts that were moved.
+func (dc *DogboxController) DemotePosts(ctx context.Context) (int, error) {
+	tiered, ok := store.As[*store.TieredStore](dc.store)
+	if !ok {
+		return 0, NotTieredError
+	}
+
+	now := time.Now()
+	params := db.ListPostsToDemoteParams{PageSize: POST_BATCH_SIZE}
+	if dc.cfg.DogboxTierMaxAge > 0 {
+		params.CreatedBefore = pgtype.Timestamptz{
+			Time:  now.Add(-dc.cfg.DogboxTierMaxAge),
+			Valid: true,
+		}
+	}
+	if dc.cfg.DogboxTierMaxIdle > 0 {
+		params.AccessedBefore = pgtype.Timestamptz{
+			Time:  now.Add(-dc.cfg.DogboxTierMaxIdle),
+			Valid: true,
+		}
+	}
+
+	moved := 0
+	for {
+		posts, err := dc.db.ListPostsToDemote(ctx, params)
+		if err != nil {
+			return moved, err
+		}
+		if len(posts) == 0 {
+			return moved, nil
+		}
+
+		for _, p := range posts {
+			params.AfterID = p.ID
+
+			err := tiered.Demote(ctx, dc.objectPath(p))
+			// Posts with the same contents share a blob, which only has to
+			// be moved once.
+			if errors.Is(err, fs.ErrNotExist) {
+				err = nil
+			}
+			if err != nil {
+				if ctx.Err() != nil {
+					return moved, ctx.Err()
+				}
+				log.Printf("tier: post %d: %v\n", p.ID, err)
+				continue
+			}
+
+			if err := dc.db.SetPostTier(ctx, db.SetPostTierParams{
+				Tier: db.StorageTierCold,
+				ID:   p.ID,
+			}); err != nil {
+				return moved, err
+			}
+			moved++
+		}
+	}
+}
+
+// Runs DemotePosts in the background every DOGBOX_TIER_INTERVAL until the
+// context is canceled.
+func (dc *DogboxController) StartTierMover(ctx context.Context) {
+	interval := dc.cfg.DogboxTierInterval
+	if interval <= 0 {
+		return
+	}
+	if _, ok := store.As[*store.TieredStore](dc.store); !ok {
+		return
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			moved, err := dc.DemotePosts(ctx)
+			if err != nil && ctx.Err() == nil {
+				log.Printf("tier: %v\n", err)
+			}
+			if moved > 0 {
+				log.Printf("tier: moved %d posts to cold storage\n", moved)
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// Command-line entry point for a single pass of the tier mover.
+func runTier(ctx context.Context, dc *DogboxController, args []string) error {
+	moved, err := dc.DemotePosts(ctx)
+	log.Printf("tier: moved %d posts to cold storage\n", moved)
+
+	return err
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	db "github.com/Fekinox/dogbox-main/db/sqlc"
+	store "github.com/Fekinox/dogbox-main/internal/store"
+	"github.com/Fekinox/dogbox-main/internal/store/memstore"
+)
+
+func TestDedupKeepsColdTier(t *testing.T) {
+	ctx := context.Background()
+	dc := newTestController(t)
+	tiered := store.MakeTieredStore(memstore.MakeMemStore(), memstore.MakeMemStore())
+	dc.store = tiered
+
+	data := []byte("shared contents")
+	tierOf := func(name string) db.StorageTier {
+		t.Helper()
+
+		p, err := dc.db.GetPostByFilename(ctx, &name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.Tier
+	}
+
+	w, first := upload(t, dc, "a.txt", data, nil)
+	if first == "" {
+		t.Fatalf("uploading: %d %s", w.Code, w.Body)
+	}
+	if tier := tierOf(first); tier != db.StorageTierHot {
+		t.Fatalf("new blob is %s, want %s", tier, db.StorageTierHot)
+	}
+
+	p, err := dc.db.GetPostByFilename(ctx, &first)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tiered.Demote(ctx, dc.objectPath(p)); err != nil {
+		t.Fatal(err)
+	}
+
+	w, second := upload(t, dc, "b.txt", data, nil)
+	if second == "" {
+		t.Fatalf("uploading: %d %s", w.Code, w.Body)
+	}
+	if tier := tierOf(second); tier != db.StorageTierCold {
+		t.Fatalf("post sharing a cold blob is %s, want %s", tier, db.StorageTierCold)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Largest envelope accepted with an encrypted upload, in bytes.
+const MAX_ENVELOPE_SIZE = 4096
+
+var InvalidEnvelopeError = errors.New(
+	"Encrypted uploads need a JSON envelope with an iv, of at most 4096 bytes",
+)
+
+// The envelope of an encrypted upload, as read by the viewer. The file is
+// encrypted with AES-GCM under a 256-bit key that never reaches the server:
+// the client puts it, base64url-encoded, in the fragment of the viewer URL.
+// Binary values are base64url-encoded. Any other fields are kept for the
+// client.
+type envelope struct {
+	// IV of the file's ciphertext.
+	IV string `json:"iv"`
+	// Optional ciphertext, under the same key, of a JSON object with the
+	// file's original "name" and "type", and its IV.
+	Meta   string `json:"meta,omitempty"`
+	MetaIV string `json:"meta_iv,omitempty"`
+}
+
+// Checks the envelope given with an encrypted upload.
+func parseEnvelope(s string) (*string, error) {
+	if len(s) > MAX_ENVELOPE_SIZE {
+		return nil, InvalidEnvelopeError
+	}
+
+	var env envelope
+	if err := json.Unmarshal([]byte(s), &env); err != nil || env.IV == "" {
+		return nil, InvalidEnvelopeError
+	}
+	if env.Meta != "" && env.MetaIV == "" {
+		return nil, InvalidEnvelopeError
+	}
+
+	return &s, nil
+}
+
+var viewerPage = template.Must(template.New("viewer").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Name}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+img, pre { max-width: 100%; }
+pre { white-space: pre-wrap; }
+</style>
+</head>
+<body>
+<p id="status">Decrypting...</p>
+<form id="unlock" hidden>
+<input type="password" id="password" required>
+<button type="submit">Unlock</button>
+</form>
+<div id="content"></div>
+<script>
+const fileName = {{.Name}};
+const source = {{.Source}} + location.search;
+const env = JSON.parse({{.Envelope}});
+
+const statusLine = document.getElementById("status");
+const unlock = document.getElementById("unlock");
+const content = document.getElementById("content");
+
+function decode(s) {
+	s = s.replace(/-/g, "+").replace(/_/g, "/");
+	return Uint8Array.from(atob(s), (c) => c.charCodeAt(0));
+}
+
+async function decrypt(key, iv, data) {
+	return crypto.subtle.decrypt({ name: "AES-GCM", iv: decode(iv) }, key, data);
+}
+
+async function show(password) {
+	const raw = location.hash.slice(1);
+	if (!raw) {
+		statusLine.textContent = "The link is missing its key.";
+		return;
+	}
+	const key = await crypto.subtle.importKey(
+		"raw", decode(raw), "AES-GCM", false, ["decrypt"]);
+
+	const headers = password ? { "X-Dogbox-Password": password } : {};
+	const res = await fetch(source, { headers, credentials: "same-origin" });
+	if (res.status === 401) {
+		statusLine.textContent = password ? "Wrong password." : "Password required.";
+		unlock.hidden = false;
+		return;
+	}
+	if (!res.ok) {
+		statusLine.textContent = "Could not load the file (" + res.status + ").";
+		return;
+	}
+	unlock.hidden = true;
+
+	let meta = {};
+	if (env.meta) {
+		const m = await decrypt(key, env.meta_iv, decode(env.meta));
+		meta = JSON.parse(new TextDecoder().decode(m));
+	}
+	const data = await decrypt(key, env.iv, await res.arrayBuffer());
+
+	const blob = new Blob([data], {
+		type: meta.type || "application/octet-stream",
+	});
+	const url = URL.createObjectURL(blob);
+
+	if (blob.type.startsWith("image/")) {
+		const img = document.createElement("img");
+		img.src = url;
+		content.append(img);
+	} else if (blob.type.startsWith("text/")) {
+		const pre = document.createElement("pre");
+		pre.textContent = await blob.text();
+		content.append(pre);
+	}
+
+	const link = document.createElement("a");
+	link.href = url;
+	link.download = meta.name || fileName;
+	link.textContent = "Download " + link.download;
+	statusLine.replaceChildren(link);
+}
+
+unlock.addEventListener("submit", (e) => {
+	e.preventDefault();
+	show(document.getElementById("password").value).catch(() => {
+		statusLine.textContent = "Could not decrypt the file.";
+	});
+});
+
+show().catch(() => {
+	statusLine.textContent = "Could not decrypt the file.";
+});
+</script>
+</body>
+</html>
+`))
+
+// Serves the page that decrypts an encrypted post in the browser. The page
+// fetches the ciphertext through GetFile, so the post's visibility, password
+// and download limit apply as usual.
+func (dc *DogboxController) ViewPost(c *gin.Context) {
+	name := c.Param("name")
+
+	p, err := dc.db.GetPostByFilename(c.Request.Context(), &name)
+	if err != nil || !postAvailable(p) || !p.Encrypted ||
+		p.Envelope == nil {
+		c.AbortWithError(http.StatusNotFound, NotFoundError(name))
+		return
+	}
+
+	if _, ok := dc.checkVisibility(c, p); !ok {
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header(
+		"Content-Security-Policy",
+		"default-src 'none'; script-src 'unsafe-inline'; "+
+			"style-src 'unsafe-inline'; img-src blob:; connect-src 'self'",
+	)
+	c.Header("Content-Type", "text/html; charset=utf-8")
+	c.Status(http.StatusOK)
+	viewerPage.Execute(c.Writer, gin.H{
+		"Name":     name,
+		"Source":   postURL(name),
+		"Envelope": *p.Envelope,
+	})
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseEnvelope(t *testing.T) {
+	tests := []struct {
+		name     string
+		envelope string
+		ok       bool
+	}{
+		{"IVOnly", `{"iv":"AAECAwQFBgcICQoL"}`, true},
+		{"WithMeta", `{"iv":"AAEC","meta":"ZGF0YQ","meta_iv":"CQoL"}`, true},
+		{"ExtraFields", `{"iv":"AAEC","v":2,"kdf":{"name":"PBKDF2"}}`, true},
+		{"Empty", ``, false},
+		{"NotJSON", `iv=AAEC`, false},
+		{"NotObject", `["AAEC"]`, false},
+		{"MissingIV", `{"meta":"ZGF0YQ","meta_iv":"CQoL"}`, false},
+		{"EmptyIV", `{"iv":""}`, false},
+		{"MetaWithoutIV", `{"iv":"AAEC","meta":"ZGF0YQ"}`, false},
+		{"TooLarge", `{"iv":"AAEC","pad":"` + strings.Repeat("a", MAX_ENVELOPE_SIZE) + `"}`, false},
+	}
+
+	for _, tt := range tests {
+		got, err := parseEnvelope(tt.envelope)
+		if !tt.ok {
+			if err != InvalidEnvelopeError {
+				t.Errorf("%s: got error %v, want %v", tt.name, err, InvalidEnvelopeError)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		// The envelope is kept as given, fields the server does not know
+		// included.
+		if *got != tt.envelope {
+			t.Errorf("%s: stored %q, want %q", tt.name, *got, tt.envelope)
+		}
+	}
+}